@@ -0,0 +1,72 @@
+package jj
+
+// An UpdateBuilder accumulates Updates, which are then applied to a Journal
+// as a single atomic set. An UpdateBuilder is not safe for concurrent use.
+type UpdateBuilder struct {
+	j   *Journal
+	us  []Update
+	err error // first invalid path, reported by Commit
+}
+
+// Begin returns an UpdateBuilder for j.
+func (j *Journal) Begin() *UpdateBuilder {
+	return &UpdateBuilder{j: j}
+}
+
+// Set adds an Update that sets the value at path to val.
+func (b *UpdateBuilder) Set(path string, val interface{}) *UpdateBuilder {
+	if b.validate(path) {
+		b.us = append(b.us, NewUpdate(path, val))
+	}
+	return b
+}
+
+// Append adds an Update that appends val to the array at path.
+func (b *UpdateBuilder) Append(path string, val interface{}) *UpdateBuilder {
+	if b.validate(path) {
+		b.us = append(b.us, NewAppendUpdates(path, val)...)
+	}
+	return b
+}
+
+// Delete adds an Update that deletes the value at path.
+func (b *UpdateBuilder) Delete(path string) *UpdateBuilder {
+	if b.validate(path) {
+		b.us = append(b.us, NewDeleteUpdate(path))
+	}
+	return b
+}
+
+// validate checks path, recording the first invalid path so that Commit can
+// report it.
+func (b *UpdateBuilder) validate(path string) bool {
+	err := ValidatePath(path)
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	return err == nil
+}
+
+// Commit applies the accumulated Updates to the Journal as a single set. The
+// builder is then reset, and may be reused. If any of the paths passed to the
+// builder were invalid (see ValidatePath), Commit applies nothing and returns
+// an error wrapping ErrInvalidPath. If no Updates have been accumulated,
+// Commit does nothing.
+func (b *UpdateBuilder) Commit() error {
+	if b.err != nil {
+		err := b.err
+		b.Discard()
+		return err
+	} else if len(b.us) == 0 {
+		return nil
+	}
+	err := b.j.Update(b.us)
+	b.us = nil
+	return err
+}
+
+// Discard drops the accumulated Updates without applying them.
+func (b *UpdateBuilder) Discard() {
+	b.us = nil
+	b.err = nil
+}
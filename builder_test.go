@@ -0,0 +1,45 @@
+package jj
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUpdateBuilder(t *testing.T) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, map[string]interface{}{"x": 0, "y": []int{1}, "z": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := j.Begin().Set("x", 1).Append("y", 2).Delete("z")
+	if string(j.Snapshot()) != `{"x":0,"y":[1],"z":true}` {
+		t.Fatalf("updates should not be applied before Commit: %s", j.Snapshot())
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"x":1,"y":[1,2]}` {
+		t.Fatalf("wrong object after Commit: %s", j.Snapshot())
+	} else if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 2 {
+		t.Fatalf("updates should have been written as a single set, got %v lines", n)
+	}
+
+	// discarded updates are never written
+	b.Set("x", 2).Discard()
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	} else if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 2 {
+		t.Fatalf("empty Commit should not write a set, got %v lines", n)
+	} else if string(j.Snapshot()) != `{"x":1,"y":[1,2]}` {
+		t.Fatalf("discarded updates should not be applied: %s", j.Snapshot())
+	}
+
+	// appending to the root array
+	j, err = NewJournal(nil, &buf, []int{})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j.Begin().Append("", 1).Append("", 2).Commit(); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `[1,2]` {
+		t.Fatalf("wrong object: %s", j.Snapshot())
+	}
+}
@@ -0,0 +1,123 @@
+package jj
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// Diff returns a set of Updates that transforms old into new. Objects and
+// arrays are compared recursively, so that only the elements that differ are
+// updated; however, if updating a container element-by-element would be
+// larger than replacing it outright (e.g. because an array was reordered),
+// the container is replaced outright. Objects and arrays are compared
+// textually, ignoring insignificant whitespace; thus, reordering the keys of
+// an object produces Updates, even though the objects are equivalent.
+//
+// If old and new are identical (ignoring whitespace), Diff returns nil. If old
+// is not valid JSON, Diff returns a single Update that replaces it with new. If
+// new is not valid JSON, Diff returns nil.
+func Diff(old, new json.RawMessage) []Update {
+	var a, b bytes.Buffer
+	if err := json.Compact(&b, new); err != nil {
+		return nil
+	} else if err := json.Compact(&a, old); err != nil {
+		return []Update{{Path: "", Value: b.Bytes()}}
+	}
+	return diff(nil, "", a.Bytes(), b.Bytes())
+}
+
+// diff appends to us the Updates that transform a into b, both of which are
+// located at path and must be compacted JSON.
+func diff(us []Update, path string, a, b []byte) []Update {
+	if bytes.Equal(a, b) {
+		return us
+	}
+	start := len(us)
+	switch {
+	case a[0] == '{' && b[0] == '{':
+		us = diffObjects(us, path, a, b)
+	case a[0] == '[' && b[0] == '[':
+		us = diffArrays(us, path, a, b)
+	default:
+		return append(us, Update{Path: path, Value: b})
+	}
+	// replace the container outright if that would be smaller
+	replace := Update{Path: path, Value: b}
+	var n int
+	for _, u := range us[start:] {
+		n += updateSize(u)
+	}
+	if n >= updateSize(replace) {
+		us = append(us[:start], replace)
+	}
+	return us
+}
+
+// joinPath returns the path of acc within the element at path.
+func joinPath(path, acc string) string {
+	if path == "" {
+		return acc
+	}
+	return path + "." + acc
+}
+
+func diffObjects(us []Update, path string, a, b []byte) []Update {
+	members := func(obj []byte) (keys []string, vals map[string][]byte) {
+		vals = make(map[string][]byte)
+		it, _ := newElemIter(obj)
+		for it.next() {
+			key := unescape(it.key)
+			if _, ok := vals[key]; !ok {
+				keys = append(keys, key)
+			}
+			vals[key] = obj[it.off:it.end] // like encoding/json, the last key wins
+		}
+		return keys, vals
+	}
+	akeys, avals := members(a)
+	bkeys, bvals := members(b)
+	if path == "" {
+		// a top-level empty key cannot be expressed as a path
+		_, inA := avals[""]
+		_, inB := bvals[""]
+		if inA || inB {
+			return append(us, Update{Path: path, Value: b})
+		}
+	}
+	for _, key := range akeys {
+		keyPath := joinPath(path, EscapeKey(key))
+		if bval, ok := bvals[key]; !ok {
+			us = append(us, Update{Path: keyPath, Op: OpDelete})
+		} else {
+			us = diff(us, keyPath, avals[key], bval)
+		}
+	}
+	for _, key := range bkeys {
+		if _, ok := avals[key]; !ok {
+			us = append(us, Update{Path: joinPath(path, EscapeKey(key)), Value: bvals[key], Op: OpUpsert})
+		}
+	}
+	return us
+}
+
+func diffArrays(us []Update, path string, a, b []byte) []Update {
+	elems := func(arr []byte) (vals [][]byte) {
+		it, _ := newElemIter(arr)
+		for it.next() {
+			vals = append(vals, arr[it.off:it.end])
+		}
+		return vals
+	}
+	avals, bvals := elems(a), elems(b)
+	for i := 0; i < len(avals) && i < len(bvals); i++ {
+		us = diff(us, joinPath(path, strconv.Itoa(i)), avals[i], bvals[i])
+	}
+	for i := len(avals); i < len(bvals); i++ {
+		us = append(us, Update{Path: joinPath(path, "-"), Value: bvals[i], Op: OpInsert})
+	}
+	for i := len(avals) - 1; i >= len(bvals); i-- {
+		us = append(us, Update{Path: joinPath(path, strconv.Itoa(i)), Op: OpDelete})
+	}
+	return us
+}
@@ -0,0 +1,51 @@
+package jj
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		old, new string
+		exp      string // expected Updates, or "" to only check the result
+	}{
+		{`{"a":1}`, `{"a":1}`, `null`},
+		{`{"a":1}`, ` { "a" : 1 } `, `null`},
+		{`{"a":{"b":{"c":1,"d":"xxxxxxxx"}}}`, `{"a":{"b":{"c":2,"d":"xxxxxxxx"}}}`, `[{"p":"a.b.c","v":2}]`},
+		{`{"a":1,"b":2,"c":"xxxxxxxxxxxxxxxxxxxxxxxxxxxx"}`, `{"b":2,"c":"xxxxxxxxxxxxxxxxxxxxxxxxxxxx","d":3}`, `[{"p":"a","o":"d"},{"p":"d","o":"u","v":3}]`},
+		{`{"a":[1,2],"b":"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"}`, `{"a":[1,2,3],"b":"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"}`, `[{"p":"a.-","o":"i","v":3}]`},
+		{`{"a":[1,2,3,4],"b":"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"}`, `{"a":[1,2],"b":"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"}`, `[{"p":"a","v":[1,2]}]`},
+		{`{"a":{"x":1},"b":"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"}`, `{"a":[1],"b":"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"}`, `[{"p":"a","v":[1]}]`},
+		{`[1,2,3,4,5]`, `[5,4,3,2,1]`, `[{"p":"","v":[5,4,3,2,1]}]`},
+		{`{"a.b":{"c":1,"d":"xxxxxxxxxxxxxxxxxxxxx"}}`, `{"a.b":{"c":2,"d":"xxxxxxxxxxxxxxxxxxxxx"}}`, `[{"p":"a\\.b.c","v":2}]`},
+		{`{"":1}`, `{"":2}`, `[{"p":"","v":{"":2}}]`},
+		{`1`, `"foo"`, `[{"p":"","v":"foo"}]`},
+		{`{`, `{"a":1}`, `[{"p":"","v":{"a":1}}]`},
+		{`{"a":1}`, `{`, `null`},
+		{`{"a":[{"b":1,"c":[1,2,3]},{"d":null}],"e":{"f":{"g":true}}}`, `{"a":[{"b":2,"c":[1,3]},{"d":{}},7],"e":{"f":{"h":false}},"i":[]}`, ``},
+		{`{"a":{"b":[1,[2,[3]]]}}`, `{"a":{"b":[1,[2,[4,5]]],"c":{}}}`, ``},
+	}
+	for _, test := range tests {
+		us := Diff(json.RawMessage(test.old), json.RawMessage(test.new))
+		if test.exp != "" {
+			if data, _ := json.Marshal(us); string(data) != test.exp {
+				t.Errorf("Diff(%s, %s): expected %s, got %s", test.old, test.new, test.exp, data)
+			}
+		}
+		if !json.Valid([]byte(test.new)) {
+			continue
+		}
+		obj := json.RawMessage(test.old)
+		for _, u := range us {
+			obj, _ = u.apply(obj)
+		}
+		var got, exp interface{}
+		json.Unmarshal(obj, &got)
+		json.Unmarshal([]byte(test.new), &exp)
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("Diff(%s, %s): applying Updates produced %s", test.old, test.new, obj)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package jj
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// Each line of a Journal (i.e. the initial object and each update set) may be
+// encoded before being written, and decoded after being read. By default,
+// lines are stored as plain JSON.
+//
+// If compression is enabled, each line is compressed into a standalone gzip
+// stream, which is then base64-encoded (so that it cannot contain a newline)
+// and prefixed with a '~'. Each line thus forms an independent frame: a
+// corrupted frame affects only its own update set, and replay continues with
+// the next line, exactly as it does for a malformed set of plain JSON. Since
+// gzip and base64 both add overhead, small lines (which typically do not
+// compress well anyway) are left as plain JSON; they are distinguished by
+// their lack of a '~' prefix.
+//
+// If encryption is enabled, each line is sealed with AES-256-GCM under a
+// random nonce, and the nonce and ciphertext are base64-encoded. Encryption
+// authenticates each line individually; it does not prevent an attacker from
+// deleting, duplicating, or reordering whole lines.
+//
+// If checksums are enabled, each line is followed by a space and the
+// hex-encoded big-endian CRC-32 (IEEE) checksum of the preceding bytes, e.g.:
+//
+//    [{"p":"foo","v":3}] 9baa66d9
+//
+// Lines are compressed, then encrypted, then checksummed; thus the checksum
+// covers the final bytes of the line.
+//
+// The same options must be supplied each time a Journal is opened; otherwise,
+// its lines will not decode correctly.
+//
+// There is deliberately no binary encoding of values (e.g. CBOR). Since each
+// line must be newline-free, binary data would have to be base64-encoded,
+// which costs about as much space as a binary encoding saves over JSON; and
+// since objects are manipulated in memory as JSON, every line would have to be
+// transcoded during replay, making it slower rather than faster. Journals for
+// which size matters should use WithCompression; BenchmarkEncodingReplay
+// compares the size and replay time of each encoding.
+
+// checksumSize is the number of bytes added to each line by WithChecksums.
+const checksumSize = len(" 01234567")
+
+var (
+	errChecksum = fmt.Errorf("%w: checksum mismatch", ErrMalformed)
+	errDecrypt  = fmt.Errorf("%w: decryption failed", ErrMalformed)
+)
+
+// WithChecksums causes a checksum to be appended to each line of the Journal,
+// and verified when the Journal is replayed. Update sets with invalid
+// checksums are treated as malformed. An initial object with an invalid
+// checksum causes OpenJournal to return an error.
+func WithChecksums() Option {
+	return func(j *Journal) {
+		j.checksums = true
+	}
+}
+
+// WithCompression causes each line of the Journal to be gzip-compressed.
+// Update sets that cannot be decompressed are treated as malformed.
+func WithCompression() Option {
+	return func(j *Journal) {
+		j.compress = true
+	}
+}
+
+// WithEncryption causes each line of the Journal to be encrypted with the
+// supplied key. Update sets that fail authentication are treated as
+// malformed. An initial object that fails authentication (e.g. because the
+// wrong key was supplied) causes OpenJournal to return an error.
+func WithEncryption(key [32]byte) Option {
+	return func(j *Journal) {
+		block, _ := aes.NewCipher(key[:]) // key length is always valid
+		j.aead, _ = cipher.NewGCM(block)  // never fails for AES
+	}
+}
+
+// encoded reports whether j's lines are stored in a format other than plain
+// JSON.
+func (j *Journal) encoded() bool {
+	return j.checksums || j.compress || j.aead != nil
+}
+
+// encodeLine encodes line, which may be modified in place.
+func (j *Journal) encodeLine(line []byte) []byte {
+	if j.compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(line) // writes to a bytes.Buffer cannot fail
+		zw.Close()
+		if n := 1 + base64.StdEncoding.EncodedLen(buf.Len()); n < len(line) {
+			line = make([]byte, n)
+			line[0] = '~'
+			base64.StdEncoding.Encode(line[1:], buf.Bytes())
+		}
+	}
+	if j.aead != nil {
+		nonce := make([]byte, j.aead.NonceSize(), j.aead.NonceSize()+len(line)+j.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			panic("jj: could not generate nonce: " + err.Error())
+		}
+		sealed := j.aead.Seal(nonce, nonce, line, nil)
+		line = make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+		base64.StdEncoding.Encode(line, sealed)
+	}
+	if j.checksums {
+		var sum [4]byte
+		crc := crc32.ChecksumIEEE(line)
+		sum[0], sum[1], sum[2], sum[3] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+		line = append(line, ' ')
+		line = append(line, hex.EncodeToString(sum[:])...)
+	}
+	return line
+}
+
+// decodeLine decodes line, which may be modified in place. If limit is
+// positive, a compressed line whose decompressed size exceeds limit is
+// rejected with ErrTooLarge, without decompressing the remainder.
+func (j *Journal) decodeLine(line []byte, limit int64) ([]byte, error) {
+	line = bytes.TrimSpace(line)
+	if j.checksums {
+		i := bytes.LastIndexByte(line, ' ')
+		if i < 0 {
+			return nil, errChecksum
+		}
+		var sum [4]byte
+		if n, err := hex.Decode(sum[:], line[i+1:]); err != nil || n != len(sum) {
+			return nil, errChecksum
+		}
+		line = line[:i]
+		crc := uint32(sum[0])<<24 | uint32(sum[1])<<16 | uint32(sum[2])<<8 | uint32(sum[3])
+		if crc32.ChecksumIEEE(line) != crc {
+			return nil, errChecksum
+		}
+	}
+	if j.aead != nil {
+		sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+		n, err := base64.StdEncoding.Decode(sealed, line)
+		if err != nil || n < j.aead.NonceSize() {
+			return nil, errDecrypt
+		}
+		nonce, ciphertext := sealed[:j.aead.NonceSize()], sealed[j.aead.NonceSize():n]
+		line, err = j.aead.Open(ciphertext[:0], nonce, ciphertext, nil)
+		if err != nil {
+			return nil, errDecrypt
+		}
+	}
+	if j.compress && len(line) > 0 && line[0] == '~' {
+		line = line[1:]
+		frame := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+		n, err := base64.StdEncoding.Decode(frame, line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not decode compressed frame: %v", ErrMalformed, err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(frame[:n]))
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not decompress line: %v", ErrMalformed, err)
+		}
+		var r io.Reader = zr
+		if limit > 0 {
+			r = io.LimitReader(zr, limit+1)
+		}
+		line, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not decompress line: %v", ErrMalformed, err)
+		} else if limit > 0 && int64(len(line)) > limit {
+			return nil, fmt.Errorf("%w: decompressed line exceeds limit of %v bytes", ErrTooLarge, limit)
+		}
+	}
+	return line, nil
+}
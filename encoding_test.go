@@ -0,0 +1,330 @@
+package jj
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestJournalChecksums(t *testing.T) {
+	type foo struct {
+		X int `json:"x"`
+	}
+	tf, cleanup := tempFile(t, "TestJournalChecksums")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), foo{X: 1}, WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 4; i++ {
+		if err := j.Update([]Update{NewUpdate("x", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	var f foo
+	j, err = OpenJournal(j.filename, &f, WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if f.X != 4 || j.ReplaySummary().SkippedSets != 0 {
+		t.Fatal("journal was not replayed correctly:", f, j.ReplaySummary())
+	}
+
+	// flip a byte in the middle of the last set; the result is still valid
+	// JSON, but the checksum should reject it
+	data, err := ioutil.ReadFile(j.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.LastIndex(data, []byte(`"v":4`))
+	data[i+4] = '5'
+	if err := ioutil.WriteFile(j.filename, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	j, err = OpenJournal(j.filename, &f, WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if f.X != 3 || j.ReplaySummary().SkippedSets != 1 {
+		t.Fatal("corrupted set should have been skipped:", f, j.ReplaySummary())
+	}
+	r, err := Verify(j.filename, WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	} else if r.Sets[2].Status != SetMalformed {
+		t.Fatal("Verify should report corrupted set:", r.Sets)
+	}
+
+	// corrupting the initial object should cause an error
+	data[1] = ' '
+	if err := ioutil.WriteFile(j.filename, data, 0666); err != nil {
+		t.Fatal(err)
+	} else if _, err := OpenJournal(j.filename, &f, WithChecksums()); err != errChecksum {
+		t.Fatal("expected checksum error, got", err)
+	}
+}
+
+func TestEncodeLine(t *testing.T) {
+	j := &Journal{checksums: true}
+	line := j.encodeLine([]byte(`[{"p":"foo","v":3}]`))
+	if string(line) != `[{"p":"foo","v":3}] 9baa66d9` {
+		t.Fatalf("unexpected encoding: %s", line)
+	}
+	for _, bad := range []string{
+		`[{"p":"foo","v":3}]`,
+		`[{"p":"foo","v":3}] 9baa66d`,
+		`[{"p":"foo","v":3}] 9baa66d8`,
+		`[{"p":"foo","v":4}] 9baa66d9`,
+		`[{"p":"foo","v":3}] zzzzzzzz`,
+	} {
+		if _, err := j.decodeLine([]byte(bad), 0); err != errChecksum {
+			t.Errorf("expected checksum error for %s, got %v", bad, err)
+		}
+	}
+	dec, err := j.decodeLine(append(line, '\r', '\n'), 0)
+	if err != nil || string(dec) != `[{"p":"foo","v":3}]` {
+		t.Fatalf("unexpected decoding: %s %v", dec, err)
+	}
+}
+
+func TestJournalCompression(t *testing.T) {
+	type foo struct {
+		X string `json:"x"`
+		Y int    `json:"y"`
+	}
+	long := strings.Repeat("a", 200)
+	for _, opts := range [][]Option{
+		{WithCompression()},
+		{WithCompression(), WithChecksums()},
+	} {
+		var buf bytes.Buffer
+		j, err := NewJournal(nil, &buf, foo{X: long}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 2; i <= 4; i++ {
+			if err := j.Update([]Update{NewUpdate("x", long+fmt.Sprint(i))}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// small sets are not compressed
+		if err := j.Update([]Update{NewUpdate("y", 5)}); err != nil {
+			t.Fatal(err)
+		}
+		lines := bytes.Split(buf.Bytes(), []byte("\n"))
+		if bytes.Contains(buf.Bytes(), []byte(long)) || !bytes.HasPrefix(lines[4], []byte(`[{"p":"y","v":5}]`)) {
+			t.Fatal("journal was not compressed correctly:", buf.String())
+		}
+
+		var f foo
+		j, err = NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, &f, opts...)
+		if err != nil {
+			t.Fatal(err)
+		} else if f.X != long+"4" || f.Y != 5 || j.ReplaySummary().SkippedSets != 0 {
+			t.Fatal("journal was not replayed correctly:", f, j.ReplaySummary())
+		}
+
+		// corrupt the frame of the second set; the sets on either side of it
+		// should still be applied
+		lines[2] = lines[2][:len(lines[2])/2]
+		f = foo{}
+		j, err = NewJournal(bytes.NewReader(bytes.Join(lines, []byte("\n"))), ioutil.Discard, &f, opts...)
+		if err != nil {
+			t.Fatal(err)
+		} else if f.X != long+"4" || j.ReplaySummary().SkippedSets != 1 || j.ReplaySummary().AppliedSets != 3 {
+			t.Fatal("corrupted frame should have been skipped:", f, j.ReplaySummary())
+		}
+	}
+
+	// corrupt frames are malformed
+	j := &Journal{compress: true}
+	for _, bad := range []string{"~!!!!", "~" + base64.StdEncoding.EncodeToString([]byte("not gzip"))} {
+		if _, err := j.decodeLine([]byte(bad), 0); !errors.Is(err, ErrMalformed) {
+			t.Errorf("expected ErrMalformed for %q, got %v", bad, err)
+		}
+	}
+
+	// the set size limit applies to the decompressed set, both when writing
+	// and when replaying
+	huge := strings.Repeat("a", 10000)
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, foo{}, WithCompression())
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j.Update([]Update{NewUpdate("x", huge)}); err != nil {
+		t.Fatal(err)
+	} else if err := j.Update([]Update{NewUpdate("y", 1)}); err != nil {
+		t.Fatal(err)
+	} else if bytes.Count(buf.Bytes(), []byte("\n")) != 3 || buf.Len() > 1000 {
+		t.Fatal("set was not compressed:", buf.Len())
+	}
+	var f foo
+	j, err = NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, &f, WithCompression(), WithMaxSetSize(1000))
+	if err != nil {
+		t.Fatal(err)
+	} else if f.X != "" || f.Y != 1 || j.ReplaySummary().SkippedSets != 1 {
+		t.Fatal("oversized set should have been skipped:", j.ReplaySummary())
+	} else if err := j.Update([]Update{NewUpdate("x", huge)}); !errors.Is(err, ErrTooLarge) {
+		t.Fatal("expected ErrTooLarge, got", err)
+	}
+}
+
+func TestJournalEncryption(t *testing.T) {
+	type foo struct {
+		X int `json:"x"`
+	}
+	var key [32]byte
+	key[0] = 1
+	tf, cleanup := tempFile(t, "TestJournalEncryption")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), foo{X: 1}, WithEncryption(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Checkpoint(foo{X: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 3; i <= 5; i++ {
+		if err := j.Update([]Update{NewUpdate("x", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+	data, err := ioutil.ReadFile(j.filename)
+	if err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(data, []byte(`"x"`)) {
+		t.Fatal("journal was not encrypted:", string(data))
+	}
+
+	var f foo
+	j, err = OpenJournal(j.filename, &f, WithEncryption(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if f.X != 5 || j.ReplaySummary().SkippedSets != 0 {
+		t.Fatal("journal was not replayed correctly:", f, j.ReplaySummary())
+	}
+
+	// tamper with the ciphertext of the second set; it should be dropped
+	lines := bytes.Split(data, []byte("\n"))
+	lines[2][len(lines[2])/2] ^= 1
+	if err := ioutil.WriteFile(j.filename, bytes.Join(lines, []byte("\n")), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f = foo{}
+	j, err = OpenJournal(j.filename, &f, WithEncryption(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if f.X != 5 || j.ReplaySummary().SkippedSets != 1 || j.ReplaySummary().SkippedOffsets[0] != int64(len(lines[0])+len(lines[1])+2) {
+		t.Fatal("tampered set should have been skipped:", f, j.ReplaySummary())
+	}
+
+	// the wrong key should cause an error
+	key[0] = 2
+	if _, err := OpenJournal(j.filename, &f, WithEncryption(key)); err != errDecrypt {
+		t.Fatal("expected decryption error, got", err)
+	}
+}
+
+func BenchmarkCompression(b *testing.B) {
+	// a realistic journal: a moderately-sized object, followed by many small
+	// updates to it
+	type user struct {
+		Name    string   `json:"name"`
+		Email   string   `json:"email"`
+		Balance int      `json:"balance"`
+		Tags    []string `json:"tags"`
+	}
+	init := make(map[string]user)
+	for i := 0; i < 100; i++ {
+		init[fmt.Sprint("user", i)] = user{
+			Name:  fmt.Sprint("User Number ", i),
+			Email: fmt.Sprintf("user%v@example.com", i),
+			Tags:  []string{"active", "verified"},
+		}
+	}
+	writeJournal := func(opts ...Option) int {
+		var buf bytes.Buffer
+		j, err := NewJournal(nil, &buf, init, opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			err := j.Update([]Update{
+				NewUpdate(fmt.Sprintf("user%v.balance", i%100), i),
+				NewUpdate(fmt.Sprintf("user%v.tags.0", i%100), "inactive"),
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		return buf.Len()
+	}
+
+	raw := writeJournal()
+	b.ResetTimer()
+	var compressed int
+	for i := 0; i < b.N; i++ {
+		compressed = writeJournal(WithCompression())
+	}
+	b.ReportMetric(float64(raw), "raw-bytes")
+	b.ReportMetric(float64(compressed), "compressed-bytes")
+}
+
+func BenchmarkEncodingReplay(b *testing.B) {
+	init := make(map[string]map[string]interface{})
+	for i := 0; i < 100; i++ {
+		init[fmt.Sprint("user", i)] = map[string]interface{}{
+			"name":    fmt.Sprint("User Number ", i),
+			"balance": 0,
+			"tags":    []string{"active", "verified"},
+		}
+	}
+	for _, enc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"plain", nil},
+		{"checksums", []Option{WithChecksums()}},
+		{"compressed", []Option{WithCompression()}},
+	} {
+		b.Run(enc.name, func(b *testing.B) {
+			var buf bytes.Buffer
+			j, err := NewJournal(nil, &buf, init, enc.opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < 1000; i++ {
+				err := j.Update([]Update{
+					NewUpdate(fmt.Sprintf("user%v.balance", i%100), i),
+					NewUpdate(fmt.Sprintf("user%v.tags.0", i%100), "inactive"),
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, new(interface{}), enc.opts...); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(buf.Len()), "file-bytes")
+		})
+	}
+}
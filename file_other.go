@@ -0,0 +1,18 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+
+package jj
+
+import "os"
+
+// Locking and directory syncing are not supported on this platform. Journals
+// are not protected against concurrent access, and a Checkpoint may not be
+// durable until the filesystem flushes the rename.
+const lockingSupported = false
+
+func lockFile(f *os.File) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
+
+var syncDir = func(dir string) error { return nil }
+
+func isCrossDevice(err error) bool { return false }
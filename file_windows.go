@@ -0,0 +1,61 @@
+//go:build windows
+
+package jj
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const lockingSupported = true
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errLockViolation syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+)
+
+// Windows locks are mandatory, so we lock a single byte far beyond the end of
+// the file, which will never be read or written.
+func lockRegion() *syscall.Overlapped {
+	return &syscall.Overlapped{Offset: ^uint32(0), OffsetHigh: ^uint32(0)}
+}
+
+func lockFile(f *os.File) error {
+	flags := uint32(lockfileFailImmediately | lockfileExclusiveLock)
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(lockRegion())))
+	if r == 0 {
+		if err == errLockViolation {
+			return ErrLocked
+		}
+		return err
+	}
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(lockRegion())))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// syncDir is a no-op on Windows, where directories cannot be synced; renames
+// are made durable by the filesystem itself.
+var syncDir = func(dir string) error { return nil }
+
+const errNotSameDevice syscall.Errno = 17 // ERROR_NOT_SAME_DEVICE
+
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errNotSameDevice)
+}
@@ -0,0 +1,94 @@
+package jj
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// followInterval is how often Follow polls for new data. It is a variable so
+// that tests can shorten it.
+var followInterval = 100 * time.Millisecond
+
+// Follow waits for update sets to be appended to j's file, applying each one
+// to j's object and then calling fn with it, in the manner of tail -f. A set
+// is not applied until its trailing newline has been written, so
+// partially-written sets are never observed; this includes a partial set at
+// the end of the file when j was opened. Malformed sets are skipped, and sets
+// written by Transact are observed when they are committed. Follow polls the
+// file for new data until ctx is done, at which point it returns ctx.Err().
+//
+// Follow requires a read-only Journal opened by OpenJournal. Since read-only
+// Journals take no lock, the file may be written concurrently by a Journal
+// opened for writing, in this process or another. Checkpoints that replace
+// the file are not observed. j must not be used concurrently with Follow.
+func (j *Journal) Follow(ctx context.Context, fn func([]Update)) error {
+	if !j.readOnly || j.f == nil {
+		return errors.New("jj: Follow requires a read-only, file-backed Journal")
+	}
+	// resume after the last complete line
+	if j.tail > 0 {
+		j.size, j.tail = j.tail, 0
+	}
+	off := j.size
+	buf := make([]byte, 32*1024)
+	var pending []byte
+	for {
+		n, err := j.f.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("jj: could not read journal: %w", err)
+		}
+		off += int64(n)
+		pending = append(pending, buf[:n]...)
+		for {
+			i := bytes.IndexByte(pending, '\n')
+			if i < 0 {
+				break
+			}
+			if set, ok := j.followLine(pending[:i+1]); ok {
+				fn(set)
+			}
+			pending = pending[i+1:]
+		}
+		pending = append([]byte(nil), pending...)
+		if n == len(buf) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(followInterval):
+		}
+	}
+}
+
+// followLine applies the update set in line, which may be modified in place,
+// to j's object. It returns false if line is empty or malformed.
+func (j *Journal) followLine(line []byte) ([]Update, bool) {
+	j.size += int64(len(line))
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil, false
+	}
+	j.sets++
+	data, err := j.decodeLine(line, j.maxSet)
+	if err != nil {
+		return nil, false
+	}
+	set, m, err := decodeSet(data, new(SetRecord))
+	if err != nil {
+		return nil, false
+	}
+	set, ok := j.resolveTx(set, m)
+	if !ok {
+		return nil, false
+	}
+	obj := j.obj
+	for _, u := range set {
+		obj, _ = u.applyCached(obj, &j.paths)
+	}
+	j.setObj(obj)
+	return set, true
+}
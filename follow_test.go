@@ -0,0 +1,122 @@
+package jj
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestJournalFollow(t *testing.T) {
+	defer func(d time.Duration) { followInterval = d }(followInterval)
+	followInterval = time.Millisecond
+
+	primary, cleanup := tempFile(t, "TestJournalFollow")
+	defer cleanup()
+	primary.Close()
+	mirror, cleanup := tempFile(t, "TestJournalFollowMirror")
+	defer cleanup()
+	j, err := OpenJournal(primary.Name(), map[string]int{"x": 1}, WithMirror(mirror, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	// leave a partially-written set at the end of the mirror
+	if _, err := mirror.WriteString(`[{"p":"x",`); err != nil {
+		t.Fatal(err)
+	}
+
+	var obj map[string]int
+	f, err := OpenJournalReadOnly(mirror.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sets := make(chan []Update)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() { errCh <- f.Follow(ctx, func(set []Update) { sets <- set }) }()
+
+	// complete the partial set
+	time.Sleep(10 * time.Millisecond)
+	if _, err := mirror.WriteString(`"v":2}]` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if set := <-sets; len(set) != 1 || string(set[0].Value) != "2" {
+		t.Fatal("wrong set:", set)
+	}
+	for i := 3; i <= 5; i++ {
+		if err := j.Set("x", i); err != nil {
+			t.Fatal(err)
+		}
+		if set := <-sets; len(set) != 1 || string(set[0].Value) != string(rune('0'+i)) {
+			t.Fatal("wrong set:", set)
+		}
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	} else if string(f.Snapshot()) != `{"x":5}` {
+		t.Fatal("wrong object:", string(f.Snapshot()))
+	}
+
+	// writable Journals cannot be followed
+	if err := j.Follow(context.Background(), func([]Update) {}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestJournalFollowWriter(t *testing.T) {
+	defer func(d time.Duration) { followInterval = d }(followInterval)
+	followInterval = time.Millisecond
+
+	// readers may follow a Journal while it is open for writing
+	tf, cleanup := tempFile(t, "TestJournalFollowWriter")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]int{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if err := j.Set("x", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	var readers []*Journal
+	for i := 0; i < 2; i++ {
+		var obj map[string]int
+		r, err := OpenJournalReadOnly(tf.Name(), &obj)
+		if err != nil {
+			t.Fatal(err)
+		} else if obj["x"] != 2 {
+			t.Fatal("wrong object:", obj)
+		}
+		defer r.Close()
+		readers = append(readers, r)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sets := make(chan []Update)
+	errCh := make(chan error)
+	for _, r := range readers {
+		r := r
+		go func() { errCh <- r.Follow(ctx, func(set []Update) { sets <- set }) }()
+	}
+	for i := 3; i <= 5; i++ {
+		if err := j.Set("x", i); err != nil {
+			t.Fatal(err)
+		}
+		for range readers {
+			if set := <-sets; len(set) != 1 || string(set[0].Value) != string(rune('0'+i)) {
+				t.Fatal("wrong set:", set)
+			}
+		}
+	}
+	cancel()
+	for _, r := range readers {
+		if err := <-errCh; err != context.Canceled {
+			t.Fatal("expected context.Canceled, got", err)
+		} else if string(r.Snapshot()) != `{"x":5}` {
+			t.Fatal("wrong object:", string(r.Snapshot()))
+		}
+	}
+}
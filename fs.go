@@ -0,0 +1,23 @@
+package jj
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// OpenJournalFS is like OpenJournal with WithReadOnly, but reads the Journal
+// stored at name within fsys, e.g. one embedded in the program via embed.FS.
+// The reconstructed object is decoded into obj. Unlike OpenJournal, the file
+// must exist; if it is empty, obj is used as the initial object.
+//
+// Since fs.FS is read-only, so is the returned Journal: Update and Checkpoint
+// return ErrReadOnly, and the Journal does not hold a lock or an open file.
+// Its read methods, such as Get and Snapshot, may be used as normal.
+func OpenJournalFS(fsys fs.FS, name string, obj interface{}, opts ...Option) (*Journal, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("jj: could not open journal: %w", err)
+	}
+	defer f.Close()
+	return NewJournal(f, nil, obj, append(opts[:len(opts):len(opts)], WithReadOnly())...)
+}
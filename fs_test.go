@@ -0,0 +1,67 @@
+package jj
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOpenJournalFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"config.jj": {Data: []byte(`{"a":1,"b":[]}` + "\n" + `[{"p":"a","v":2}]` + "\n" + `[{"p":"b.0","v":3}]` + "\n")},
+		"empty.jj":  {Data: nil},
+		"bad.jj":    {Data: []byte(`{"a":`)},
+	}
+	var obj struct {
+		A int   `json:"a"`
+		B []int `json:"b"`
+	}
+	j, err := OpenJournalFS(fsys, "config.jj", &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if obj.A != 2 || len(obj.B) != 1 || obj.B[0] != 3 {
+		t.Fatal("wrong object:", obj)
+	} else if a, err := j.GetInt("a"); err != nil || a != 2 {
+		t.Fatal("wrong value:", a, err)
+	} else if j.Len() != 2 {
+		t.Fatal("wrong number of sets:", j.Len())
+	}
+	if err := j.Set("a", 3); err != ErrReadOnly {
+		t.Fatal("expected ErrReadOnly, got", err)
+	} else if err := j.Checkpoint(obj); err != ErrReadOnly {
+		t.Fatal("expected ErrReadOnly, got", err)
+	}
+
+	// options are respected
+	var buf bytes.Buffer
+	src, err := NewJournal(nil, &buf, map[string]int{"x": 1}, WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	} else if err := src.Set("x", 2); err != nil {
+		t.Fatal(err)
+	}
+	fsys["sums.jj"] = &fstest.MapFile{Data: buf.Bytes()}
+	var m map[string]int
+	if _, err := OpenJournalFS(fsys, "sums.jj", &m, WithChecksums()); err != nil || m["x"] != 2 {
+		t.Fatal("wrong object:", m, err)
+	}
+
+	// an empty file yields obj
+	m = map[string]int{"y": 1}
+	if j, err := OpenJournalFS(fsys, "empty.jj", &m); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"y":1}` {
+		t.Fatal("wrong object:", string(j.Snapshot()))
+	}
+
+	// errors
+	if _, err := OpenJournalFS(fsys, "missing.jj", &m); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("expected ErrNotExist, got", err)
+	} else if _, err := OpenJournalFS(fsys, "bad.jj", &m); !errors.Is(err, ErrMalformed) {
+		t.Fatal("expected ErrMalformed, got", err)
+	}
+}
@@ -17,136 +17,1646 @@
 // simply ignored when reading the Journal. Individual updates may also be
 // ignored if they are malformed, though other updates in the set may be
 // applied. See the Update docstring for an explanation of malformed updates.
+//
+// Update sets are delimited by newlines, which are therefore significant:
+// sets that are not separated by a newline are treated as a single malformed
+// set. Only the initial object may span multiple lines. If the final set is
+// well-formed but lacks its trailing newline (e.g. due to a crash), it is
+// applied, and the next set is written on a new line.
 package jj
 
-import (
-	"encoding/json"
-	"io"
-	"os"
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Journal is a log of updates to a JSON object.
+type Journal struct {
+	w        io.Writer
+	f        *os.File // nil if not file-backed
+	filename string
+	obj      json.RawMessage // current object
+	summary  ReplaySummary
+	size     int64           // total size of the Journal, in bytes
+	initSize int64           // size of the initial object, in bytes
+	sets     int             // number of update sets since the last checkpoint
+	buf      []byte          // reused by Update
+	prev     json.RawMessage // object prior to the last set, for Undo
+	partial  bool            // whether the last write failed partway
+	tail     int64           // offset of a partially-written final set, if any
+	alloc    int64           // end of the preallocated region of the file
+	mu       sync.RWMutex    // guards obj; see Snapshot
+	syncs    sync.WaitGroup  // syncs abandoned by syncContext
+
+	// options
+	strict     bool
+	checksums  bool
+	compress   bool
+	aead       cipher.AEAD
+	readOnly   bool
+	autoCP     int64
+	useNumber  bool
+	maxSet     int64
+	keepFailed bool
+	mode       os.FileMode
+	tmpDir     string
+	timestamps bool
+	prealloc   int64
+	validate   bool
+	defaults   interface{}
+
+	// mirroring
+	mirror       io.Writer
+	mirrorErr    func(error)
+	mirroring    bool // whether the mirror has been started
+	mirrorFailed bool // whether the last write to the mirror failed
+
+	// observers
+	onCommit     func([]Update)
+	onCheckpoint func()
+	metrics      Metrics
+
+	// transactions
+	pending   map[string][]Update // prepared, but neither committed nor aborted
+	committed map[string]bool
+
+	paths pathCache // accessed only by the writer
+}
+
+// An Option configures a Journal when it is opened.
+type Option func(*Journal)
+
+// WithStrict causes OpenJournal to return a *MalformedError upon encountering
+// a malformed update set or update, rather than skipping it. This includes a
+// partially written set at the end of the Journal, so strict mode is not
+// suitable for recovering from a crash; it is intended for catching buggy
+// writers during development and testing.
+func WithStrict() Option {
+	return func(j *Journal) {
+		j.strict = true
+	}
+}
+
+// WithReadOnly causes OpenJournal to open the Journal for reading only. A
+// read-only Journal takes no lock on its file, so any number of read-only
+// Journals may be opened concurrently, including while the file is opened for
+// writing. Update and Checkpoint return an error on a read-only Journal. If
+// the file is empty, obj is used as the initial object, but is not written.
+func WithReadOnly() Option {
+	return func(j *Journal) {
+		j.readOnly = true
+	}
+}
+
+// WithAutoCheckpoint causes Update to automatically checkpoint the Journal,
+// using the current object as the new initial object, once the Journal's size
+// exceeds threshold bytes. To prevent a large object from triggering a
+// checkpoint on every Update, the checkpoint is only performed once the
+// update sets in the Journal are at least as large as the initial object.
+//
+// The checkpoint happens synchronously, after the updates have been written.
+// If it fails, Update returns the error; however, the updates will still have
+// been applied. Automatic checkpoints are only supported by file-backed
+// Journals.
+func WithAutoCheckpoint(threshold int64) Option {
+	return func(j *Journal) {
+		j.autoCP = threshold
+	}
+}
+
+// WithUseNumber causes numbers to be decoded into an interface{} as a
+// json.Number instead of as a float64, preserving the precision of large
+// integers. Note that the Journal itself always stores numbers exactly as
+// written, so Snapshot is unaffected by this option.
+func WithUseNumber() Option {
+	return func(j *Journal) {
+		j.useNumber = true
+	}
+}
+
+// WithMaxSetSize limits the size of each update set, including its trailing
+// newline, to max bytes. Update returns ErrTooLarge for sets that exceed the
+// limit, and OpenJournal treats them as malformed, discarding them without
+// reading them into memory. If WithCompression is also supplied, the limit
+// applies to each set both before and after compression, so that a corrupt
+// set cannot decompress to an unbounded size. The initial object is not
+// limited.
+func WithMaxSetSize(max int64) Option {
+	return func(j *Journal) {
+		j.maxSet = max
+	}
+}
+
+// WithKeepFailedCheckpoints causes Checkpoint to preserve the temporary file
+// it writes if the checkpoint fails, e.g. for inspection. The file is renamed
+// with a timestamped suffix. By default, the temporary file is removed.
+func WithKeepFailedCheckpoints() Option {
+	return func(j *Journal) {
+		j.keepFailed = true
+	}
+}
+
+// WithFileMode sets the permissions used when OpenJournal creates the
+// Journal's file, and when Checkpoint and Backup create new files. Like
+// os.OpenFile, the mode is subject to the process's umask. The default is
+// 0666.
+func WithFileMode(mode os.FileMode) Option {
+	return func(j *Journal) {
+		j.mode = mode
+	}
+}
+
+// WithTempDir causes Checkpoint to write its temporary file to dir, rather
+// than to the directory containing the Journal. dir must be on the same
+// filesystem as the Journal; otherwise, the temporary file cannot be renamed
+// atomically, and Checkpoint falls back to overwriting the Journal in place,
+// which is not crash-safe.
+func WithTempDir(dir string) Option {
+	return func(j *Journal) {
+		j.tmpDir = dir
+	}
+}
+
+// WithPreallocation causes the Journal's file to be extended in increments of
+// chunk bytes as it grows, allocating disk space ahead of time rather than on
+// each write. This reduces fragmentation and can make syncing cheaper, since
+// the filesystem need not allocate blocks (and update the file's metadata) as
+// part of each sync. The reported size of the file is unaffected, so the
+// Journal remains readable without this option. Preallocation is best-effort:
+// it is only supported on Linux, and is silently disabled if the filesystem
+// does not support it.
+func WithPreallocation(chunk int64) Option {
+	return func(j *Journal) {
+		j.prealloc = chunk
+	}
+}
+
+// WithWriteValidation causes Update to verify that each Value is valid JSON
+// that does not span multiple lines, and that the resulting update set is
+// well-formed, before writing the set. A set that fails validation is not
+// written, and Update returns an error wrapping ErrMalformed. Without this
+// option, an invalid Value (e.g. from a json.Marshaler passed to NewUpdate)
+// is written as-is, causing the entire set to be discarded when the Journal
+// is replayed. Validation requires scanning each set, so it is disabled by
+// default.
+func WithWriteValidation() Option {
+	return func(j *Journal) {
+		j.validate = true
+	}
+}
+
+// Sentinel errors returned (possibly wrapped) by Journal methods.
+var (
+	// ErrMalformed indicates that the Journal's contents could not be decoded,
+	// or that an update set failed validation (see WithWriteValidation).
+	ErrMalformed = errors.New("jj: malformed journal")
+	// ErrReadOnly is returned when modifying a read-only Journal.
+	ErrReadOnly = errors.New("jj: Journal is read-only")
+	// ErrNotFound is returned when a path does not identify an element.
+	ErrNotFound = errors.New("jj: path not found")
+	// ErrTooLarge is returned when an update set exceeds the size limit set
+	// by WithMaxSetSize.
+	ErrTooLarge = errors.New("jj: update set too large")
+	// ErrWrongType is returned when an element does not have the expected
+	// type, e.g. by GetString.
+	ErrWrongType = errors.New("jj: element has wrong type")
+	// ErrInvalidPath is returned by ValidatePath.
+	ErrInvalidPath = errors.New("jj: invalid path")
+)
+
+// A MalformedError is returned by OpenJournal in strict mode when a malformed
+// update set or update is encountered. It matches ErrMalformed.
+type MalformedError struct {
+	Offset int64  // byte offset of the update set
+	Data   []byte // the malformed update set or update
+	Err    error  // the underlying decoding error, if any
+}
+
+// Error implements the error interface.
+func (e *MalformedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("jj: malformed update set at offset %v (%v): %s", e.Offset, e.Err, e.Data)
+	}
+	return fmt.Sprintf("jj: malformed update in set at offset %v: %s", e.Offset, e.Data)
+}
+
+// Unwrap returns the underlying decoding error, if any.
+func (e *MalformedError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrMalformed.
+func (e *MalformedError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// A ReplaySummary describes the outcome of replaying a Journal's update sets
+// in OpenJournal. Malformed update sets are skipped in their entirety, whereas
+// malformed updates within an otherwise well-formed set are skipped
+// individually.
+type ReplaySummary struct {
+	AppliedSets    int     // number of update sets applied
+	SkippedSets    int     // number of malformed update sets skipped
+	SkippedUpdates int     // number of malformed updates skipped within applied sets
+	SkippedOffsets []int64 // byte offset of each skipped update set
+	InitialErr     error   // non-nil if the initial object was malformed and recovered
+}
+
+// ReplaySummary returns a summary of the replay performed when j was opened.
+func (j *Journal) ReplaySummary() ReplaySummary {
+	return j.summary
+}
+
+// Stats contains statistics about a Journal.
+type Stats struct {
+	Size        int64 // size of the Journal, in bytes
+	InitialSize int64 // size of the initial object, in bytes
+	Sets        int   // number of update sets written since the last checkpoint
+}
+
+// Stats returns statistics about j, e.g. for deciding when to call Checkpoint.
+// Sets includes any malformed sets encountered while replaying the Journal.
+func (j *Journal) Stats() Stats {
+	return Stats{
+		Size:        j.size,
+		InitialSize: j.initSize,
+		Sets:        j.sets,
+	}
+}
+
+// Len returns the number of update sets in j, i.e. the number written since
+// the initial object. It is equivalent to j.Stats().Sets.
+func (j *Journal) Len() int {
+	return j.sets
+}
+
+// Snapshot returns a copy of the current object, i.e. the initial object with
+// all subsequent updates applied.
+//
+// Snapshot, Exists, and the Get methods may be called concurrently with each
+// other and with a method that modifies j, such as Update or Checkpoint; they
+// observe the object either before or after each update set is applied, never
+// partway through. Methods that modify j must not be called concurrently with
+// each other.
+func (j *Journal) Snapshot() json.RawMessage {
+	return append(json.RawMessage(nil), j.current()...)
+}
+
+// current returns the current object, which must not be modified. It may be
+// called concurrently with setObj.
+func (j *Journal) current() json.RawMessage {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.obj
+}
+
+// setObj replaces the current object. Since the object is never modified in
+// place, readers holding the previous object are unaffected.
+func (j *Journal) setObj(obj json.RawMessage) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.obj = obj
+}
+
+// Get returns a copy of the element at path within the current object. If path
+// does not identify an element, Get returns ErrNotFound.
+func (j *Journal) Get(path string) (json.RawMessage, error) {
+	val, ok := extractPath(j.current(), path)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, path)
+	}
+	return append(json.RawMessage(nil), val...), nil
+}
+
+// GetMany is like Get, but returns the elements at each of paths. The paths
+// are resolved against the same version of the object, so the elements are
+// consistent with each other even if the Journal is updated concurrently. If
+// any path does not identify an element, GetMany returns ErrNotFound.
+func (j *Journal) GetMany(paths []string) ([]json.RawMessage, error) {
+	obj := j.current()
+	vals := make([]json.RawMessage, len(paths))
+	for i, path := range paths {
+		val, ok := extractPath(obj, path)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrNotFound, path)
+		}
+		vals[i] = append(json.RawMessage(nil), val...)
+	}
+	return vals, nil
+}
+
+// GetInto decodes the element at path within the current object into v,
+// respecting the Journal's options. If path does not identify an element,
+// GetInto returns ErrNotFound.
+func (j *Journal) GetInto(path string, v interface{}) error {
+	val, ok := extractPath(j.current(), path)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrNotFound, path)
+	}
+	if err := j.unmarshal(val, v); err != nil {
+		return fmt.Errorf("jj: could not decode element: %w", err)
+	}
+	return nil
+}
+
+// GetString returns the string at path within the current object. If path
+// does not identify an element, GetString returns ErrNotFound; if the element
+// is not a string, it returns ErrWrongType.
+func (j *Journal) GetString(path string) (string, error) {
+	val, err := j.getScalar(path)
+	if err != nil {
+		return "", err
+	} else if consumeString(val) != len(val) {
+		return "", fmt.Errorf("%w: %q is not a string", ErrWrongType, path)
+	}
+	return unescape(val[1 : len(val)-1]), nil
+}
+
+// GetInt returns the integer at path within the current object. If path does
+// not identify an element, GetInt returns ErrNotFound; if the element is not a
+// number, or is a number with a fraction or exponent, it returns ErrWrongType.
+func (j *Journal) GetInt(path string) (int64, error) {
+	val, err := j.getScalar(path)
+	if err != nil {
+		return 0, err
+	} else if consumeNumber(val) != len(val) || bytes.ContainsAny(val, ".eE") {
+		return 0, fmt.Errorf("%w: %q is not an integer", ErrWrongType, path)
+	}
+	i, err := strconv.ParseInt(string(val), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("jj: could not decode element: %w", err)
+	}
+	return i, nil
+}
+
+// GetFloat returns the number at path within the current object. If path does
+// not identify an element, GetFloat returns ErrNotFound; if the element is not
+// a number, it returns ErrWrongType.
+func (j *Journal) GetFloat(path string) (float64, error) {
+	val, err := j.getScalar(path)
+	if err != nil {
+		return 0, err
+	} else if consumeNumber(val) != len(val) {
+		return 0, fmt.Errorf("%w: %q is not a number", ErrWrongType, path)
+	}
+	f, err := strconv.ParseFloat(string(val), 64)
+	if err != nil {
+		return 0, fmt.Errorf("jj: could not decode element: %w", err)
+	}
+	return f, nil
+}
+
+// GetBool returns the boolean at path within the current object. If path does
+// not identify an element, GetBool returns ErrNotFound; if the element is not
+// a boolean, it returns ErrWrongType.
+func (j *Journal) GetBool(path string) (bool, error) {
+	val, err := j.getScalar(path)
+	if err != nil {
+		return false, err
+	}
+	switch string(val) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: %q is not a boolean", ErrWrongType, path)
+	}
+}
+
+// getScalar returns the element at path within the current object, without
+// surrounding whitespace. The returned slice must not be modified.
+func (j *Journal) getScalar(path string) ([]byte, error) {
+	val, ok := extractPath(j.current(), path)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, path)
+	}
+	return bytes.TrimSpace(val), nil
+}
+
+// Exists reports whether path identifies an element of the current object.
+// An element whose value is null exists; the array append index (i.e. the
+// length of the array) does not.
+func (j *Journal) Exists(path string) bool {
+	_, ok := extractPath(j.current(), path)
+	return ok
+}
+
+// Update applies the updates atomically to j. It syncs the underlying file
+// before returning. The updates are applied in order, so each update sees the
+// effects of those before it; e.g. an update may set a field within an
+// element appended by an earlier update in the same set. A malformed update
+// is skipped without affecting the others.
+func (j *Journal) Update(us []Update) error {
+	return j.UpdateContext(context.Background(), us)
+}
+
+// UpdateContext is like Update, but respects the cancellation of ctx. If ctx is
+// done before the updates are written, UpdateContext returns ctx.Err() and the
+// Journal is unchanged. Otherwise, the updates are written and applied, and
+// UpdateContext waits for the underlying file to be synced; if ctx is done
+// first, UpdateContext stops waiting and returns ctx.Err(). In that case, the
+// updates have been applied and written, but are not guaranteed to be
+// durable: they will not survive a crash that occurs before the sync (which
+// continues in the background) completes.
+func (j *Journal) UpdateContext(ctx context.Context, us []Update) error {
+	return j.update(ctx, setMeta{}, us)
+}
+
+// update writes and applies the update set us, along with its metadata.
+func (j *Journal) update(ctx context.Context, m setMeta, us []Update) error {
+	if j.readOnly {
+		return ErrReadOnly
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	line, err := j.writeSet(m, us)
+	if err != nil {
+		return err
+	} else if err := j.commit(ctx, line, us); err != nil {
+		return err
+	}
+	return j.autoCheckpoint()
+}
+
+// writeSet encodes the update set us, along with its metadata, and writes it
+// to the Journal, returning the written line. The line is not synced.
+func (j *Journal) writeSet(m setMeta, us []Update) ([]byte, error) {
+	if j.readOnly {
+		return nil, ErrReadOnly
+	}
+	// reuse the buffer from the previous call if it's large enough; otherwise,
+	// allocate one that is
+	n := len("[]\n") + len(us) + checksumSize
+	if j.hasMeta(m) {
+		n += len(`{"fv":1,"ts":-9223372036854775808,"tag":"","tx":"","ph":"","u":}`) + len(m.tag) + len(m.tx) + len(m.phase)
+	}
+	for _, u := range us {
+		n += updateSize(u)
+	}
+	if cap(j.buf) < n {
+		j.buf = make([]byte, 0, n)
+	}
+	buf := j.appendSetPrefix(j.buf[:0], m)
+	for i, u := range us {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendUpdate(buf, u)
+	}
+	buf = j.appendSetSuffix(buf, m)
+	if j.validate {
+		if err := validateSet(buf, us); err != nil {
+			return nil, err
+		}
+	}
+	// the limit applies to the set both before and after it is encoded, so
+	// that decompressing it during replay is also bounded
+	if j.maxSet > 0 && int64(len(buf)) > j.maxSet {
+		return nil, fmt.Errorf("%w: %v bytes exceeds limit of %v", ErrTooLarge, len(buf), j.maxSet)
+	}
+	buf = append(j.encodeLine(buf), '\n')
+	j.buf = buf
+	if j.maxSet > 0 && int64(len(buf)) > j.maxSet {
+		return nil, fmt.Errorf("%w: %v bytes exceeds limit of %v", ErrTooLarge, len(buf), j.maxSet)
+	}
+	if err := j.write(buf); err != nil {
+		return nil, fmt.Errorf("jj: could not write update set: %w", err)
+	}
+	return buf, nil
+}
+
+// validateSet checks that each Value in us is valid JSON that does not span
+// multiple lines, and that set, the encoding of us, is valid JSON.
+func validateSet(set []byte, us []Update) error {
+	for i, u := range us {
+		if len(u.Value) > 0 && (!json.Valid(u.Value) || bytes.IndexByte(u.Value, '\n') >= 0) {
+			return fmt.Errorf("%w: update %v (%q) has an invalid value", ErrMalformed, i, u.Path)
+		}
+	}
+	if !json.Valid(set) || bytes.IndexByte(set, '\n') >= 0 {
+		return fmt.Errorf("%w: update set is not valid JSON", ErrMalformed)
+	}
+	return nil
+}
+
+// commit syncs the update set us, which has already been written as line, and
+// applies it to the current object. line is only used if the Journal is
+// mirrored. The caller is responsible for calling autoCheckpoint afterward.
+func (j *Journal) commit(ctx context.Context, line []byte, us []Update) error {
+	canceled, err := j.syncContext(ctx)
+	if err != nil {
+		return fmt.Errorf("jj: could not sync journal: %w", err)
+	}
+	j.writeMirror(line)
+	j.sets++
+	// apply never modifies obj in place, so no copy is needed, and readers
+	// observe either the old object or the new one
+	j.prev = j.obj
+	obj := j.obj
+	for _, u := range us {
+		obj, _ = u.applyCached(obj, &j.paths)
+	}
+	j.setObj(obj)
+	if canceled {
+		return ctx.Err()
+	}
+	if j.onCommit != nil {
+		j.onCommit(us)
+	}
+	if j.metrics.Commit != nil {
+		j.metrics.Commit(len(us))
+	}
+	return nil
+}
+
+// autoCheckpoint checkpoints the Journal if WithAutoCheckpoint was supplied
+// and its threshold has been reached. Journals with pending transactions are
+// not checkpointed.
+func (j *Journal) autoCheckpoint() error {
+	if j.autoCP > 0 && j.f != nil && j.size > j.autoCP && j.size-j.initSize >= j.initSize && len(j.pending) == 0 {
+		return j.Checkpoint(j.obj)
+	}
+	return nil
+}
+
+// Undo reverts the most recent call to Update by appending a set of updates
+// that restores the previous object. Only a single level of undo is
+// supported: after calling Undo, or after a Checkpoint or reopening the
+// Journal, there is nothing to undo, and Undo returns an error. To support
+// Undo, the Journal retains the previous version of the object in memory,
+// roughly doubling its memory usage. If the most recent call to Update did
+// not change the object, Undo writes nothing.
+func (j *Journal) Undo() error {
+	if j.prev == nil {
+		return errors.New("jj: nothing to undo")
+	}
+	if us := Diff(j.obj, j.prev); len(us) > 0 {
+		if err := j.Update(us); err != nil {
+			return err
+		}
+	}
+	j.prev = nil
+	return nil
+}
+
+// Set sets the value at path to val. It is shorthand for calling Update with a
+// single Update constructed by NewUpdate, except that an invalid path is
+// reported as an error wrapping ErrInvalidPath rather than causing a panic.
+func (j *Journal) Set(path string, val interface{}) error {
+	if err := ValidatePath(path); err != nil {
+		return err
+	}
+	return j.Update([]Update{NewUpdate(path, val)})
+}
+
+// Delete deletes the value at path. It is shorthand for calling Update with a
+// single Update constructed by NewDeleteUpdate, except that an invalid path is
+// reported as an error, as with Set.
+func (j *Journal) Delete(path string) error {
+	if err := ValidatePath(path); err != nil {
+		return err
+	}
+	return j.Update([]Update{NewDeleteUpdate(path)})
+}
+
+// Replace replaces the entire object with obj, by appending an update set
+// containing a single update with path "". Unlike Checkpoint, which also
+// replaces the object, Replace does not compact the Journal: the previous
+// update sets are retained, so Replace can be undone with Undo, and the
+// history leading up to it remains available via History. It returns an error
+// if obj cannot be marshaled.
+func (j *Journal) Replace(obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("jj: could not encode object: %w", err)
+	}
+	return j.Update([]Update{{Path: "", Value: data}})
+}
+
+// UpdateChecked is like Update, but also reports which of the updates were
+// ignored as malformed, in the same format as DryRun: nil if every update was
+// applied, and otherwise a slice containing, for each update, nil or an error
+// describing why it was ignored. The updates are written regardless, since
+// the malformed updates are ignored during replay as well. Validating the
+// updates roughly doubles the cost of applying them, so Update should be
+// preferred when the updates are known to be well-formed.
+//
+// Unlike Update, UpdateChecked also checks each path with ValidatePath before
+// writing anything; if any path is invalid, it returns an error wrapping
+// ErrInvalidPath, and no updates are written.
+func (j *Journal) UpdateChecked(us []Update) ([]error, error) {
+	if j.readOnly {
+		return nil, ErrReadOnly
+	}
+	for i, u := range us {
+		err := ValidatePath(u.Path)
+		if err == nil && (u.Op == OpMove || u.Op == OpCopy) {
+			err = ValidatePath(u.From)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jj: update %v: %w", i, err)
+		}
+	}
+	errs := j.DryRun(us)
+	if err := j.Update(us); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// Append appends each of vals, in order, to the array at path. It is shorthand
+// for calling Update with the updates constructed by NewAppendUpdates, except
+// that an invalid path is reported as an error, as with Set.
+func (j *Journal) Append(path string, vals ...interface{}) error {
+	if err := ValidatePath(path); err != nil {
+		return err
+	}
+	return j.Update(NewAppendUpdates(path, vals...))
+}
+
+// DryRun reports which of the updates would be ignored as malformed if they
+// were passed to Update. The updates are applied, in order, to a copy of the
+// current object; nothing is written to the Journal. If every update would be
+// applied, DryRun returns nil. Otherwise, it returns a slice containing, for
+// each update, nil or an error describing why it would be ignored.
+func (j *Journal) DryRun(us []Update) []error {
+	var errs []error
+	obj := j.obj
+	for i, u := range us {
+		var ok bool
+		if obj, ok = u.applyCached(obj, &j.paths); ok {
+			continue
+		}
+		if errs == nil {
+			errs = make([]error, len(us))
+		}
+		errs[i] = u.diagnose(obj)
+	}
+	return errs
+}
+
+// write writes buf to the Journal. If the write fails partway, write attempts
+// to remove the partially-written data, so that it does not corrupt
+// subsequent writes. If that is not possible (e.g. because the Journal is not
+// file-backed), the next write is prefixed with a newline, so that the
+// partial data forms its own line, which is skipped as malformed during
+// replay.
+func (j *Journal) write(buf []byte) error {
+	wasPartial := j.partial
+	if j.partial {
+		buf = append([]byte{'\n'}, buf...)
+	}
+	j.preallocate(int64(len(buf)))
+	n, err := writeFull(j.w, buf)
+	j.recordWrite(n)
+	j.size += int64(n)
+	if err == nil {
+		j.partial = false
+	} else if n > 0 {
+		j.partial = true
+		j.rollback(j.size-int64(n), wasPartial)
+	}
+	return err
+}
+
+// preallocate ensures that n bytes beyond the end of the Journal's file have
+// been preallocated, if WithPreallocation was supplied. If preallocation
+// fails, it is disabled.
+func (j *Journal) preallocate(n int64) {
+	if j.prealloc <= 0 || j.f == nil || j.size+n <= j.alloc {
+		return
+	}
+	end := j.size + n + j.prealloc
+	end -= end % j.prealloc
+	if err := preallocate(j.f, j.size, end-j.size); err != nil {
+		j.prealloc = 0
+		return
+	}
+	j.alloc = end
+}
+
+// rollback attempts to truncate the Journal's file to size bytes, removing
+// any data written after that point. If successful, the partial flag is
+// restored to wasPartial.
+func (j *Journal) rollback(size int64, wasPartial bool) {
+	if j.f != nil && j.f.Truncate(size) == nil {
+		j.alloc = 0 // truncating frees any preallocated space
+		if _, err := j.f.Seek(size, io.SeekStart); err == nil {
+			j.size = size
+			j.partial = wasPartial
+		}
+	}
+}
+
+// writeFull writes all of buf to w. Unlike w.Write, it returns an error if w
+// reports a short write without one.
+func writeFull(w io.Writer, buf []byte) (int, error) {
+	var total int
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		total += n
+		if err != nil {
+			return total, err
+		} else if n == 0 {
+			return total, io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
+	return total, nil
+}
+
+// Sync syncs the underlying file, ensuring that all previous updates are
+// durable. Since Update syncs after each write, calling Sync is normally
+// unnecessary; it is provided for callers that want to force durability at a
+// particular point, e.g. after an UpdateContext call was canceled. If the
+// Journal's writer does not support syncing, Sync does nothing.
+func (j *Journal) Sync() error {
+	if err := j.sync(); err != nil {
+		return fmt.Errorf("jj: could not sync journal: %w", err)
+	}
+	return nil
+}
+
+// sync syncs the underlying writer, if it supports syncing.
+func (j *Journal) sync() error {
+	return syncWriter(j.w, j.metrics.Sync)
+}
+
+// syncWriter syncs w, if it has a Sync() error method, reporting the result to
+// hook, if non-nil.
+func syncWriter(w io.Writer, hook func(time.Duration, error)) error {
+	s, ok := w.(interface{ Sync() error })
+	if !ok {
+		return nil
+	} else if hook == nil {
+		return s.Sync()
+	}
+	start := time.Now()
+	err := s.Sync()
+	hook(time.Since(start), err)
+	return err
+}
+
+// syncContext is like sync, but stops waiting for the sync to complete if ctx
+// is done, in which case it returns true. The sync continues in the
+// background, and Checkpoint and Close wait for it before closing the file.
+func (j *Journal) syncContext(ctx context.Context) (canceled bool, err error) {
+	if ctx.Done() == nil {
+		return false, j.sync()
+	}
+	// the sync may outlive this call, so it must not refer to j, whose
+	// writer may be replaced by a subsequent Checkpoint
+	w, hook := j.w, j.metrics.Sync
+	errCh := make(chan error, 1)
+	j.syncs.Add(1)
+	go func() {
+		defer j.syncs.Done()
+		errCh <- syncWriter(w, hook)
+	}()
+	select {
+	case err := <-errCh:
+		return false, err
+	case <-ctx.Done():
+		return true, nil
+	}
+}
+
+// encodeObject marshals obj, returning both the JSON and its encoded line
+// (including the trailing newline).
+func (j *Journal) encodeObject(obj interface{}) (data, line []byte, err error) {
+	data, err = json.Marshal(obj)
+	if err != nil {
+		return nil, nil, fmt.Errorf("jj: could not encode object: %w", err)
+	}
+	line = j.encodeLine(append([]byte(nil), data...))
+	return data, append(line, '\n'), nil
+}
+
+// Checkpoint refreshes the Journal with a new initial object. It syncs the
+// underlying file before returning. Checkpoint is only supported by
+// file-backed Journals. Since the Journal is rewritten with obj as its
+// initial object, all previous update sets are discarded; to replace the
+// object while retaining them, use Replace. See also Compact and Reset.
+func (j *Journal) Checkpoint(obj interface{}) (err error) {
+	if j.readOnly {
+		return ErrReadOnly
+	} else if j.f == nil {
+		return errors.New("jj: Checkpoint requires a file-backed Journal")
+	} else if len(j.pending) > 0 {
+		return errors.New("jj: cannot checkpoint a Journal with pending transactions")
+	}
+	if j.metrics.Checkpoint != nil {
+		defer func(start time.Time) { j.metrics.Checkpoint(time.Since(start), err) }(time.Now())
+	}
+	// encode obj before creating the temp file, so that an unencodable object
+	// leaves no trace
+	data, line, err := j.encodeObject(obj)
+	if err != nil {
+		return err
+	}
+
+	// write to a new temp file
+	//
+	// TODO: a separate file may not be necessary. We could use an update with
+	// path "" instead, and then overwrite the beginning of the file and
+	// truncate. If the overwrite fails, we still have the full rewrite update
+	// left at the end. Just need to be careful not to overflow into the
+	// update if the new object is large.
+	tmpName := j.filename + "_tmp"
+	if j.tmpDir != "" {
+		tmpName = filepath.Join(j.tmpDir, filepath.Base(tmpName))
+	}
+	tmp, err := j.create(tmpName)
+	if err != nil {
+		return fmt.Errorf("jj: could not create checkpoint: %w", err)
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		j.discardCheckpoint(tmpName)
+		return err
+	}
+	if err := lockFile(tmp); err != nil {
+		return fail(err)
+	}
+	n, err := writeFull(tmp, line)
+	j.recordWrite(n)
+	if err != nil {
+		return fail(fmt.Errorf("jj: could not write checkpoint: %w", err))
+	} else if err := tmp.Sync(); err != nil {
+		return fail(fmt.Errorf("jj: could not sync checkpoint: %w", err))
+	}
+
+	// atomically replace the old file with the new one. On Windows, an open
+	// file cannot be replaced, so the old file must be closed first;
+	// elsewhere, it remains open (and locked) until the new file is in place.
+	// a sync abandoned by UpdateContext may still be using the old file
+	j.syncs.Wait()
+	if runtime.GOOS == "windows" {
+		if err := j.f.Close(); err != nil {
+			return fail(fmt.Errorf("jj: could not close journal: %w", err))
+		}
+	}
+	var closeErr error
+	err = rename(tmpName, j.filename)
+	if isCrossDevice(err) {
+		// this should never happen, since both files are in the same
+		// directory, but some filesystems (e.g. certain network or overlay
+		// mounts) report it anyway
+		tmp.Close()
+		os.Remove(tmpName)
+		if tmp, err = j.overwrite(data, line); err != nil {
+			j.partial = true // the file may have been extended
+			return fmt.Errorf("jj: could not replace journal: %w", err)
+		}
+	} else if err != nil {
+		return fail(fmt.Errorf("jj: could not replace journal: %w", err))
+	} else if runtime.GOOS != "windows" {
+		// the new file is already in place, so j must switch to it even if
+		// the old file cannot be closed
+		closeErr = j.f.Close()
+	}
+	j.mirrorCheckpoint(j.obj, data)
+	j.f = tmp
+	j.w = tmp
+	j.setObj(data)
+	j.size = int64(len(line))
+	j.initSize = j.size
+	j.alloc = 0
+	j.sets = 0
+	j.prev = nil
+	j.committed = nil // the commit records were discarded with the old file
+
+	// On Unix, a rename is not durable until the directory containing it has
+	// been synced. Note that the new file is already in place (and j has
+	// switched to it), so the Journal remains usable even if this fails.
+	if err := syncDir(filepath.Dir(j.filename)); err != nil {
+		return fmt.Errorf("jj: could not sync directory: %w", err)
+	}
+	if j.onCheckpoint != nil {
+		j.onCheckpoint()
+	}
+	if closeErr != nil {
+		return fmt.Errorf("jj: could not close old journal: %w", closeErr)
+	}
+	return nil
+}
+
+// fileMode returns the permissions used when creating files.
+func (j *Journal) fileMode() os.FileMode {
+	if j.mode == 0 {
+		return 0666
+	}
+	return j.mode
+}
+
+// create is like os.Create, but uses the Journal's file mode.
+func (j *Journal) create(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, j.fileMode())
+}
+
+// rename is os.Rename. It is a variable so that tests can simulate failures.
+var rename = os.Rename
+
+// syncFile is (*os.File).Sync. It is a variable so that tests can simulate
+// crashes.
+var syncFile = (*os.File).Sync
+
+// discardCheckpoint removes the temporary file of a failed Checkpoint. If
+// WithKeepFailedCheckpoints was supplied, the file is instead renamed with a
+// timestamped suffix, so that it is not overwritten by the next Checkpoint.
+func (j *Journal) discardCheckpoint(tmpName string) {
+	if j.keepFailed {
+		os.Rename(tmpName, tmpName+"."+time.Now().Format("20060102T150405.000000000"))
+		return
+	}
+	os.Remove(tmpName)
+}
+
+// Backup writes the current object to filename as the initial object of a
+// new Journal, which can be opened with OpenJournal using the same options.
+// The Journal itself is unaffected. As with Checkpoint, the backup is written
+// to a temporary file and then renamed, so an existing file at filename is
+// replaced atomically. Like Snapshot, Backup may be called concurrently with
+// methods that modify the Journal.
+func (j *Journal) Backup(filename string) error {
+	line := append(j.encodeLine(append([]byte(nil), j.current()...)), '\n')
+	tmpName := filename + "_tmp"
+	tmp, err := j.create(tmpName)
+	if err != nil {
+		return fmt.Errorf("jj: could not create backup: %w", err)
+	}
+	defer os.Remove(tmpName)
+	if _, err := writeFull(tmp, line); err != nil {
+		tmp.Close()
+		return fmt.Errorf("jj: could not write backup: %w", err)
+	} else if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("jj: could not sync backup: %w", err)
+	} else if err := tmp.Close(); err != nil {
+		return fmt.Errorf("jj: could not write backup: %w", err)
+	} else if err := os.Rename(tmpName, filename); err != nil {
+		return fmt.Errorf("jj: could not replace backup: %w", err)
+	} else if err := syncDir(filepath.Dir(filename)); err != nil {
+		return fmt.Errorf("jj: could not sync directory: %w", err)
+	}
+	return nil
+}
+
+// WriteSnapshot writes the current object to w, followed by a newline. Unlike
+// Backup, the object is written as plain JSON, regardless of the Journal's
+// encoding options, so the output is not itself a Journal unless the Journal
+// is unencoded. The Journal is unaffected. Like Snapshot, WriteSnapshot may
+// be called concurrently with methods that modify the Journal.
+func (j *Journal) WriteSnapshot(w io.Writer) error {
+	obj := j.current()
+	line := make([]byte, 0, len(obj)+1)
+	line = append(append(line, obj...), '\n')
+	if _, err := writeFull(w, line); err != nil {
+		return fmt.Errorf("jj: could not write snapshot: %w", err)
+	}
+	return nil
+}
+
+// overwrite replaces the contents of the Journal's file with line, the
+// encoded form of the object data, returning a locked handle to the file.
+// Unlike the rename performed by Checkpoint, overwrite is not atomic, so it
+// proceeds in stages, syncing after each, such that an interruption at any
+// point leaves a file that reconstructs either the old object or the new one:
+//
+// 1. An update set replacing the whole object with data is appended, preceded
+// by enough blank lines that it begins beyond the end of line.
+// 2. The update sets preceding it are blanked, leaving the initial object.
+// 3. The initial object is overwritten with line. If this is interrupted, the
+// malformed initial object is recovered from the appended set (see
+// OpenJournal).
+// 4. The file is truncated to the length of line.
+func (j *Journal) overwrite(data, line []byte) (*os.File, error) {
+	f := j.f
+	if runtime.GOOS == "windows" {
+		// j.f has already been closed
+		var err error
+		if f, err = openLocked(j.filename, false, j.fileMode()); err != nil {
+			return nil, err
+		}
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	set := j.appendSetPrefix(nil, setMeta{})
+	set = appendUpdate(set, Update{Value: data})
+	set = append(j.encodeLine(j.appendSetSuffix(set, setMeta{})), '\n')
+	start := end + 1
+	if start < int64(len(line)) {
+		start = int64(len(line))
+	}
+	if err := j.blank(f, end, start-end); err != nil {
+		return nil, err
+	}
+	n, err := f.WriteAt(set, start)
+	j.recordWrite(n)
+	if err != nil {
+		return nil, err
+	} else if err := syncFile(f); err != nil {
+		return nil, err
+	}
+	initSize := j.initSize
+	if initSize > end {
+		initSize = end
+	}
+	if err := j.blank(f, initSize, end-initSize); err != nil {
+		return nil, err
+	} else if err := syncFile(f); err != nil {
+		return nil, err
+	}
+	n, err = f.WriteAt(line, 0)
+	j.recordWrite(n)
+	if err != nil {
+		return nil, err
+	} else if err := j.blank(f, int64(len(line)), initSize-int64(len(line))); err != nil {
+		return nil, err
+	} else if err := syncFile(f); err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(len(line))); err != nil {
+		return nil, err
+	} else if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	return f, syncFile(f)
+}
+
+// blank overwrites the n bytes of f at off with newlines, which are skipped
+// during replay. If n is not positive, blank does nothing.
+func (j *Journal) blank(f *os.File, off, n int64) error {
+	buf := bytes.Repeat([]byte{'\n'}, 32*1024)
+	for n > 0 {
+		chunk := buf
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		w, err := f.WriteAt(chunk, off)
+		j.recordWrite(w)
+		if err != nil {
+			return err
+		}
+		off += int64(w)
+		n -= int64(w)
+	}
+	return nil
+}
 
-	"github.com/lukechampine/mjson"
-)
+// Close closes the underlying file, releasing its lock. If the Journal is not
+// file-backed, Close closes the underlying writer if it implements io.Closer.
+func (j *Journal) Close() error {
+	j.syncs.Wait()
+	if j.f != nil {
+		unlockFile(j.f)
+		return j.f.Close()
+	} else if c, ok := j.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
 
-// A Journal is a log of updates to a JSON object.
-type Journal struct {
-	f        *os.File
-	filename string
+// Reset checkpoints the Journal with an empty object, {}, discarding its
+// contents. It is equivalent to calling Checkpoint with an empty map; to reset
+// the Journal to a different object, call Checkpoint directly. Like
+// Checkpoint, Reset is only supported by file-backed Journals, and the
+// previous contents are not discarded until the new file is durably in place.
+func (j *Journal) Reset() error {
+	return j.Checkpoint(json.RawMessage(`{}`))
 }
 
-// Update applies the updates atomically to j. It syncs the underlying file
-// before returning.
-func (j *Journal) Update(us []Update) error {
-	buf := make([]byte, 0, 1024) // reasonable guess; avoids GC if we're lucky
-	buf = append(buf, '[')
-	for i, u := range us {
-		if i > 0 {
-			buf = append(buf, ',')
-		}
-		buf = append(buf, `{"p":"`...)
-		buf = append(buf, u.Path...)
-		buf = append(buf, `","v":`...)
-		buf = append(buf, u.Value...)
-		buf = append(buf, '}')
+// Compact checkpoints the Journal, using the current object as the new initial
+// object. It is equivalent to calling Checkpoint with the result of Snapshot,
+// but avoids the copy. If the Journal contains no update sets, it is already
+// compact, and Compact does nothing.
+func (j *Journal) Compact() error {
+	if j.sets == 0 {
+		return nil
 	}
-	buf = append(buf, ']', '\n')
-	if _, err := j.f.Write(buf); err != nil {
+	return j.Checkpoint(j.obj)
+}
+
+// CloseCheckpoint compacts the Journal (see Compact) and then closes it, so
+// that the next OpenJournal need not replay any update sets. The Journal is
+// closed even if the compaction fails.
+func (j *Journal) CloseCheckpoint() error {
+	if err := j.Compact(); err != nil {
+		j.Close()
 		return err
 	}
-	return j.f.Sync()
+	return j.Close()
 }
 
-// Checkpoint refreshes the Journal with a new initial object. It syncs the
-// underlying file before returning.
-func (j *Journal) Checkpoint(obj interface{}) error {
-	// write to a new temp file
-	//
-	// TODO: a separate file may not be necessary. We could use an update with
-	// path "" instead, and then overwrite the beginning of the file and
-	// truncate. If the overwrite fails, we still have the full rewrite update
-	// left at the end. Just need to be careful not to overflow into the
-	// update if the new object is large.
-	tmp, err := os.Create(j.filename + "_tmp")
+// load reconstructs the object stored in r and decodes it into obj. If r does
+// not contain an initial object, load returns io.EOF.
+func (j *Journal) load(r io.Reader, obj interface{}) error {
+	start := time.Now()
+	initObj, err := j.replay(r, func(rec SetRecord) {
+		switch rec.Status {
+		case SetApplied:
+			j.summary.AppliedSets++
+			j.summary.SkippedUpdates += rec.SkippedUpdates
+		case SetPartial:
+			j.tail = rec.Offset
+			fallthrough
+		case SetMalformed:
+			j.summary.SkippedSets++
+			j.summary.SkippedOffsets = append(j.summary.SkippedOffsets, rec.Offset)
+		}
+	})
 	if err != nil {
 		return err
 	}
-	if err := json.NewEncoder(tmp).Encode(obj); err != nil {
-		return err
+	// decode the final object into obj
+	if err := j.unmarshal(initObj, obj); err != nil {
+		return fmt.Errorf("jj: could not decode object: %w", err)
 	}
-	if err := tmp.Sync(); err != nil {
-		return err
+	j.obj = initObj
+	if j.metrics.Replay != nil {
+		j.metrics.Replay(j.summary, time.Since(start))
 	}
+	return nil
+}
 
-	// atomically replace the old file with the new one
-	if err := j.f.Close(); err != nil {
-		return err
+// unmarshal decodes data into v, respecting j's options.
+func (j *Journal) unmarshal(data []byte, v interface{}) error {
+	if !j.useNumber {
+		return json.Unmarshal(data, v)
 	}
-	if err := os.Rename(j.filename+"_tmp", j.filename); err != nil {
-		return err
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// OpenJournal opens the supplied Journal and decodes the reconstructed object
+// into obj. If the Journal does not exist, or is empty or contains only
+// whitespace, it will be created and obj will be used as the initial object.
+// Unless the Journal is read-only, a partially-written update set at the end of
+// the file (e.g. due to a crash) is truncated.
+//
+// If the initial object is malformed (e.g. truncated), OpenJournal skips to
+// the first well-formed update set. If that set replaces the whole object
+// (i.e. with an update to the path ""), it is used to rebuild the object, and
+// the original error is reported in ReplaySummary.InitialErr; otherwise, an
+// error wrapping ErrMalformed is returned. This recovery is not performed in
+// strict mode.
+//
+// Unless the Journal is read-only, OpenJournal takes an exclusive advisory
+// lock on the file, which is held until the Journal is closed. If another
+// Journal already holds the lock, OpenJournal returns ErrLocked.
+func OpenJournal(filename string, obj interface{}, opts ...Option) (*Journal, error) {
+	j := &Journal{
+		filename: filename,
+	}
+	for _, opt := range opts {
+		opt(j)
 	}
 
-	j.f = tmp
-	return nil
+	// open and lock file handle, creating the file if it does not exist
+	f, err := openLocked(filename, j.readOnly, j.fileMode())
+	if err != nil {
+		return nil, err
+	}
+	j.f = f
+	if !j.readOnly {
+		j.w = f
+	}
+
+	// reconstruct the object. If the file contains no object (e.g. because
+	// it was newly created), use obj as the initial object.
+	if err := j.load(f, obj); err == io.EOF {
+		if j.readOnly {
+			j.obj, err = json.Marshal(obj)
+		} else {
+			err = j.Checkpoint(obj)
+		}
+		if err != nil {
+			j.Close()
+			return nil, err
+		}
+	} else if err != nil {
+		j.Close()
+		return nil, err
+	} else {
+		j.dropPartial()
+	}
+	j.startMirror()
+	return j, nil
 }
 
-// Close closes the underlying file.
-func (j *Journal) Close() error {
-	return j.f.Close()
+// OpenJournalReadOnly is shorthand for calling OpenJournal with the
+// WithReadOnly option. The file is opened with O_RDONLY, so it may reside on
+// read-only media; unlike OpenJournal, it is not created if it does not
+// exist.
+func OpenJournalReadOnly(filename string, obj interface{}, opts ...Option) (*Journal, error) {
+	return OpenJournal(filename, obj, append(opts, WithReadOnly())...)
 }
 
-// OpenJournal opens the supplied Journal and decodes the reconstructed object
-// into obj. If the Journal does not exist, it will be created and obj will be
-// used as the initial object.
-func OpenJournal(filename string, obj interface{}) (*Journal, error) {
-	// open file handle, creating the file if it does not exist
-	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+// AttachJournal opens the Journal stored in filename without replaying it,
+// using snapshot as its current object. It is intended for processes that
+// already hold the Journal's current state, e.g. from a previous Journal for
+// the same file, and wish to avoid the cost of OpenJournal. snapshot and stats
+// should be obtained from the Snapshot and Stats methods of that Journal after
+// its final Update or Checkpoint.
+//
+// The caller must ensure that snapshot is exactly the object that replaying
+// the file would reconstruct. AttachJournal cannot verify this; it only checks
+// that the file exists and that its size matches stats.Size, which detects
+// most (but not all) modifications of the file by other means. If snapshot
+// does not match the file, subsequent updates are applied to the wrong object,
+// and the Journal's state will differ from that reconstructed by OpenJournal.
+func AttachJournal(filename string, snapshot json.RawMessage, stats Stats, opts ...Option) (*Journal, error) {
+	if !isValue(snapshot) {
+		return nil, errors.New("jj: snapshot is not valid JSON")
+	} else if stats.InitialSize <= 0 || stats.InitialSize > stats.Size {
+		return nil, errors.New("jj: invalid stats")
+	} else if _, err := os.Stat(filename); err != nil {
+		return nil, fmt.Errorf("jj: could not open journal: %w", err)
+	}
+	j := &Journal{
+		filename: filename,
+		obj:      append(json.RawMessage(nil), snapshot...),
+		size:     stats.Size,
+		initSize: stats.InitialSize,
+		sets:     stats.Sets,
+	}
+	for _, opt := range opts {
+		opt(j)
+	}
+	f, err := openLocked(filename, j.readOnly, j.fileMode())
 	if err != nil {
 		return nil, err
 	}
-	// if file was newly created, use obj as the initial object.
-	if stat, err := f.Stat(); err != nil {
-		return nil, err
-	} else if stat.Size() == 0 {
-		j := &Journal{
-			f:        f,
-			filename: filename,
+	if size, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("jj: could not seek journal: %w", err)
+	} else if size != stats.Size {
+		f.Close()
+		return nil, fmt.Errorf("jj: journal is %v bytes, but stats indicate %v", size, stats.Size)
+	}
+	j.f = f
+	if !j.readOnly {
+		j.w = f
+	}
+	j.startMirror()
+	return j, nil
+}
+
+// NewJournal returns a Journal that reads its contents from r and appends
+// updates to w, which typically refer to the same underlying storage. The
+// reconstructed object is decoded into obj. If r is nil or does not contain an
+// initial object, obj is written to w as the initial object. If w implements
+// a Sync() error method, it is called after each write. Journals created by
+// NewJournal do not support Checkpoint.
+func NewJournal(r io.Reader, w io.Writer, obj interface{}, opts ...Option) (*Journal, error) {
+	j := &Journal{
+		w: w,
+	}
+	for _, opt := range opts {
+		opt(j)
+	}
+	if r == nil {
+		r = bytes.NewReader(nil)
+	}
+	if err := j.load(r, obj); err == io.EOF && j.readOnly {
+		if j.obj, err = json.Marshal(obj); err != nil {
+			return nil, err
 		}
-		if err := j.Checkpoint(obj); err != nil {
+	} else if err == io.EOF {
+		data, line, err := j.encodeObject(obj)
+		if err != nil {
 			return nil, err
 		}
-		return j, nil
+		n, err := writeFull(w, line)
+		j.recordWrite(n)
+		if err != nil {
+			return nil, fmt.Errorf("jj: could not write initial object: %w", err)
+		} else if err := j.sync(); err != nil {
+			return nil, fmt.Errorf("jj: could not sync journal: %w", err)
+		}
+		j.obj = data
+		j.size = int64(len(line))
+		j.initSize = j.size
+		j.sets = 0
+	} else if err != nil {
+		return nil, err
+	} else {
+		j.dropPartial()
+	}
+	j.startMirror()
+	return j, nil
+}
+
+// dropPartial removes a partially-written final set, if one was encountered
+// during replay, so that subsequent writes are not appended to it. If that is
+// not possible (e.g. because the Journal is not file-backed), the next write
+// is prefixed with a newline instead, as in write.
+func (j *Journal) dropPartial() {
+	if j.readOnly || j.tail == 0 {
+		return
+	}
+	if j.f != nil && j.f.Truncate(j.tail) == nil {
+		j.alloc = 0
+		if _, err := j.f.Seek(j.tail, io.SeekStart); err == nil {
+			j.size = j.tail
+			j.tail = 0
+			j.sets--
+			return
+		}
 	}
+	j.partial = true
+}
 
-	// decode the initial object
-	var initObj json.RawMessage
-	dec := json.NewDecoder(f)
-	if err = dec.Decode(&initObj); err != nil {
+// readErr wraps an error encountered while reading a Journal. Decoding errors
+// are wrapped with ErrMalformed.
+func readErr(err error) error {
+	var se *json.SyntaxError
+	if errors.As(err, &se) || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: invalid initial object: %v", ErrMalformed, err)
+	}
+	return fmt.Errorf("jj: could not read journal: %w", err)
+}
+
+// replay reconstructs an object from the journal data in r, i.e. an initial
+// object followed by update sets, one per line. If fn is non-nil, it is called
+// with a record of each update set. In strict mode, replay returns a
+// *MalformedError upon encountering a malformed update set or update. If r
+// does not contain an initial object, replay returns io.EOF.
+func (j *Journal) replay(r io.Reader, fn func(SetRecord)) (json.RawMessage, error) {
+	var obj json.RawMessage
+	err := j.scan(r, func(init json.RawMessage) error {
+		obj = init
+		if j.defaults != nil && init != nil {
+			var err error
+			obj, err = j.applyDefaults(init)
+			return err
+		}
+		return nil
+	}, func(set []Update, rec SetRecord) error {
+		for _, u := range set {
+			var ok bool
+			if obj, ok = u.applyCached(obj, &j.paths); !ok {
+				if j.strict {
+					data, _ := json.Marshal(u)
+					return &MalformedError{Offset: rec.Offset, Data: data}
+				}
+				rec.SkippedUpdates++
+			}
+		}
+		if fn != nil {
+			fn(rec)
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	// decode each set of updates
-	for {
-		var set []Update
-		if err = dec.Decode(&set); err == io.EOF || err == io.ErrUnexpectedEOF {
-			// unexpected EOF means the last update was corrupted
-			break
-		} else if _, ok := err.(*json.SyntaxError); ok {
-			// skip malformed update sets
-			continue
+	return obj, nil
+}
+
+// scan reads the journal data in r, calling initFn with the initial object
+// and then setFn with each update set, in order. Malformed update sets are
+// passed to setFn as nil. In strict mode, scan instead returns a
+// *MalformedError upon encountering a malformed update set. If initFn or setFn
+// return an error, scan returns it. If r does not contain an initial object,
+// scan returns io.EOF.
+func (j *Journal) scan(r io.Reader, initFn func(json.RawMessage) error, setFn func([]Update, SetRecord) error) error {
+	// decode the initial object
+	var obj json.RawMessage
+	var offset int64
+	var br *bufio.Reader
+	initOpen := !j.encoded() // whether the initial object's line is unterminated
+	if !j.encoded() {
+		// the initial object may span multiple lines
+		tr, rewind := rewindable(r)
+		dec := json.NewDecoder(tr)
+		if err := dec.Decode(&obj); err == io.EOF {
+			return err
 		} else if err != nil {
-			return nil, err
+			err = readErr(err)
+			if !errors.Is(err, ErrMalformed) || j.strict {
+				return err
+			}
+			// search for a set that replaces the object, starting from the
+			// beginning, since the object may have been truncated
+			rr, rerr := rewind()
+			if rerr != nil {
+				return err
+			}
+			var ok bool
+			if br, offset, ok = j.recoverInit(bufio.NewReader(rr), 0); !ok {
+				return err
+			}
+			obj = nil
+			j.summary.InitialErr = err
+		} else {
+			offset = dec.InputOffset()
+			br = bufio.NewReader(io.MultiReader(dec.Buffered(), r))
 		}
-		for _, u := range set {
-			initObj = u.apply(initObj)
+	} else {
+		// the initial object is the first non-empty line
+		br = bufio.NewReader(r)
+		for obj == nil {
+			line, err := br.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return readErr(err)
+			}
+			offset += int64(len(line))
+			if len(bytes.TrimSpace(line)) > 0 {
+				var initErr error
+				if obj, initErr = j.decodeLine(line, 0); initErr == nil && !isValue(obj) {
+					initErr = fmt.Errorf("%w: initial object is not valid JSON", ErrMalformed)
+				}
+				if initErr != nil {
+					var ok bool
+					if j.strict || err == io.EOF {
+						return initErr
+					} else if br, offset, ok = j.recoverInit(br, offset); !ok {
+						return initErr
+					}
+					obj = nil
+					j.summary.InitialErr = initErr
+					break
+				}
+				initOpen = err == io.EOF
+			} else if err == io.EOF {
+				return io.EOF
+			}
 		}
 	}
-	// decode the final object into obj
-	if err = json.Unmarshal(initObj, obj); err != nil {
-		return nil, err
+	j.initSize = offset
+	if err := initFn(obj); err != nil {
+		return err
+	}
+	// decode each set of updates, one per line
+	for first := true; ; first = false {
+		partial := false
+		line, n, err := j.readLine(br)
+		tooLarge := int64(len(line)) < n
+		if err != nil && err != io.EOF {
+			return readErr(err)
+		} else if first && !tooLarge && len(bytes.TrimSpace(line)) == 0 {
+			// remainder of the initial object's line
+			j.initSize += n
+		} else if tooLarge || len(bytes.TrimSpace(line)) > 0 {
+			j.sets++
+			rec := SetRecord{
+				Offset: offset,
+				Length: n,
+				Status: SetApplied,
+			}
+			var set []Update
+			var m setMeta
+			jsonErr := ErrTooLarge
+			if !tooLarge {
+				var data []byte
+				data, jsonErr = j.decodeLine(line, j.maxSet)
+				if jsonErr == nil {
+					set, m, jsonErr = decodeSet(data, &rec)
+				}
+			}
+			apply := true
+			if jsonErr != nil {
+				if j.strict {
+					return &MalformedError{Offset: offset, Data: bytes.TrimSpace(line), Err: jsonErr}
+				}
+				// skip malformed update sets
+				set = nil
+				rec.Status = SetMalformed
+				if err == io.EOF {
+					rec.Status = SetPartial
+					partial = true
+				}
+			} else {
+				// transactional sets are deferred until they are committed
+				set, apply = j.resolveTx(set, m)
+			}
+			if apply {
+				if err := setFn(set, rec); err != nil {
+					return err
+				}
+			}
+		}
+		offset += n
+		if err == io.EOF {
+			// if the final line is unterminated, the next write must begin
+			// a new line; otherwise, the next set would be appended to it,
+			// and both would be skipped as a single malformed set. A
+			// partially-written set is instead removed by dropPartial, which
+			// leaves the line unterminated only if the set began on the
+			// initial object's line.
+			if partial {
+				j.partial = first && !j.encoded()
+			} else {
+				j.partial = n > 0 || (first && initOpen)
+			}
+			break
+		}
+	}
+	j.size = offset
+	return nil
+}
+
+// recoverInit searches br, which begins at offset, for the first well-formed
+// update set; it is used when the initial object is malformed. If the set
+// replaces the whole object, recoverInit returns a reader positioned at the
+// start of the set, along with the set's offset.
+func (j *Journal) recoverInit(br *bufio.Reader, offset int64) (*bufio.Reader, int64, bool) {
+	for {
+		line, n, err := j.readLine(br)
+		if err != nil && err != io.EOF {
+			return nil, 0, false
+		}
+		if int64(len(line)) == n && len(bytes.TrimSpace(line)) > 0 {
+			var set []Update
+			var m setMeta
+			data, jsonErr := j.decodeLine(line, j.maxSet)
+			if jsonErr == nil {
+				set, m, jsonErr = decodeSet(data, new(SetRecord))
+			}
+			if jsonErr == nil {
+				if m.phase != "" || !replacesObject(set) {
+					return nil, 0, false
+				}
+				return bufio.NewReader(io.MultiReader(bytes.NewReader(line), br)), offset, true
+			}
+		}
+		offset += n
+		if err == io.EOF {
+			return nil, 0, false
+		}
 	}
+}
 
-	return &Journal{
-		f:        f,
-		filename: filename,
-	}, nil
+// replacesObject reports whether set contains an update that replaces the
+// whole object.
+func replacesObject(set []Update) bool {
+	for _, u := range set {
+		if u.Op == OpReplace && u.Path == "" && len(u.Value) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rewindable returns a reader equivalent to r, along with a function that
+// rewinds it to r's current position. If r is not an io.Seeker, the data read
+// from it is buffered in memory.
+func rewindable(r io.Reader) (io.Reader, func() (io.Reader, error)) {
+	if s, ok := r.(io.ReadSeeker); ok {
+		if pos, err := s.Seek(0, io.SeekCurrent); err == nil {
+			return r, func() (io.Reader, error) {
+				_, err := s.Seek(pos, io.SeekStart)
+				return r, err
+			}
+		}
+	}
+	buf := new(bytes.Buffer)
+	return io.TeeReader(r, buf), func() (io.Reader, error) {
+		return io.MultiReader(buf, r), nil
+	}
+}
+
+// readLine reads a line from br, including its trailing newline, and returns
+// it along with its length. If the line exceeds the limit set by
+// WithMaxSetSize, it is discarded rather than read into memory, and readLine
+// returns a nil line.
+func (j *Journal) readLine(br *bufio.Reader) ([]byte, int64, error) {
+	if j.maxSet <= 0 {
+		line, err := br.ReadBytes('\n')
+		return line, int64(len(line)), err
+	}
+	var line []byte
+	var n int64
+	for {
+		frag, err := br.ReadSlice('\n')
+		n += int64(len(frag))
+		if n <= j.maxSet {
+			line = append(line, frag...)
+		} else {
+			line = nil
+		}
+		if err != bufio.ErrBufferFull {
+			return line, n, err
+		}
+	}
 }
 
 // An Update is a modification of a path in a JSON object. A "path" in this
@@ -166,6 +1676,12 @@ func OpenJournal(filename string, obj interface{}) (*Journal, error) {
 //
 //    foo.bars.0.baz
 //
+// Within an accessor, a '\' causes the following character to be interpreted
+// literally, so object keys containing '.' or '\' can be accessed by escaping
+// those characters, e.g. the path a\.b accesses the key "a.b". EscapeKey
+// performs this escaping. Keys are compared after decoding any JSON escape
+// sequences, so the path ab also accesses the key "a\u0062".
+//
 // The path is accompanied by a new object. Thus, to increment the value "3"
 // in the above object, we would use the following Update:
 //
@@ -175,48 +1691,385 @@ func OpenJournal(filename string, obj interface{}) (*Journal, error) {
 //    }
 //
 // All permutations of the Update object are legal. However, malformed updates
-// are ignored during application. An Update is considered malformed in three
+// are ignored during application. An Update is considered malformed in two
 // circumstances:
 //
 //    - Its Path references an element that does not exist at application time.
 //      This includes out-of-bounds array indices.
-//    - Its Path contains invalid characters (e.g. "). See the JSON spec.
 //    - Value contains invalid JSON or is empty.
 //
 // Other special cases are handled as follows:
 //
 //    - If Path is "", the entire object is replaced.
-//    - If an object contains duplicate keys, the first key encountered is used.
+//    - An empty accessor refers to the empty key, e.g. the paths a. and a..b
+//      access the key "" within a. Since the path "" refers to the entire
+//      object, a top-level empty key can only be accessed as part of a
+//      longer path, such as .b. Since empty accessors are more often a
+//      mistake than a reference to the empty key, ValidatePath reports them,
+//      and the New*Update constructors (and UpdateChecked) reject them.
+//    - If an object contains duplicate keys, the last key encountered is used,
+//      matching the behavior of encoding/json. Deleting a duplicated key
+//      removes all of its occurrences.
+//
+// Negative array indices count backwards from the end of the array, e.g. -1
+// refers to the last element. As with positive indices, out-of-bounds
+// negative indices are malformed.
+//
+// An array element may also be identified by the value of one of its fields,
+// using an accessor of the form [field=value]. For example, the path
+// items.[id=42].name accesses the name of the first element of items that is
+// an object whose id is 42. String fields are compared to value after
+// decoding; other fields are compared by their JSON encoding, e.g. 42 or true.
+// If no element matches, the Update is malformed. Within an object, such an
+// accessor is an ordinary key.
 //
 // Finally, to enable efficient array updates, the length of the array (at
 // application time) may be used as a special array index.  When this index is
 // the last accessor in Path, Value will be appended to the end of the array.
 // If the index is not the last accessor, the Update is considered malformed
 // (and thus is ignored).
+//
+// By default, an Update replaces the element at Path with Value. An Update may
+// specify a different operation via its Op field; see the Op constants for
+// details. An Update with an unrecognized Op is considered malformed.
 type Update struct {
 	// Path is an arbitrarily-nested JSON element, such as foo.bars.1.baz
 	Path string `json:"p"`
 	// Value contains the new value of Path.
-	Value json.RawMessage `json:"v"`
+	Value json.RawMessage `json:"v,omitempty"`
+	// Op is the operation performed by the Update.
+	Op Op `json:"o,omitempty"`
+	// From is the source path of an OpMove or OpCopy Update.
+	From string `json:"f,omitempty"`
+}
+
+// An Op is an operation performed by an Update.
+type Op string
+
+// Supported operations.
+const (
+	// OpReplace replaces the element at Path with Value. It is the default
+	// operation.
+	OpReplace Op = ""
+	// OpDelete removes the element at Path. Value is ignored. Deleting an
+	// array element shifts the indices of subsequent elements. Path may not be
+	// "".
+	OpDelete Op = "d"
+	// OpInsert inserts Value into an array before the element at Path,
+	// shifting the indices of subsequent elements. The final accessor of Path
+	// may be the length of the array, or "-", in which case Value is appended
+	// to the array. Since encoding/json encodes a nil slice as null, a null
+	// value is treated as an empty array when inserting at "-" or 0. If Path
+	// refers to a key of an existing object, the key is set to Value, whether
+	// or not it already exists.
+	OpInsert Op = "i"
+	// OpMove removes the element at From and sets Path to its value, as by
+	// OpReplace. Value is ignored. Path is resolved after the element has
+	// been removed, so if From and Path are within the same array, Path
+	// refers to the array's indices after the removal. If either path is
+	// invalid, or Path is within From, the Update is malformed. If From and
+	// Path are equal, the Update has no effect.
+	OpMove Op = "m"
+	// OpCopy sets Path to the value of the element at From, as by OpReplace.
+	// Value is ignored. If either path is invalid, the Update is malformed.
+	OpCopy Op = "c"
+	// OpIncrement adds Value to the number at Path. If both numbers are
+	// integers, the sum is computed exactly (and the Update is malformed if it
+	// overflows an int64); otherwise, it is computed in floating point. If
+	// either Value or the element at Path is not a number, the Update is
+	// malformed.
+	OpIncrement Op = "+"
+	// OpUpsert is like OpReplace, but if Path references object keys that do
+	// not exist, they are created, along with any intermediate objects. For
+	// example, upserting the path a.b.c with the value 5 into {} yields
+	// {"a":{"b":{"c":5}}}. Intermediate values are always created as objects,
+	// even if the accessor is numeric; however, an existing array may be
+	// extended via its append index. If Path traverses an existing value that
+	// is neither an object nor an array, the Update is malformed.
+	OpUpsert Op = "u"
+	// OpReplaceAll is like OpReplace, but each "*" accessor in Path matches
+	// every element of an object or array. For example, the path
+	// items.*.active matches the active key of every element of items.
+	// Value replaces each matched element. Elements that do not contain the
+	// remainder of Path are skipped; if no elements match, the Update is
+	// malformed. Like OpReplace, OpReplaceAll never appends to an array. A
+	// literal "*" key can be matched by escaping it, i.e. \*.
+	OpReplaceAll Op = "*"
+)
+
+// needsValue reports whether op uses an Update's Value.
+func (op Op) needsValue() bool {
+	return op == OpReplace || op == OpInsert || op == OpUpsert || op == OpIncrement || op == OpReplaceAll
+}
+
+// apply applies u to obj, returning the new JSON. If u is malformed, obj is
+// returned unaltered and apply returns false. See the Update docstring for an
+// explanation of malformed Updates.
+//
+// obj must be valid JSON (or empty, in which case only an update replacing
+// the whole object succeeds). It is not validated here, since that would
+// require scanning the whole object for every update; instead, objects are
+// validated once, when they are loaded, and apply preserves their validity.
+func (u Update) apply(obj json.RawMessage) (json.RawMessage, bool) {
+	if u.Op == OpReplace {
+		// avoid allocating for single-accessor paths
+		if len(u.Value) == 0 {
+			return obj, false
+		}
+		return rewritePath(obj, u.Path, u.Value)
+	}
+	return u.applyCached(obj, nil)
+}
+
+// applyCached is like apply, but parses u's paths via paths, if non-nil.
+func (u Update) applyCached(obj json.RawMessage, paths *pathCache) (json.RawMessage, bool) {
+	accs := accessors
+	if paths != nil {
+		accs = paths.accessors
+	}
+	switch u.Op {
+	case OpReplace:
+		if len(u.Value) == 0 {
+			// u is malformed
+			return obj, false
+		}
+		return rewriteAccs(obj, accs(u.Path), u.Value)
+	case OpDelete:
+		return deleteAccs(obj, accs(u.Path))
+	case OpInsert:
+		if len(u.Value) == 0 {
+			return obj, false
+		}
+		return insertAccs(obj, accs(u.Path), u.Value)
+	case OpMove:
+		return moveAccs(obj, accs(u.From), accs(u.Path))
+	case OpCopy:
+		return copyAccs(obj, accs(u.From), accs(u.Path))
+	case OpIncrement:
+		return incrementAccs(obj, accs(u.Path), u.Value)
+	case OpUpsert:
+		if len(u.Value) == 0 {
+			return obj, false
+		}
+		return upsertAccs(obj, accs(u.Path), u.Value)
+	case OpReplaceAll:
+		if len(u.Value) == 0 {
+			return obj, false
+		}
+		return rewriteAll(obj, u.Path, u.Value)
+	default:
+		return obj, false
+	}
+}
+
+// diagnose returns an error describing why u is malformed with respect to
+// obj.
+func (u Update) diagnose(obj json.RawMessage) error {
+	needsValue := u.Op.needsValue()
+	switch {
+	case needsValue && !isValue(u.Value):
+		return fmt.Errorf("jj: value for %q is not valid JSON", u.Path)
+	case u.Op == OpIncrement && !isNumber(u.Value):
+		return fmt.Errorf("jj: increment for %q is not a number", u.Path)
+	case u.Op == OpDelete && u.Path == "":
+		return errors.New("jj: cannot delete the entire object")
+	case u.Op == OpMove || u.Op == OpCopy:
+		if _, ok := extractPath(obj, u.From); !ok {
+			return fmt.Errorf("%w: %q", ErrNotFound, u.From)
+		}
+	case !needsValue && u.Op != OpDelete:
+		return fmt.Errorf("jj: unrecognized op %q", u.Op)
+	}
+	if _, ok := extractPath(obj, u.Path); !ok {
+		return fmt.Errorf("%w: %q", ErrNotFound, u.Path)
+	}
+	return fmt.Errorf("jj: %q cannot be updated with op %q", u.Path, u.Op)
+}
+
+// appendUpdate appends the JSON encoding of u to buf. Value is appended
+// verbatim, without validation.
+func appendUpdate(buf []byte, u Update) []byte {
+	buf = append(buf, `{"p":`...)
+	buf = appendString(buf, u.Path)
+	if u.Op != OpReplace {
+		buf = append(buf, `,"o":`...)
+		buf = appendString(buf, string(u.Op))
+	}
+	if u.From != "" {
+		buf = append(buf, `,"f":`...)
+		buf = appendString(buf, u.From)
+	}
+	if len(u.Value) > 0 {
+		buf = append(buf, `,"v":`...)
+		buf = append(buf, u.Value...)
+	}
+	return append(buf, '}')
+}
+
+// updateSize returns an upper bound on the encoded size of u, assuming that
+// its Path and From do not require escaping.
+func updateSize(u Update) int {
+	return len(`{"p":"","o":"","f":"","v":}`) + len(u.Path) + len(u.Op) + len(u.From) + len(u.Value)
+}
+
+// MarshalJSON implements json.Marshaler. It produces the same encoding used
+// when u is written to a Journal: Path, Op, and From are escaped as by
+// encoding/json, and Value is included verbatim.
+func (u Update) MarshalJSON() ([]byte, error) {
+	return appendUpdate(nil, u), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It is stricter than the decoding
+// performed when a Journal is replayed: it returns an error if data is not an
+// object, if p is missing, if p, o, or f is not a string, or if v is missing
+// and u's Op requires a value. (Unrecognized Ops do not require a value.)
+// Unrecognized fields are ignored. Like other Unmarshalers, it does nothing
+// if data is null.
+func (u *Update) UnmarshalJSON(data []byte) error {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+	var raw struct {
+		Path  *string         `json:"p"`
+		Value json.RawMessage `json:"v"`
+		Op    Op              `json:"o"`
+		From  string          `json:"f"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("jj: invalid update: %w", err)
+	} else if raw.Path == nil {
+		return errors.New("jj: invalid update: missing path")
+	} else if raw.Op.needsValue() && len(raw.Value) == 0 {
+		return fmt.Errorf("jj: invalid update: missing value for %q", *raw.Path)
+	}
+	*u = Update{
+		Path:  *raw.Path,
+		Value: raw.Value,
+		Op:    raw.Op,
+		From:  raw.From,
+	}
+	return nil
+}
+
+// Equal reports whether u and other are equivalent, i.e. they have the same
+// Op, Path, and From, and their Values are equal ignoring insignificant
+// whitespace. A nil Value is equal to an empty one. Like Diff, Equal compares
+// Values textually, so objects whose keys are ordered differently are not
+// equal. If either Value is not valid JSON, the Values must be identical.
+func (u Update) Equal(other Update) bool {
+	if u.Op != other.Op || u.Path != other.Path || u.From != other.From {
+		return false
+	} else if bytes.Equal(u.Value, other.Value) {
+		return true
+	}
+	var a, b bytes.Buffer
+	if json.Compact(&a, u.Value) != nil || json.Compact(&b, other.Value) != nil {
+		return false
+	}
+	return bytes.Equal(a.Bytes(), b.Bytes())
+}
+
+// Identical is like Equal, but requires the Values of u and other to be
+// identical byte-for-byte.
+func (u Update) Identical(other Update) bool {
+	return u.Op == other.Op && u.Path == other.Path && u.From == other.From && bytes.Equal(u.Value, other.Value)
 }
 
-// apply applies u to obj, returning the new JSON, which may share underlying
-// memory with obj or u.Value. If u is malformed, obj is returned unaltered.
-// See the Update docstring for an explanation of malformed Updates. If obj is
-// not valid JSON, the result is undefined.
-func (u Update) apply(obj json.RawMessage) json.RawMessage {
+// String implements fmt.Stringer, rendering u compactly for debugging, e.g.
+// foo.bar = 3 or delete foo.bar. The whole object is rendered as "". A
+// missing Value is rendered as <nil>. The format is not stable and should not
+// be parsed.
+func (u Update) String() string {
+	appendPath := func(buf []byte, p string) []byte {
+		if p == "" {
+			return append(buf, `""`...)
+		}
+		return append(buf, p...)
+	}
+	buf := make([]byte, 0, updateSize(u)+8)
+	switch u.Op {
+	case OpDelete:
+		return string(appendPath(append(buf, "delete "...), u.Path))
+	case OpMove, OpCopy:
+		if u.Op == OpMove {
+			buf = append(buf, "move "...)
+		} else {
+			buf = append(buf, "copy "...)
+		}
+		buf = appendPath(buf, u.From)
+		return string(appendPath(append(buf, " -> "...), u.Path))
+	case OpReplace, OpReplaceAll, OpIncrement:
+	case OpInsert:
+		buf = append(buf, "insert "...)
+	case OpUpsert:
+		buf = append(buf, "upsert "...)
+	default:
+		buf = append(strconv.AppendQuote(buf, string(u.Op)), ' ')
+	}
+	buf = appendPath(buf, u.Path)
+	if u.Op == OpIncrement {
+		buf = append(buf, " += "...)
+	} else {
+		buf = append(buf, " = "...)
+	}
 	if len(u.Value) == 0 {
-		// u is malformed
-		return obj
+		buf = append(buf, "<nil>"...)
+	} else {
+		buf = append(buf, u.Value...)
 	}
-	return mjson.SetRawInPlace(obj, u.Path, u.Value)
+	return string(buf)
+}
+
+// GoString implements fmt.GoStringer, rendering u as a Go expression. Unlike
+// the default %#v format, Value is rendered as text rather than bytes.
+func (u Update) GoString() string {
+	buf := append([]byte(nil), "jj.Update{Path: "...)
+	buf = strconv.AppendQuote(buf, u.Path)
+	if u.Value != nil {
+		buf = append(buf, ", Value: json.RawMessage("...)
+		buf = strconv.AppendQuote(buf, string(u.Value))
+		buf = append(buf, ')')
+	}
+	if u.Op != OpReplace {
+		buf = append(buf, ", Op: "...)
+		buf = strconv.AppendQuote(buf, string(u.Op))
+	}
+	if u.From != "" {
+		buf = append(buf, ", From: "...)
+		buf = strconv.AppendQuote(buf, u.From)
+	}
+	return string(append(buf, '}'))
+}
+
+// EscapeKey escapes the '.', '\', and '*' characters in key, allowing it to be
+// used as an accessor in an Update's Path. Escaping '*' prevents the key from
+// being treated as a wildcard by OpReplaceAll.
+func EscapeKey(key string) string {
+	if !strings.ContainsAny(key, `.\*`) {
+		return key
+	}
+	buf := make([]byte, 0, len(key)+2)
+	for i := 0; i < len(key); i++ {
+		if key[i] == '.' || key[i] == '\\' || key[i] == '*' {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, key[i])
+	}
+	return string(buf)
 }
 
 // NewUpdate constructs an update using the provided path and val. If val
 // cannot be marshaled, NewUpdate panics. If val implements the json.Marshaler
 // interface, it is called directly. Note that this bypasses validation of the
 // produced JSON, which may result in a malformed Update.
+//
+// NewUpdate also panics if path is invalid, e.g. because it contains an empty
+// accessor; callers constructing paths from untrusted input should check them
+// with ValidatePath first. The other New*Update constructors validate their
+// paths in the same way. To access the empty key, use a Path, or construct
+// the Update directly.
 func NewUpdate(path string, val interface{}) Update {
+	mustValidatePath(path)
 	var data []byte
 	var err error
 	if m, ok := val.(json.Marshaler); ok {
@@ -233,3 +2086,112 @@ func NewUpdate(path string, val interface{}) Update {
 		Value: json.RawMessage(data),
 	}
 }
+
+// NewRawUpdate constructs an update that sets path to raw, without
+// marshaling it. If raw is not a valid JSON value, NewRawUpdate panics. If raw
+// spans multiple lines, it is compacted, since each update set must occupy a
+// single line of the Journal; otherwise, it is used verbatim.
+func NewRawUpdate(path string, raw json.RawMessage) Update {
+	mustValidatePath(path)
+	if !isValue(raw) {
+		panic("jj: invalid JSON value")
+	}
+	if bytes.ContainsAny(raw, "\r\n") {
+		var buf bytes.Buffer
+		json.Compact(&buf, raw) // raw is valid, so this cannot fail
+		raw = buf.Bytes()
+	}
+	return Update{
+		Path:  path,
+		Value: raw,
+	}
+}
+
+// NewDeleteUpdate constructs an update that deletes the element at path.
+func NewDeleteUpdate(path string) Update {
+	mustValidatePath(path)
+	return Update{
+		Path: path,
+		Op:   OpDelete,
+	}
+}
+
+// NewMoveUpdate constructs an update that moves the element at from to to.
+func NewMoveUpdate(from, to string) Update {
+	mustValidatePath(from)
+	mustValidatePath(to)
+	return Update{
+		Path: to,
+		Op:   OpMove,
+		From: from,
+	}
+}
+
+// NewCopyUpdate constructs an update that copies the element at from to to.
+func NewCopyUpdate(from, to string) Update {
+	mustValidatePath(from)
+	mustValidatePath(to)
+	return Update{
+		Path: to,
+		Op:   OpCopy,
+		From: from,
+	}
+}
+
+// NewIncrementUpdate constructs an update that adds delta to the number at
+// path.
+func NewIncrementUpdate(path string, delta float64) Update {
+	mustValidatePath(path)
+	return Update{
+		Path:  path,
+		Value: strconv.AppendFloat(nil, delta, 'g', -1, 64),
+		Op:    OpIncrement,
+	}
+}
+
+// NewUpsertUpdate constructs an update that sets path to val, creating any
+// missing object keys along path. It marshals val in the same manner as
+// NewUpdate.
+func NewUpsertUpdate(path string, val interface{}) Update {
+	u := NewUpdate(path, val)
+	u.Op = OpUpsert
+	return u
+}
+
+// NewReplaceAllUpdate constructs an update that sets every element matched by
+// path, which may contain "*" accessors, to val. It marshals val in the same
+// manner as NewUpdate.
+func NewReplaceAllUpdate(path string, val interface{}) Update {
+	u := NewUpdate(path, val)
+	u.Op = OpReplaceAll
+	return u
+}
+
+// NewInsertUpdate constructs an update that inserts val into an array at
+// path. It marshals val in the same manner as NewUpdate.
+func NewInsertUpdate(path string, val interface{}) Update {
+	u := NewUpdate(path, val)
+	u.Op = OpInsert
+	return u
+}
+
+// NewAppendUpdates constructs a sequence of updates that append each of vals,
+// in order, to the array at path. Each update inserts at the "-" accessor, so
+// the indices of the new elements need not be known in advance. path should
+// identify an array; note that, per OpInsert, if it identifies an object, the
+// updates instead set its "-" key. It marshals each value in the same manner
+// as NewUpdate.
+func NewAppendUpdates(path string, vals ...interface{}) []Update {
+	us := make([]Update, len(vals))
+	for i, val := range vals {
+		us[i] = NewInsertUpdate(joinPath(path, "-"), val)
+	}
+	return us
+}
+
+// mustValidatePath panics if path is invalid.
+func mustValidatePath(path string) {
+	if err := ValidatePath(path); err != nil {
+		panic(err)
+	}
+}
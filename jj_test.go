@@ -1,9 +1,21 @@
 package jj
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func tempFile(t interface {
@@ -72,6 +84,2158 @@ func TestJournal(t *testing.T) {
 	}
 }
 
+func TestJournalOps(t *testing.T) {
+	j, cleanup := tempJournal(t, map[string][]int{"x": {1, 2, 3}, "y": nil}, "TestJournalOps")
+	defer cleanup()
+
+	us := []Update{
+		NewDeleteUpdate("x.0"),
+		NewInsertUpdate("x.1", 4),
+		{Path: "x.0", Value: []byte("5"), Op: "bogus"},
+		NewMoveUpdate("x.-1", "y.0"),
+		NewCopyUpdate("y.0", "y.1"),
+		NewIncrementUpdate("y.1", 2),
+		NewUpsertUpdate("z.0", 6),
+	}
+	if err := j.Update(us); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	var obj struct {
+		X, Y []int
+		Z    map[string]int
+	}
+	j, err := OpenJournal(j.filename, &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if x, y := obj.X, obj.Y; len(x) != 2 || x[0] != 2 || x[1] != 4 || len(y) != 2 || y[0] != 3 || y[1] != 5 || obj.Z["0"] != 6 {
+		t.Fatal("ops were not applied correctly:", obj)
+	} else if s := j.ReplaySummary(); s.SkippedUpdates != 1 {
+		t.Fatal("expected bogus op to be skipped:", s)
+	}
+}
+
+func TestJournalEscapedPath(t *testing.T) {
+	j, cleanup := tempJournal(t, map[string]int{"a.b": 1, `c\d"`: 2}, "TestJournalEscapedPath")
+	defer cleanup()
+
+	us := []Update{
+		NewUpdate(EscapeKey("a.b"), 3),
+		NewUpdate(EscapeKey(`c\d"`), 4),
+	}
+	if err := j.Update(us); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	var obj map[string]int
+	j, err := OpenJournal(j.filename, &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if obj["a.b"] != 3 || j.ReplaySummary().SkippedSets != 0 {
+		t.Fatal("escaped path was not applied:", obj, j.ReplaySummary())
+	}
+}
+
+func TestJournalUnicode(t *testing.T) {
+	keys := []string{"\u00e9", "\U0001F600", "a\x00b", "\t\n", "\u2028", "\x01.\\"}
+	init := make(map[string]string)
+	for _, k := range keys {
+		init[k] = ""
+	}
+	j, cleanup := tempJournal(t, init, "TestJournalUnicode")
+	defer cleanup()
+
+	exp := make(map[string]string)
+	for i, k := range keys {
+		exp[k] = keys[(i+1)%len(keys)] + "\ufffd\u2029"
+		if err := j.Update([]Update{NewUpdate(EscapeKey(k), exp[k])}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	if r, err := Verify(j.filename); err != nil {
+		t.Fatal(err)
+	} else if !r.OK() {
+		t.Fatal("journal should be valid:", r)
+	}
+	var obj map[string]string
+	j, err := OpenJournal(j.filename, &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if !reflect.DeepEqual(obj, exp) || j.ReplaySummary().SkippedSets != 0 {
+		t.Fatal("unicode was not round-tripped:", obj, j.ReplaySummary())
+	}
+	for _, k := range keys {
+		var v string
+		if err := j.GetInto(EscapeKey(k), &v); err != nil || v != exp[k] {
+			t.Errorf("GetInto(%q): expected %q, got (%q, %v)", k, exp[k], v, err)
+		}
+	}
+}
+
+func TestJournalSnapshot(t *testing.T) {
+	j, cleanup := tempJournal(t, map[string]int{"x": 1}, "TestJournalSnapshot")
+	defer cleanup()
+
+	if s := string(j.Snapshot()); s != `{"x":1}` {
+		t.Fatal("wrong initial snapshot:", s)
+	}
+	if err := j.Update([]Update{NewUpdate("x", 2)}); err != nil {
+		t.Fatal(err)
+	} else if s := string(j.Snapshot()); s != `{"x":2}` {
+		t.Fatal("wrong snapshot after update:", s)
+	}
+	// modifying a snapshot should not affect the journal
+	s := j.Snapshot()
+	s[5] = '3'
+	if s := string(j.Snapshot()); s != `{"x":2}` {
+		t.Fatal("snapshot was modified:", s)
+	}
+	if err := j.Checkpoint(map[string]int{"y": 3}); err != nil {
+		t.Fatal(err)
+	} else if s := string(j.Snapshot()); s != `{"y":3}` {
+		t.Fatal("wrong snapshot after checkpoint:", s)
+	}
+	j.Close()
+
+	// the snapshot of a reopened journal should match
+	var obj map[string]int
+	j, err := OpenJournal(j.filename, &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if s := string(j.Snapshot()); s != `{"y":3}` {
+		t.Fatal("wrong snapshot after reopening:", s)
+	}
+}
+
+func TestNewJournal(t *testing.T) {
+	// create a journal in memory
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, map[string]int{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Update([]Update{NewUpdate("x", 2)}); err != nil {
+		t.Fatal(err)
+	} else if err := j.Checkpoint(nil); err == nil {
+		t.Fatal("expected Checkpoint to fail")
+	} else if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "{\"x\":1}\n[{\"p\":\"x\",\"v\":2}]\n"; buf.String() != exp {
+		t.Fatalf("expected %q, got %q", exp, buf.String())
+	}
+
+	// reopen, appending to the same buffer
+	var obj map[string]int
+	j, err = NewJournal(bytes.NewReader(buf.Bytes()), &buf, &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 2 {
+		t.Fatal("wrong object:", obj)
+	}
+	if err := j.Update([]Update{NewUpdate("x", 3)}); err != nil {
+		t.Fatal(err)
+	}
+	obj = nil
+	if _, err := NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, &obj); err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 3 {
+		t.Fatal("wrong object:", obj)
+	}
+}
+
+func TestCheckpointDurability(t *testing.T) {
+	type foo struct {
+		X int `json:"x"`
+	}
+	tf, cleanup := tempFile(t, "TestCheckpointDurability")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), foo{X: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	var synced []string
+	oldSyncDir := syncDir
+	syncDir = func(dir string) error {
+		synced = append(synced, dir)
+		return oldSyncDir(dir)
+	}
+	defer func() { syncDir = oldSyncDir }()
+	if err := j.Checkpoint(foo{X: 2}); err != nil {
+		t.Fatal(err)
+	} else if len(synced) != 1 || synced[0] != filepath.Dir(tf.Name()) {
+		t.Fatal("directory was not synced:", synced)
+	} else if _, err := os.Stat(tf.Name() + "_tmp"); !os.IsNotExist(err) {
+		t.Fatal("temp file should not exist:", err)
+	}
+
+	// if syncing the directory fails, the journal should still be usable
+	syncDir = func(string) error { return errors.New("sync failed") }
+	if err := j.Checkpoint(foo{X: 2}); err == nil {
+		t.Fatal("expected Checkpoint to fail")
+	}
+	syncDir = oldSyncDir
+	if err := j.Update([]Update{NewUpdate("x", 2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash immediately after the checkpoint by copying the file
+	// as it exists on disk, without closing the journal
+	crashed := func() foo {
+		data, err := ioutil.ReadFile(tf.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf, cleanup := tempFile(t, "TestCheckpointDurability")
+		defer cleanup()
+		cf.Write(data)
+		cf.Close()
+		var f foo
+		cj, err := OpenJournal(cf.Name(), &f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cj.Close()
+		return f
+	}
+	if f := crashed(); f.X != 2 {
+		t.Fatal("checkpoint did not survive crash:", f)
+	}
+
+	// the in-place fallback should produce an equivalent journal, and a
+	// crash at any point should leave either the old object or the new one
+	var snapshots [][]byte
+	syncFile = func(f *os.File) error {
+		data, err := ioutil.ReadFile(tf.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, data)
+		return f.Sync()
+	}
+	defer func() { syncFile = (*os.File).Sync }()
+	data, line, _ := j.encodeObject(foo{X: 3})
+	if runtime.GOOS == "windows" {
+		j.f.Close()
+	}
+	if j.f, err = j.overwrite(data, line); err != nil {
+		t.Fatal(err)
+	}
+	syncFile = (*os.File).Sync
+	j.w = j.f
+	if len(snapshots) != 4 {
+		t.Fatal("expected 4 syncs, got", len(snapshots))
+	}
+	// an interrupted overwrite of the initial object leaves a prefix of line
+	// in place of the old one
+	for n := 1; n < len(line); n += 2 {
+		torn := append([]byte(nil), snapshots[1]...)
+		copy(torn, line[:n])
+		snapshots = append(snapshots, torn)
+	}
+	for i, data := range snapshots {
+		var f foo
+		if _, err := NewJournal(bytes.NewReader(data), ioutil.Discard, &f); err != nil {
+			t.Fatalf("could not replay state %v (%q): %v", i, data, err)
+		} else if f.X != 2 && f.X != 3 {
+			t.Fatalf("wrong object for state %v (%q): %v", i, data, f)
+		}
+	}
+	if err := j.Update([]Update{NewUpdate("x", 4)}); err != nil {
+		t.Fatal(err)
+	} else if f := crashed(); f.X != 4 {
+		t.Fatal("overwritten journal was not replayed correctly:", f)
+	}
+}
+
+func TestAutoCheckpoint(t *testing.T) {
+	type foo struct {
+		X []int `json:"x"`
+	}
+	tf, cleanup := tempFile(t, "TestAutoCheckpoint")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), foo{X: []int{}}, WithAutoCheckpoint(500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shrinks int
+	prevSize := j.size
+	for i := 0; i < 200; i++ {
+		if err := j.Update([]Update{NewUpdate(fmt.Sprintf("x.%d", i), i)}); err != nil {
+			t.Fatal(err)
+		}
+		stat, err := os.Stat(tf.Name())
+		if err != nil {
+			t.Fatal(err)
+		} else if stat.Size() != j.size {
+			t.Fatalf("size is %v, but journal thinks it is %v", stat.Size(), j.size)
+		} else if j.size < prevSize {
+			shrinks++
+		} else if j.size > 500 && j.size-j.initSize >= j.initSize {
+			t.Fatal("journal should have been checkpointed")
+		}
+		prevSize = j.size
+	}
+	j.Close()
+	if shrinks < 2 {
+		t.Fatal("journal should have been checkpointed several times, got", shrinks)
+	}
+
+	var f foo
+	j, err = OpenJournal(tf.Name(), &f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if len(f.X) != 200 || f.X[199] != 199 {
+		t.Fatal("wrong final object:", f)
+	} else if stat, _ := os.Stat(tf.Name()); stat.Size() != j.size {
+		t.Fatalf("size is %v, but journal thinks it is %v", stat.Size(), j.size)
+	}
+}
+
+func TestJournalInitialObjectOnly(t *testing.T) {
+	for _, data := range []string{
+		`{"x":1}`,
+		"{\"x\":1}\n",
+		"{\"x\":1}\n\n",
+		"{\"x\":1}  \r\n \n",
+		"\n {\n\t\"x\": 1\n}\n",
+	} {
+		tf, cleanup := tempFile(t, "TestJournalInitialObjectOnly")
+		tf.WriteString(data)
+		tf.Close()
+		var obj map[string]int
+		j, err := OpenJournal(tf.Name(), &obj, WithStrict())
+		if err != nil {
+			t.Fatalf("%q: %v", data, err)
+		} else if obj["x"] != 1 || j.Len() != 0 || j.ReplaySummary().AppliedSets != 0 {
+			t.Fatalf("%q: wrong state: %v %v %+v", data, obj, j.Len(), j.ReplaySummary())
+		} else if s := j.Stats(); s.Size != int64(len(data)) || s.Sets != 0 {
+			t.Fatalf("%q: wrong stats: %+v", data, s)
+		}
+		// appending to the Journal should work regardless of the trailing
+		// whitespace
+		if err := j.Set("x", 2); err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		obj = nil
+		if j, err = OpenJournal(tf.Name(), &obj, WithStrict()); err != nil {
+			t.Fatalf("%q: %v", data, err)
+		} else if obj["x"] != 2 || j.Len() != 1 {
+			t.Fatalf("%q: wrong state after Set: %v %v", data, obj, j.Len())
+		}
+		j.Close()
+		cleanup()
+	}
+
+	// encoded Journals, with and without a trailing newline
+	for _, opts := range [][]Option{{WithChecksums()}, {WithCompression()}, {WithEncryption([32]byte{1})}} {
+		tf, cleanup := tempFile(t, "TestJournalInitialObjectOnly")
+		tf.Close()
+		j, err := OpenJournal(tf.Name(), map[string]int{"x": 1}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		data, _ := ioutil.ReadFile(tf.Name())
+		for _, trimmed := range []bool{false, true} {
+			if trimmed {
+				ioutil.WriteFile(tf.Name(), bytes.TrimSuffix(data, []byte("\n")), 0666)
+			}
+			var obj map[string]int
+			j, err := OpenJournal(tf.Name(), &obj, append(opts, WithStrict())...)
+			if err != nil {
+				t.Fatal(err)
+			} else if obj["x"] != 1 || j.Len() != 0 {
+				t.Fatal("wrong state:", obj, j.Len())
+			}
+			j.Close()
+		}
+		cleanup()
+	}
+}
+
+func TestJournalSeparators(t *testing.T) {
+	// the initial object need not be followed by a newline, and blank lines
+	// and surrounding whitespace are ignored
+	data := `{"x":0} [{"p":"x","v":1}]` + "\n\n \t[{\"p\":\"x\",\"v\":2}]\r\n\n"
+	var obj map[string]int
+	j, err := NewJournal(strings.NewReader(data), ioutil.Discard, &obj, WithStrict())
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 2 || j.ReplaySummary().AppliedSets != 2 {
+		t.Fatal("wrong replay:", obj, j.ReplaySummary())
+	}
+
+	// sets must be separated by newlines
+	data = `{"x":0}` + "\n" + `[{"p":"x","v":1}] [{"p":"x","v":2}]` + "\n" + `[{"p":"x","v":3}]`
+	j, err = NewJournal(strings.NewReader(data), ioutil.Discard, &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 3 || j.ReplaySummary().SkippedSets != 1 || j.ReplaySummary().AppliedSets != 1 {
+		t.Fatal("wrong replay:", obj, j.ReplaySummary())
+	}
+}
+
+func TestJournalStats(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestJournalStats")
+	defer cleanup()
+	tf.Write([]byte("{\"x\":1}\n[{\"p\":\"x\",\"v\":2}]\nbad\n"))
+	tf.Close()
+
+	var obj map[string]int
+	j, err := OpenJournal(tf.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if s := j.Stats(); s != (Stats{Size: 30, InitialSize: 8, Sets: 2}) {
+		t.Fatal("wrong stats after replay:", s)
+	}
+	if err := j.Update([]Update{NewUpdate("x", 3)}); err != nil {
+		t.Fatal(err)
+	} else if s := j.Stats(); s != (Stats{Size: 48, InitialSize: 8, Sets: 3}) {
+		t.Fatal("wrong stats after Update:", s)
+	} else if j.Len() != 3 {
+		t.Fatal("wrong Len after Update:", j.Len())
+	}
+	if err := j.Checkpoint(map[string]int{"y": 10}); err != nil {
+		t.Fatal(err)
+	} else if s := j.Stats(); s != (Stats{Size: 9, InitialSize: 9, Sets: 0}) {
+		t.Fatal("wrong stats after Checkpoint:", s)
+	} else if j.Len() != 0 {
+		t.Fatal("wrong Len after Checkpoint:", j.Len())
+	}
+}
+
+func TestAttachJournal(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestAttachJournal")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]int{"x": 0})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j.Set("x", 1); err != nil {
+		t.Fatal(err)
+	}
+	snap, stats := j.Snapshot(), j.Stats()
+	j.Close()
+
+	j, err = AttachJournal(tf.Name(), snap, stats)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != string(snap) || j.Stats() != stats {
+		t.Fatal("wrong state after attaching:", string(j.Snapshot()), j.Stats())
+	} else if err := j.Update([]Update{NewUpdate("x", 2)}); err != nil {
+		t.Fatal(err)
+	}
+	snap, stats = j.Snapshot(), j.Stats()
+	j.Close()
+
+	// the attached Journal should have appended to the file correctly
+	var obj map[string]int
+	j, err = OpenJournal(tf.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 2 || j.Stats() != stats {
+		t.Fatal("wrong state after reopening:", obj, j.Stats())
+	}
+	j.Close()
+
+	// mismatched sizes should be rejected
+	stale := stats
+	stale.Size--
+	if _, err := AttachJournal(tf.Name(), snap, stale); err == nil {
+		t.Fatal("expected error for mismatched size")
+	} else if _, err := AttachJournal(tf.Name(), snap, Stats{}); err == nil {
+		t.Fatal("expected error for invalid stats")
+	} else if _, err := AttachJournal(tf.Name(), json.RawMessage(`{"x":`), stats); err == nil {
+		t.Fatal("expected error for invalid snapshot")
+	}
+
+	// a nonexistent file should not be created
+	if _, err := AttachJournal(tf.Name()+"_nonexistent", snap, stats); err == nil {
+		t.Fatal("expected error for nonexistent file")
+	} else if _, err := os.Stat(tf.Name() + "_nonexistent"); !os.IsNotExist(err) {
+		t.Fatal("AttachJournal created a file")
+	}
+
+	// the lock should be held
+	j, err = AttachJournal(tf.Name(), snap, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if _, err := OpenJournal(tf.Name(), &obj); !errors.Is(err, ErrLocked) {
+		t.Fatal("expected ErrLocked, got", err)
+	}
+}
+
+func TestJournalReset(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestJournalReset")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]int{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	for i := 2; i <= 5; i++ {
+		if err := j.Set("x", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.Reset(); err != nil {
+		t.Fatal(err)
+	} else if data, err := ioutil.ReadFile(tf.Name()); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "{}\n" {
+		t.Fatalf("journal was not reset: %q", data)
+	} else if string(j.Snapshot()) != `{}` || j.Len() != 0 || j.Stats().Size != 3 {
+		t.Fatal("wrong state after Reset:", string(j.Snapshot()), j.Stats())
+	}
+
+	// the Journal should remain usable, and reopen as the updated empty object
+	if err := j.Update([]Update{NewUpsertUpdate("y", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	var obj map[string]int
+	if j, err = OpenJournal(tf.Name(), &obj); err != nil {
+		t.Fatal(err)
+	} else if len(obj) != 1 || obj["y"] != 1 {
+		t.Fatal("wrong object after reopening:", obj)
+	}
+	j.Close()
+
+	// like Checkpoint, Reset requires a writable, file-backed Journal
+	if nj, err := NewJournal(nil, ioutil.Discard, map[string]int{}); err != nil {
+		t.Fatal(err)
+	} else if err := nj.Reset(); err == nil {
+		t.Fatal("expected error for Journal without a file")
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestJournalCompact")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]interface{}{"x": 0, "y": []int{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	for i := 1; i <= 10; i++ {
+		if err := j.Update([]Update{NewUpdate("x", i), NewInsertUpdate("y.-", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"x":10,"y":[1,2,3,4,5,6,7,8,9,10]}`
+	data, err := ioutil.ReadFile(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != exp+"\n" {
+		t.Fatalf("journal was not compacted: %q", data)
+	} else if string(j.Snapshot()) != exp || j.Len() != 0 {
+		t.Fatal("wrong state after Compact:", string(j.Snapshot()), j.Len())
+	}
+
+	// compacting an already-compact Journal should not touch the file
+	before, _ := os.Stat(tf.Name())
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	} else if after, _ := os.Stat(tf.Name()); !os.SameFile(before, after) {
+		t.Fatal("file was replaced")
+	}
+
+	// the Journal should remain usable
+	if err := j.Set("x", 11); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	var obj struct{ X int }
+	if j, err := OpenJournal(tf.Name(), &obj); err != nil {
+		t.Fatal(err)
+	} else if j.Close(); obj.X != 11 {
+		t.Fatal("wrong object after reopening:", obj)
+	}
+}
+
+func TestJournalCloseCheckpoint(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestJournalCloseCheckpoint")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]int{"x": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 100; i++ {
+		if err := j.Set("x", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.CloseCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != "{\"x\":100}\n" {
+		t.Fatalf("journal was not checkpointed: %q", data)
+	}
+
+	var obj map[string]int
+	j, err = OpenJournal(tf.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 100 || j.Len() != 0 {
+		t.Fatal("wrong object after reopening:", obj, j.Len())
+	}
+	if err := j.CloseCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalMaxSetSize(t *testing.T) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, map[string]string{"x": ""}, WithMaxSetSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("a", 10000)
+	if err := j.Set("x", "small"); err != nil {
+		t.Fatal(err)
+	} else if err := j.Set("x", big); !errors.Is(err, ErrTooLarge) {
+		t.Fatal("expected ErrTooLarge, got", err)
+	} else if j.Len() != 1 || string(j.Snapshot()) != `{"x":"small"}` {
+		t.Fatal("oversized set should not have been applied:", string(j.Snapshot()))
+	}
+
+	// write an oversized set without a limit, followed by a small set
+	j, err = NewJournal(bytes.NewReader(buf.Bytes()), &buf, new(interface{}))
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j.Set("x", big); err != nil {
+		t.Fatal(err)
+	} else if err := j.Set("x", "end"); err != nil {
+		t.Fatal(err)
+	}
+
+	var obj map[string]string
+	j, err = NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, &obj, WithMaxSetSize(64))
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != "end" || j.ReplaySummary().SkippedSets != 1 || j.Stats().Size != int64(buf.Len()) {
+		t.Fatal("oversized set should have been skipped:", obj, j.ReplaySummary(), j.Stats())
+	}
+	_, err = NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, &obj, WithMaxSetSize(64), WithStrict())
+	var me *MalformedError
+	if !errors.As(err, &me) || !errors.Is(err, ErrTooLarge) || me.Offset != int64(bytes.Index(buf.Bytes(), []byte(big))-len(`[{"p":"x","v":"`)) {
+		t.Fatal("expected MalformedError wrapping ErrTooLarge, got", err)
+	}
+}
+
+func TestJournalPartialSet(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestJournalPartialSet")
+	defer cleanup()
+	tf.WriteString("{\"x\":1}\n[{\"p\":\"x\",\"v\":2}]\n[{\"p\":\"x\",")
+	tf.Close()
+
+	// the partial set should be removed when the Journal is opened
+	var obj map[string]int
+	j, err := OpenJournal(tf.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 2 || j.ReplaySummary().SkippedSets != 1 || j.Len() != 1 {
+		t.Fatal("wrong replay:", obj, j.ReplaySummary(), j.Len())
+	} else if err := j.Set("x", 3); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	data, err := ioutil.ReadFile(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := "{\"x\":1}\n[{\"p\":\"x\",\"v\":2}]\n[{\"p\":\"x\",\"v\":3}]\n"; string(data) != exp {
+		t.Fatalf("partial set was not removed: %q", data)
+	}
+	j, err = OpenJournal(tf.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if obj["x"] != 3 || j.ReplaySummary().SkippedSets != 0 {
+		t.Fatal("wrong replay:", obj, j.ReplaySummary())
+	}
+
+	// if the Journal is not file-backed, the next set should start on a new
+	// line instead
+	var buf bytes.Buffer
+	buf.WriteString("{\"x\":1}\n[{\"p\":\"x\",")
+	j, err = NewJournal(bytes.NewReader(buf.Bytes()), &buf, &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j.Set("x", 2); err != nil {
+		t.Fatal(err)
+	}
+	j, err = NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 2 || j.ReplaySummary().SkippedSets != 1 {
+		t.Fatal("wrong replay:", obj, j.ReplaySummary())
+	}
+}
+
+func TestJournalUnterminatedSet(t *testing.T) {
+	// a crash may leave a well-formed final line without its trailing
+	// newline; the next set must not be appended to it
+	tests := []struct {
+		data string
+		exp  string
+	}{
+		{"{\"x\":0,\"y\":0}\n[{\"p\":\"x\",\"v\":1}]", "{\"x\":0,\"y\":0}\n[{\"p\":\"x\",\"v\":1}]\n[{\"p\":\"y\",\"v\":5}]\n"},
+		{"{\"x\":1,\"y\":0}", "{\"x\":1,\"y\":0}\n[{\"p\":\"y\",\"v\":5}]\n"},
+		{"{\"x\":1,\"y\":0}[{\"p\":\"x\",", "{\"x\":1,\"y\":0}\n[{\"p\":\"y\",\"v\":5}]\n"},
+	}
+	for _, test := range tests {
+		tf, cleanup := tempFile(t, "TestJournalUnterminatedSet")
+		defer cleanup()
+		tf.WriteString(test.data)
+		tf.Close()
+
+		var obj map[string]int
+		j, err := OpenJournal(tf.Name(), &obj)
+		if err != nil {
+			t.Fatal(err)
+		} else if obj["x"] != 1 {
+			t.Fatal("wrong replay:", obj)
+		} else if err := j.Set("y", 5); err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		if data, err := ioutil.ReadFile(tf.Name()); err != nil {
+			t.Fatal(err)
+		} else if string(data) != test.exp {
+			t.Fatalf("wrong journal: expected %q, got %q", test.exp, data)
+		}
+		obj = nil
+		j, err = OpenJournal(tf.Name(), &obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		if obj["x"] != 1 || obj["y"] != 5 || j.ReplaySummary().SkippedSets != 0 {
+			t.Fatal("wrong replay:", obj, j.ReplaySummary())
+		}
+	}
+
+	// the same applies to encoded Journals, whose initial object occupies
+	// exactly one line
+	for _, sets := range []int{0, 1} {
+		var buf bytes.Buffer
+		j, err := NewJournal(nil, &buf, map[string]int{"x": 1, "y": 0}, WithChecksums())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < sets; i++ {
+			if err := j.Set("x", 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+		buf = *bytes.NewBuffer(append([]byte(nil), data...))
+		var obj map[string]int
+		if j, err = NewJournal(bytes.NewReader(data), &buf, &obj, WithChecksums()); err != nil {
+			t.Fatal(err)
+		} else if err := j.Set("y", 5); err != nil {
+			t.Fatal(err)
+		}
+		obj = nil
+		if j, err = NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, &obj, WithChecksums()); err != nil {
+			t.Fatal(err)
+		} else if obj["x"] != 1 || obj["y"] != 5 || j.ReplaySummary().SkippedSets != 0 {
+			t.Fatal("wrong replay:", obj, j.ReplaySummary())
+		}
+	}
+}
+
+func TestJournalBackup(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestJournalBackup")
+	defer cleanup()
+	tf.Close()
+	backup := tf.Name() + "_backup"
+	defer os.Remove(backup)
+	j, err := OpenJournal(tf.Name(), map[string]int{"x": 1}, WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	for i := 2; i <= 4; i++ {
+		if err := j.Set("x", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.Backup(backup); err != nil {
+		t.Fatal(err)
+	} else if err := j.Set("x", 5); err != nil {
+		t.Fatal("Journal should be usable after Backup:", err)
+	}
+
+	var obj map[string]int
+	b, err := OpenJournal(backup, &obj, WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if obj["x"] != 4 || b.Len() != 0 {
+		t.Fatal("wrong backup:", obj, b.Len())
+	}
+	if _, err := os.Stat(backup + "_tmp"); !os.IsNotExist(err) {
+		t.Fatal("temp file was not removed:", err)
+	}
+
+	// Backup may be called concurrently with Update
+	done := make(chan error)
+	go func() {
+		for i := 6; i <= 50; i++ {
+			if err := j.Set("x", i); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for running := true; running; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			running = false
+		default:
+			if err := j.Backup(backup); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	obj = nil
+	if b, err = OpenJournal(backup, &obj, WithChecksums()); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if obj["x"] < 5 || obj["x"] > 50 {
+		t.Fatal("wrong backup:", obj)
+	}
+}
+
+func TestJournalWriteSnapshot(t *testing.T) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, map[string]int{"x": 1}, WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j.Set("x", 2); err != nil {
+		t.Fatal(err)
+	}
+	size := buf.Len()
+	var out bytes.Buffer
+	if err := j.WriteSnapshot(&out); err != nil {
+		t.Fatal(err)
+	} else if out.String() != `{"x":2}`+"\n" {
+		t.Fatalf("wrong snapshot: %q", out.String())
+	} else if buf.Len() != size || j.Len() != 1 {
+		t.Fatal("WriteSnapshot modified the Journal")
+	}
+
+	// write errors are reported
+	werr := errors.New("write failed")
+	if err := j.WriteSnapshot(failWriter{werr}); !errors.Is(err, werr) {
+		t.Fatal("expected write error, got", err)
+	}
+}
+
+func TestCheckpointFailure(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		tf, cleanup := tempFile(t, "TestCheckpointFailure")
+		tf.Close()
+		var opts []Option
+		if keep {
+			opts = append(opts, WithKeepFailedCheckpoints())
+		}
+		j, err := OpenJournal(tf.Name(), map[string]int{"x": 1}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// encoding failure: no temp file should be created, and the Journal
+		// should be untouched
+		before, _ := ioutil.ReadFile(tf.Name())
+		for _, obj := range []interface{}{make(chan int), map[string]interface{}{"x": func() {}}} {
+			if err := j.Checkpoint(obj); err == nil {
+				t.Fatal("expected encoding error")
+			} else if _, err := os.Stat(tf.Name() + "_tmp"); !os.IsNotExist(err) {
+				t.Fatal("temp file should not exist:", err)
+			} else if kept, _ := filepath.Glob(tf.Name() + "_tmp.*"); len(kept) != 0 {
+				t.Fatal("no temp file should have been kept:", kept)
+			} else if after, _ := ioutil.ReadFile(tf.Name()); string(after) != string(before) {
+				t.Fatalf("journal was modified: %q -> %q", before, after)
+			} else if string(j.Snapshot()) != `{"x":1}` {
+				t.Fatal("object was modified:", string(j.Snapshot()))
+			}
+		}
+
+		// rename failure
+		rename = func(string, string) error { return errors.New("rename failed") }
+		err = j.Checkpoint(map[string]int{"x": 2})
+		rename = os.Rename
+		if err == nil {
+			t.Fatal("expected rename error")
+		} else if _, err := os.Stat(tf.Name() + "_tmp"); !os.IsNotExist(err) {
+			t.Fatal("temp file should not exist:", err)
+		}
+		kept, _ := filepath.Glob(tf.Name() + "_tmp.*")
+		if keep && len(kept) != 1 {
+			t.Fatal("temp file should have been kept:", kept)
+		} else if !keep && len(kept) != 0 {
+			t.Fatal("temp file should have been removed:", kept)
+		}
+		if len(kept) == 1 {
+			data, err := ioutil.ReadFile(kept[0])
+			os.Remove(kept[0])
+			if err != nil || string(data) != "{\"x\":2}\n" {
+				t.Fatalf("wrong temp file contents: %q %v", data, err)
+			}
+		}
+
+		// the Journal should still be usable
+		if runtime.GOOS != "windows" {
+			if err := j.Set("x", 3); err != nil {
+				t.Fatal(err)
+			} else if err := j.Checkpoint(map[string]int{"x": 4}); err != nil {
+				t.Fatal(err)
+			}
+
+			// close failure: the new file is already in place, so the
+			// Journal should switch to it anyway
+			j.f.Close()
+			if err := j.Checkpoint(map[string]int{"x": 5}); err == nil {
+				t.Fatal("expected close error")
+			} else if err := j.Set("x", 6); err != nil {
+				t.Fatal(err)
+			}
+			j.Close()
+			var obj map[string]int
+			if j, err = OpenJournal(tf.Name(), &obj); err != nil {
+				t.Fatal(err)
+			} else if obj["x"] != 6 || j.Len() != 1 {
+				t.Fatal("wrong object:", obj, j.Len())
+			}
+		}
+		j.Close()
+		cleanup()
+	}
+}
+
+func TestJournalPreallocation(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestJournalPreallocation")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]int{"x": 0}, WithPreallocation(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	for i := 1; i <= 500; i++ {
+		if err := j.Set("x", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runtime.GOOS == "linux" && j.prealloc > 0 && (j.alloc < j.size || j.alloc%4096 != 0) {
+		t.Fatal("wrong preallocated size:", j.alloc, j.size)
+	}
+	// the preallocated space should not be visible
+	if fi, err := os.Stat(tf.Name()); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != j.Stats().Size {
+		t.Fatal("file size does not match journal size:", fi.Size(), j.Stats().Size)
+	}
+	if err := j.Checkpoint(map[string]int{"x": 1000}); err != nil {
+		t.Fatal(err)
+	} else if err := j.Set("x", 1001); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	var obj map[string]int
+	r, err := OpenJournal(tf.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if obj["x"] != 1001 || r.ReplaySummary().SkippedSets != 0 {
+		t.Fatal("wrong object:", obj, r.ReplaySummary())
+	}
+}
+
+func TestJournalFileOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestJournalFileOptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmpDir := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tmpDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "journal")
+	j, err := OpenJournal(filename, map[string]int{"x": 1}, WithFileMode(0600), WithTempDir(tmpDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	var renamed string
+	rename = func(oldpath, newpath string) error {
+		renamed = oldpath
+		return os.Rename(oldpath, newpath)
+	}
+	defer func() { rename = os.Rename }()
+	if err := j.Checkpoint(map[string]int{"x": 2}); err != nil {
+		t.Fatal(err)
+	} else if filepath.Dir(renamed) != tmpDir {
+		t.Fatal("temp file was not created in temp dir:", renamed)
+	}
+	if runtime.GOOS != "windows" {
+		if fi, err := os.Stat(filename); err != nil {
+			t.Fatal(err)
+		} else if fi.Mode().Perm() != 0600 {
+			t.Fatal("wrong file mode:", fi.Mode())
+		}
+	}
+}
+
+func TestJournalCRLF(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithChecksums()}} {
+		j := &Journal{}
+		for _, opt := range opts {
+			opt(j)
+		}
+		lines := []string{
+			`{"x":1}`,
+			`[{"p":"x","v":2}]`,
+			`[{"p":"x","v":3}]`,
+			`[{"p":"x","v":4}]`,
+		}
+		var data []byte
+		for i, line := range lines {
+			data = append(data, j.encodeLine([]byte(line))...)
+			data = append(data, "\r\n \t\r\n"[:2+2*(i%2)]...)
+		}
+		var obj map[string]int
+		j, err := NewJournal(bytes.NewReader(data), ioutil.Discard, &obj, opts...)
+		if err != nil {
+			t.Fatal(err)
+		} else if obj["x"] != 4 {
+			t.Fatal("wrong object:", obj)
+		} else if s := j.ReplaySummary(); s.AppliedSets != 3 || s.SkippedSets != 0 || s.SkippedUpdates != 0 {
+			t.Fatal("wrong summary:", s)
+		}
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	// the object decoded from the journal should reflect each update, even
+	// when keys are duplicated
+	obj := json.RawMessage(`{"a":1,"a":2}`)
+	for i, u := range []Update{
+		NewUpdate("a", 3),
+		NewIncrementUpdate("a", 1),
+	} {
+		var ok bool
+		if obj, ok = u.apply(obj); !ok {
+			t.Fatal("update should have been applied:", u)
+		}
+		var m map[string]int
+		if err := json.Unmarshal(obj, &m); err != nil {
+			t.Fatal(err)
+		} else if m["a"] != 3+i {
+			t.Fatalf("expected %v, got %v (%s)", 3+i, m["a"], obj)
+		}
+	}
+	obj, _ = NewDeleteUpdate("a").apply(obj)
+	var m map[string]int
+	if err := json.Unmarshal(obj, &m); err != nil {
+		t.Fatal(err)
+	} else if _, ok := m["a"]; ok {
+		t.Fatalf("key should have been deleted: %s", obj)
+	}
+}
+
+func TestJournalUseNumber(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestJournalUseNumber")
+	defer cleanup()
+	tf.Close()
+	const big = 1<<53 + 1
+	j, err := OpenJournal(tf.Name(), map[string]interface{}{"id": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Update([]Update{NewUpdate("id", uint64(big))}); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	var obj map[string]interface{}
+	j, err = OpenJournal(tf.Name(), &obj, WithUseNumber())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if n, ok := obj["id"].(json.Number); !ok || n.String() != "9007199254740993" {
+		t.Fatalf("expected json.Number 9007199254740993, got %T %v", obj["id"], obj["id"])
+	} else if string(j.Snapshot()) != `{"id":9007199254740993}` {
+		t.Fatalf("wrong snapshot: %s", j.Snapshot())
+	}
+
+	// without the option, precision is lost
+	obj = nil
+	j, err = OpenJournal(tf.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if f, ok := obj["id"].(float64); !ok || uint64(f) == big {
+		t.Fatalf("expected imprecise float64, got %T %v", obj["id"], obj["id"])
+	}
+}
+
+func TestJournalSetOrder(t *testing.T) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, json.RawMessage(`{"y":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each update depends on the ones before it
+	err = j.Update([]Update{
+		NewUpdate("y.1", 0),                      // malformed: y is empty
+		NewUpdate("y.0", map[string]int{}),       // append to y
+		NewInsertUpdate("y.0.z", 1),              // create z
+		NewIncrementUpdate("y.0.z", 1),           // increment z
+		NewCopyUpdate("y.0", "y.1"),              // append a copy
+		NewDeleteUpdate("y.0"),                   // shift y.1 to y.0
+		NewUpdate("y.0.z", 3),                    // modify the copy
+		NewInsertUpdate("w", nil),                // create w...
+		NewMoveUpdate("y", "w"),                  // ...move y into it...
+		NewUpsertUpdate("y.a", json.Number("4")), // ...and recreate y
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"w":[{"z":3}],"y":{"a":4}}`
+	if string(j.Snapshot()) != exp {
+		t.Fatal("wrong object:", string(j.Snapshot()))
+	}
+
+	// replay must produce the same result
+	j, err = NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, new(interface{}))
+	if err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != exp {
+		t.Fatal("wrong replayed object:", string(j.Snapshot()))
+	} else if j.ReplaySummary().SkippedUpdates != 1 {
+		t.Fatal("wrong summary:", j.ReplaySummary())
+	}
+}
+
+func TestJournalSetDelete(t *testing.T) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, map[string]int{"x": 1, "y": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Set("x", 3); err != nil {
+		t.Fatal(err)
+	} else if err := j.Delete("y"); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"x":3}` {
+		t.Fatalf("wrong object: %s", j.Snapshot())
+	}
+	exp := "{\"x\":1,\"y\":2}\n[{\"p\":\"x\",\"v\":3}]\n[{\"p\":\"y\",\"o\":\"d\"}]\n"
+	if buf.String() != exp {
+		t.Fatalf("expected %q, got %q", exp, buf.String())
+	}
+}
+
+func TestNewRawUpdate(t *testing.T) {
+	raw := json.RawMessage(`{"b": [1, 2]}`)
+	if u := NewRawUpdate("a", raw); string(u.Value) != string(raw) {
+		t.Fatal("value was not stored verbatim:", string(u.Value))
+	}
+	u := NewRawUpdate("a", json.RawMessage("{\n  \"b\": \"x\\ny\"\n}"))
+	if string(u.Value) != `{"b":"x\ny"}` {
+		t.Fatal("multi-line value was not compacted:", string(u.Value))
+	}
+	for _, bad := range []string{``, `{`, `1 2`, `{"a":}`} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewRawUpdate(%q) should panic", bad)
+				}
+			}()
+			NewRawUpdate("a", json.RawMessage(bad))
+		}()
+	}
+}
+
+func TestUpdateMarshalJSON(t *testing.T) {
+	us := []Update{
+		NewUpdate("a\"b", 1),
+		NewDeleteUpdate("c"),
+		NewMoveUpdate("d", "e"),
+	}
+	var buf bytes.Buffer
+	j := &Journal{w: &buf}
+	if err := j.Update(us); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(us)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data)+"\n" != buf.String() {
+		t.Fatalf("MarshalJSON disagrees with Update: %s vs %s", data, buf.Bytes())
+	}
+	var dec []Update
+	if err := json.Unmarshal(data, &dec); err != nil {
+		t.Fatal(err)
+	} else if len(dec) != len(us) || dec[0].Path != us[0].Path || dec[2].From != us[2].From || dec[1].Op != OpDelete {
+		t.Fatal("Updates did not survive round-trip:", dec)
+	}
+
+	// paths and ops are escaped as by encoding/json
+	for _, u := range []Update{
+		{Path: `a"b\c`, Value: json.RawMessage(`1`)},
+		NewMoveUpdate("\n\t\u2028", "x\x01y"),
+		{Path: "<a&b>", Op: `"`},
+	} {
+		data, err := json.Marshal(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dec Update
+		if err := json.Unmarshal(data, &dec); err != nil {
+			t.Fatalf("could not unmarshal %s: %v", data, err)
+		} else if !dec.Identical(u) {
+			t.Fatalf("Update did not survive round-trip: %#v vs %#v", dec, u)
+		}
+	}
+}
+
+func TestUpdateUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		data string
+		exp  Update
+		ok   bool
+	}{
+		{`{"p":"a","v":1}`, NewUpdate("a", 1), true},
+		{`{"p":"a","v":null}`, Update{Path: "a", Value: json.RawMessage(`null`)}, true},
+		{`{"p":"","v":{"x": [1]}}`, Update{Path: "", Value: json.RawMessage(`{"x": [1]}`)}, true},
+		{`{"p":"a","o":"d"}`, NewDeleteUpdate("a"), true},
+		{`{"p":"b","o":"m","f":"a"}`, NewMoveUpdate("a", "b"), true},
+		{`{"p":"a","o":"?"}`, Update{Path: "a", Op: "?"}, true},
+		{`{"p":"a\"b\\c","v":1}`, Update{Path: `a"b\c`, Value: json.RawMessage(`1`)}, true},
+		// extra fields are ignored
+		{`{"p":"a","v":1,"x":[2]}`, NewUpdate("a", 1), true},
+		// missing v
+		{`{"p":"a"}`, Update{}, false},
+		{`{"p":"a","o":"i"}`, Update{}, false},
+		{`{"p":"a","o":"+"}`, Update{}, false},
+		// missing or non-string p
+		{`{"v":1}`, Update{}, false},
+		{`{"p":1,"v":1}`, Update{}, false},
+		{`{"p":null,"v":1}`, Update{}, false},
+		{`{"p":"a","o":1}`, Update{}, false},
+		{`{"p":"a","f":[],"o":"c"}`, Update{}, false},
+		// not an object
+		{`[]`, Update{}, false},
+		{`"a"`, Update{}, false},
+	}
+	for _, test := range tests {
+		var u Update
+		err := json.Unmarshal([]byte(test.data), &u)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: expected ok == %v, got %v", test.data, test.ok, err)
+		} else if test.ok && !u.Identical(test.exp) {
+			t.Errorf("%s: expected %#v, got %#v", test.data, test.exp, u)
+		}
+	}
+
+	// null is a no-op
+	u := NewUpdate("a", 1)
+	if err := json.Unmarshal([]byte(`null`), &u); err != nil || !u.Identical(NewUpdate("a", 1)) {
+		t.Error("null should not modify the Update:", u, err)
+	}
+
+	// replay is more lenient, skipping an update without a value rather than
+	// discarding its set
+	var obj map[string]int
+	j, err := NewJournal(strings.NewReader(`{"a":0,"b":0}`+"\n"+`[{"p":"a"},{"p":"b","v":2}]`), ioutil.Discard, &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["b"] != 2 {
+		t.Fatal("set should have been applied:", obj)
+	} else if s := j.ReplaySummary(); s.SkippedUpdates != 1 {
+		t.Fatal("wrong summary:", s)
+	}
+}
+
+func TestUpdateString(t *testing.T) {
+	tests := []struct {
+		u     Update
+		str   string
+		goStr string
+	}{
+		{NewUpdate("foo.bar", 3), `foo.bar = 3`, `jj.Update{Path: "foo.bar", Value: json.RawMessage("3")}`},
+		{NewUpdate("", map[string]int{"a": 1}), `"" = {"a":1}`, `jj.Update{Path: "", Value: json.RawMessage("{\"a\":1}")}`},
+		{Update{Path: "foo"}, `foo = <nil>`, `jj.Update{Path: "foo"}`},
+		{NewDeleteUpdate("foo"), `delete foo`, `jj.Update{Path: "foo", Op: "d"}`},
+		{NewInsertUpdate("foo.0", "x"), `insert foo.0 = "x"`, `jj.Update{Path: "foo.0", Value: json.RawMessage("\"x\""), Op: "i"}`},
+		{NewUpsertUpdate("a.b", true), `upsert a.b = true`, `jj.Update{Path: "a.b", Value: json.RawMessage("true"), Op: "u"}`},
+		{NewMoveUpdate("a", "b"), `move a -> b`, `jj.Update{Path: "b", Op: "m", From: "a"}`},
+		{NewCopyUpdate("a", ""), `copy a -> ""`, `jj.Update{Path: "", Op: "c", From: "a"}`},
+		{NewIncrementUpdate("n", 2), `n += 2`, `jj.Update{Path: "n", Value: json.RawMessage("2"), Op: "+"}`},
+		{NewReplaceAllUpdate("a.*", 0), `a.* = 0`, `jj.Update{Path: "a.*", Value: json.RawMessage("0"), Op: "*"}`},
+		{Update{Path: "a", Op: "?"}, `"?" a = <nil>`, `jj.Update{Path: "a", Op: "?"}`},
+	}
+	for _, test := range tests {
+		if s := test.u.String(); s != test.str {
+			t.Errorf("expected %s, got %s", test.str, s)
+		} else if s := fmt.Sprintf("%#v", test.u); s != test.goStr {
+			t.Errorf("expected %s, got %s", test.goStr, s)
+		}
+	}
+}
+
+func TestUpdateEqual(t *testing.T) {
+	tests := []struct {
+		a, b      Update
+		equal     bool
+		identical bool
+	}{
+		{NewUpdate("a", 1), NewUpdate("a", 1), true, true},
+		{NewUpdate("a", 1), NewUpdate("b", 1), false, false},
+		{NewUpdate("a", 1), NewUpsertUpdate("a", 1), false, false},
+		{NewMoveUpdate("a", "b"), NewMoveUpdate("a", "b"), true, true},
+		{NewMoveUpdate("a", "b"), NewCopyUpdate("a", "b"), false, false},
+		{NewMoveUpdate("a", "b"), NewMoveUpdate("c", "b"), false, false},
+		{NewDeleteUpdate("a"), Update{Path: "a", Value: json.RawMessage{}, Op: OpDelete}, true, true},
+		{NewUpdate("a", 1), Update{Path: "a"}, false, false},
+		{NewRawUpdate("a", json.RawMessage(`{"a":1}`)), NewRawUpdate("a", json.RawMessage(`{ "a" : 1 }`)), true, false},
+		{NewRawUpdate("a", json.RawMessage(`[1, 2]`)), NewRawUpdate("a", json.RawMessage("\t[1,2] ")), true, false},
+		{NewRawUpdate("a", json.RawMessage(`"a b"`)), NewRawUpdate("a", json.RawMessage(`"ab"`)), false, false},
+		{NewRawUpdate("a", json.RawMessage(`{"a":1,"b":2}`)), NewRawUpdate("a", json.RawMessage(`{"b":2,"a":1}`)), false, false},
+		{Update{Path: "a", Value: json.RawMessage(`{ "a"`)}, Update{Path: "a", Value: json.RawMessage(`{"a"`)}, false, false},
+	}
+	for i, test := range tests {
+		if test.a.Equal(test.b) != test.equal || test.b.Equal(test.a) != test.equal {
+			t.Errorf("%v: expected Equal(%v, %v) == %v", i, test.a, test.b, test.equal)
+		}
+		if test.a.Identical(test.b) != test.identical || test.b.Identical(test.a) != test.identical {
+			t.Errorf("%v: expected Identical(%v, %v) == %v", i, test.a, test.b, test.identical)
+		}
+	}
+}
+
+// A slowSyncer is a bytes.Buffer whose Sync method blocks until unblocked.
+type slowSyncer struct {
+	bytes.Buffer
+	unblock chan struct{}
+}
+
+func (s *slowSyncer) Sync() error {
+	<-s.unblock
+	return nil
+}
+
+func TestUpdateContext(t *testing.T) {
+	w := &slowSyncer{unblock: make(chan struct{})}
+	close(w.unblock)
+	j, err := NewJournal(nil, w, map[string]int{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	initLen := w.Len()
+
+	// a canceled context should prevent the write
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := j.UpdateContext(ctx, []Update{NewUpdate("x", 2)}); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	} else if w.Len() != initLen || string(j.Snapshot()) != `{"x":1}` {
+		t.Fatal("nothing should have been written")
+	}
+
+	// cancel while syncing; the update should be written and applied, but
+	// UpdateContext should return without waiting for the sync
+	w.unblock = make(chan struct{})
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := j.UpdateContext(ctx, []Update{NewUpdate("x", 3)}); err != context.DeadlineExceeded {
+		t.Fatal("expected context.DeadlineExceeded, got", err)
+	} else if w.Len() == initLen || string(j.Snapshot()) != `{"x":3}` {
+		t.Fatal("update should have been written and applied")
+	}
+
+	// Sync should wait for durability
+	done := make(chan error)
+	go func() { done <- j.Sync() }()
+	select {
+	case <-done:
+		t.Fatal("Sync returned before syncing")
+	case <-time.After(10 * time.Millisecond):
+	}
+	w.unblock <- struct{}{} // unblock the sync started by UpdateContext
+	w.unblock <- struct{}{} // unblock the sync started by Sync
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateContextCheckpoint(t *testing.T) {
+	// a sync abandoned by UpdateContext must not race with a subsequent
+	// Checkpoint, which must not close the file until the sync completes
+	synced, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	hook := func(time.Duration, error) {
+		once.Do(func() {
+			close(synced)
+			<-release
+		})
+	}
+	tf, cleanup := tempFile(t, "TestUpdateContextCheckpoint")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]int{"x": 1}, WithMetrics(Metrics{Sync: hook}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-synced
+		cancel()
+	}()
+	if err := j.UpdateContext(ctx, []Update{NewUpdate("x", 2)}); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	done := make(chan error)
+	go func() { done <- j.Checkpoint(map[string]int{"x": 3}) }()
+	select {
+	case <-done:
+		t.Fatal("Checkpoint returned before the sync completed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"x":3}` {
+		t.Fatal("wrong object:", string(j.Snapshot()))
+	}
+}
+
+func TestOpenJournalReadOnly(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestOpenJournalReadOnly")
+	defer cleanup()
+	tf.WriteString("{\"x\":1}\n[{\"p\":\"x\",\"v\":2}]\n")
+	tf.Close()
+	before, _ := ioutil.ReadFile(tf.Name())
+
+	var obj map[string]int
+	j, err := OpenJournalReadOnly(tf.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 2 {
+		t.Fatal("wrong object:", obj)
+	}
+	if err := j.Set("x", 3); err != ErrReadOnly {
+		t.Fatal("expected read-only error, got", err)
+	} else if err := j.Checkpoint(obj); err != ErrReadOnly {
+		t.Fatal("expected read-only error, got", err)
+	} else if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := ioutil.ReadFile(tf.Name()); !bytes.Equal(before, after) {
+		t.Fatal("read-only journal was modified")
+	}
+
+	// nonexistent journals are not created
+	if _, err := OpenJournalReadOnly(tf.Name()+"_nonexistent", &obj); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected not-exist error, got", err)
+	}
+}
+
+func TestJournalExists(t *testing.T) {
+	j, err := NewJournal(nil, ioutil.Discard, json.RawMessage(`{"a":null,"b":[1,{"c":2}],"d.e":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		exists bool
+	}{
+		{"", true},
+		{"a", true},
+		{"b.0", true},
+		{"b.1.c", true},
+		{"b.-1", true},
+		{`d\.e`, true},
+		{"x", false},
+		{"a.0", false},
+		{"b.2", false},
+		{"b.-3", false},
+		{"b.1.x", false},
+		{"d.e", false},
+	}
+	for _, test := range tests {
+		if j.Exists(test.path) != test.exists {
+			t.Errorf("Exists(%q): expected %v", test.path, test.exists)
+		}
+	}
+}
+
+func TestJournalGetInto(t *testing.T) {
+	j, err := NewJournal(nil, ioutil.Discard, json.RawMessage(`{"a":{"b":[1,{"c":"x"}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct {
+		C string `json:"c"`
+	}
+	if err := j.GetInto("a.b.1", &v); err != nil {
+		t.Fatal(err)
+	} else if v.C != "x" {
+		t.Fatal("wrong value:", v)
+	}
+	var n int
+	if err := j.GetInto("a.b.0", &n); err != nil || n != 1 {
+		t.Fatal("wrong value:", n, err)
+	} else if err := j.GetInto("a.x", &n); !errors.Is(err, ErrNotFound) {
+		t.Fatal("expected ErrNotFound, got", err)
+	} else if err := j.GetInto("a.b.1", &n); err == nil {
+		t.Fatal("expected decoding error")
+	}
+}
+
+func TestJournalConcurrentReaders(t *testing.T) {
+	f, cleanup := tempFile(t, "TestJournalConcurrentReaders")
+	defer cleanup()
+	f.Close()
+	j, err := OpenJournal(f.Name(), map[string]int{"a": 0, "b": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	// each set updates a and then b, so a reader that observes a partially
+	// applied set will see them differ
+	const n = 100
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for r := 0; r < cap(errs); r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var obj map[string]int
+				if err := json.Unmarshal(j.Snapshot(), &obj); err != nil {
+					errs <- err
+					return
+				} else if obj["a"] != obj["b"] {
+					errs <- fmt.Errorf("observed intermediate object: %v", obj)
+					return
+				} else if _, err := j.GetInt("a"); err != nil {
+					errs <- err
+					return
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	for i := 1; i <= n; i++ {
+		if err := j.Update([]Update{NewUpdate("a", i), NewUpdate("b", i)}); err != nil {
+			t.Fatal(err)
+		} else if i%10 == 0 {
+			if err := j.Compact(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if a, err := j.GetInt("b"); err != nil || a != n {
+		t.Fatal("wrong final value:", a, err)
+	}
+}
+
+func TestJournalGetMany(t *testing.T) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, map[string]interface{}{"a": 1, "b": []int{2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, err := j.GetMany([]string{"a", "b.0", "b", ""})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(vals) != 4 || string(vals[0]) != "1" || string(vals[1]) != "2" || string(vals[2]) != "[2]" || string(vals[3]) != `{"a":1,"b":[2]}` {
+		t.Fatalf("wrong values: %s", vals)
+	}
+	if vals, err := j.GetMany(nil); err != nil || len(vals) != 0 {
+		t.Fatal("expected no values:", vals, err)
+	} else if _, err := j.GetMany([]string{"a", "c"}); !errors.Is(err, ErrNotFound) {
+		t.Fatal("expected ErrNotFound, got", err)
+	}
+
+	// concurrent readers always observe a and b from the same set
+	if err := j.Update([]Update{NewUpdate("a", 1), NewUpdate("b.0", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	const n = 200
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for r := 0; r < cap(errs); r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				vals, err := j.GetMany([]string{"a", "b.0"})
+				if err != nil {
+					errs <- err
+					return
+				} else if string(vals[0]) != string(vals[1]) {
+					errs <- fmt.Errorf("inconsistent values: %s", vals)
+					return
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	for i := 2; i <= n; i++ {
+		if err := j.Update([]Update{NewUpdate("a", i), NewUpdate("b.0", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestJournalGetTyped(t *testing.T) {
+	j, err := NewJournal(nil, ioutil.Discard, json.RawMessage(`{"s":"a\"\u00e9\ud83d\ude00","i":-42,"f":1.5e3,"big":1e400,"huge":9223372036854775808,"t":true,"n":null,"o":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := j.GetString("s"); err != nil || s != "a\"\u00e9\U0001F600" {
+		t.Errorf("GetString: got %q, %v", s, err)
+	}
+	if i, err := j.GetInt("i"); err != nil || i != -42 {
+		t.Errorf("GetInt: got %v, %v", i, err)
+	}
+	if f, err := j.GetFloat("f"); err != nil || f != 1500 {
+		t.Errorf("GetFloat: got %v, %v", f, err)
+	} else if f, err := j.GetFloat("i"); err != nil || f != -42 {
+		t.Errorf("GetFloat: got %v, %v", f, err)
+	}
+	if b, err := j.GetBool("t"); err != nil || !b {
+		t.Errorf("GetBool: got %v, %v", b, err)
+	}
+
+	// type mismatches
+	for _, err := range []error{
+		func() error { _, err := j.GetString("i"); return err }(),
+		func() error { _, err := j.GetString("n"); return err }(),
+		func() error { _, err := j.GetInt("f"); return err }(),
+		func() error { _, err := j.GetInt("s"); return err }(),
+		func() error { _, err := j.GetFloat("t"); return err }(),
+		func() error { _, err := j.GetBool("n"); return err }(),
+		func() error { _, err := j.GetBool("o"); return err }(),
+	} {
+		if !errors.Is(err, ErrWrongType) {
+			t.Error("expected ErrWrongType, got", err)
+		}
+	}
+	// out-of-range numbers have the right type, but cannot be decoded
+	if _, err := j.GetInt("huge"); err == nil || errors.Is(err, ErrWrongType) {
+		t.Error("expected range error, got", err)
+	} else if _, err := j.GetFloat("big"); err == nil || errors.Is(err, ErrWrongType) {
+		t.Error("expected range error, got", err)
+	}
+	// missing paths
+	for _, err := range []error{
+		func() error { _, err := j.GetString("x"); return err }(),
+		func() error { _, err := j.GetInt("o.x"); return err }(),
+		func() error { _, err := j.GetFloat("s.0"); return err }(),
+		func() error { _, err := j.GetBool("t.x"); return err }(),
+	} {
+		if !errors.Is(err, ErrNotFound) {
+			t.Error("expected ErrNotFound, got", err)
+		}
+	}
+}
+
+func TestJournalReplace(t *testing.T) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, map[string]int{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j.Set("x", 2); err != nil {
+		t.Fatal(err)
+	} else if err := j.Replace([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `["a","b"]` || j.Len() != 2 {
+		t.Fatal("wrong state:", string(j.Snapshot()), j.Len())
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || lines[2] != `[{"p":"","v":["a","b"]}]` {
+		t.Fatalf("wrong journal: %q", lines)
+	}
+	if err := j.Replace(make(chan int)); err == nil {
+		t.Fatal("expected encoding error")
+	} else if j.Len() != 2 {
+		t.Fatal("nothing should have been written")
+	}
+
+	var obj []string
+	if _, err := NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, &obj); err != nil {
+		t.Fatal(err)
+	} else if strings.Join(obj, ",") != "a,b" {
+		t.Fatal("wrong object after replay:", obj)
+	}
+
+	if err := j.Undo(); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"x":2}` {
+		t.Fatal("wrong object after Undo:", string(j.Snapshot()))
+	}
+}
+
+// A rawMarshaler marshals to itself, bypassing the validation performed by
+// encoding/json.
+type rawMarshaler string
+
+func (m rawMarshaler) MarshalJSON() ([]byte, error) { return []byte(m), nil }
+
+func TestJournalWriteValidation(t *testing.T) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, map[string]int{"a": 0, "b": 0}, WithWriteValidation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := buf.Len()
+	for _, u := range []Update{
+		NewUpdate("b", rawMarshaler(`{"x":`)),
+		NewUpdate("b", rawMarshaler(`1 2`)),
+		NewUpdate("b", rawMarshaler("{\n}")),
+		NewDeleteUpdate("b"),
+	} {
+		if u.Op == OpDelete {
+			u.Value = json.RawMessage(`]`) // ignored, but still written
+		}
+		err := j.Update([]Update{NewUpdate("a", 1), u})
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("expected ErrMalformed for %v, got %v", u, err)
+		}
+	}
+	if buf.Len() != size || string(j.Snapshot()) != `{"a":0,"b":0}` {
+		t.Fatal("invalid set was written:", buf.String())
+	}
+	// valid sets, including those with updates that lack a value, are written
+	if err := j.Update([]Update{NewUpdate("a", rawMarshaler(`{"x": [1, 2]}`)), NewDeleteUpdate("b")}); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"a":{"x": [1, 2]}}` {
+		t.Fatal("wrong object:", string(j.Snapshot()))
+	}
+
+	// without validation, the invalid set is written, and discarded on replay
+	buf.Reset()
+	j, err = NewJournal(nil, &buf, map[string]int{"a": 0, "b": 0})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j.Update([]Update{NewUpdate("a", 1), NewUpdate("b", rawMarshaler(`{"x":`))}); err != nil {
+		t.Fatal(err)
+	}
+	var obj map[string]int
+	if _, err := NewJournal(&buf, ioutil.Discard, &obj); err != nil {
+		t.Fatal(err)
+	} else if obj["a"] != 0 {
+		t.Fatal("invalid set should have been discarded:", obj)
+	}
+}
+
+func TestJournalUpdateChecked(t *testing.T) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, json.RawMessage(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs, err := j.UpdateChecked([]Update{NewUpdate("a", 2)}); err != nil || errs != nil {
+		t.Fatal("unexpected errors:", errs, err)
+	}
+	errs, err := j.UpdateChecked([]Update{NewUpdate("b", 1), NewUpdate("a", 3), NewIncrementUpdate("a.x", 1)})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(errs) != 3 || !errors.Is(errs[0], ErrNotFound) || errs[1] != nil || errs[2] == nil {
+		t.Fatal("wrong errors:", errs)
+	} else if string(j.Snapshot()) != `{"a":3}` {
+		t.Fatal("wrong object:", string(j.Snapshot()))
+	}
+
+	// the set should have been written, and replay identically
+	var obj map[string]int
+	if r, err := NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, &obj); err != nil {
+		t.Fatal(err)
+	} else if obj["a"] != 3 || r.ReplaySummary().SkippedUpdates != 2 {
+		t.Fatal("wrong replay:", obj, r.ReplaySummary())
+	}
+
+	j.readOnly = true
+	if _, err := j.UpdateChecked([]Update{NewUpdate("a", 4)}); err != ErrReadOnly {
+		t.Fatal("expected ErrReadOnly, got", err)
+	}
+}
+
+func TestJournalAppend(t *testing.T) {
+	j, err := NewJournal(nil, ioutil.Discard, json.RawMessage(`{"a":[1],"b":{"c":[]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Append("a", 2, "x", []int{3}); err != nil {
+		t.Fatal(err)
+	} else if err := j.Append("b.c", true); err != nil {
+		t.Fatal(err)
+	} else if err := j.Append("a"); err != nil {
+		t.Fatal(err)
+	} else if exp := `{"a":[1,2,"x",[3]],"b":{"c":[true]}}`; string(j.Snapshot()) != exp {
+		t.Fatalf("expected %s, got %s", exp, j.Snapshot())
+	} else if j.Len() != 3 {
+		t.Fatal("wrong number of sets:", j.Len())
+	}
+
+	// appends can be combined with other updates in the same set
+	us := append(NewAppendUpdates("a", 4, 5), NewUpdate("a.5", 6))
+	if err := j.Update(us); err != nil {
+		t.Fatal(err)
+	} else if n, _ := j.Get("a"); string(n) != `[1,2,"x",[3],4,6]` {
+		t.Fatal("wrong array:", string(n))
+	}
+
+	// a nil slice in a struct is encoded as null, but can be appended to
+	var s struct{ Items []string }
+	j, err = NewJournal(nil, ioutil.Discard, s)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j.Append("Items", "x"); err != nil {
+		t.Fatal(err)
+	} else if err := j.Begin().Append("Items", "y").Commit(); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"Items":["x","y"]}` {
+		t.Fatal("wrong object:", string(j.Snapshot()))
+	}
+
+	// a root array
+	j, err = NewJournal(nil, ioutil.Discard, []int{})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j.Append("", 1, 2, 3); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `[1,2,3]` {
+		t.Fatal("wrong array:", string(j.Snapshot()))
+	}
+}
+
+func TestJournalDryRun(t *testing.T) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, json.RawMessage(`{"a":1,"b":[1,2]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := buf.Len()
+	if errs := j.DryRun([]Update{NewUpdate("a", 2), NewInsertUpdate("b.-", 3), NewDeleteUpdate("a")}); errs != nil {
+		t.Fatal("unexpected errors:", errs)
+	}
+	us := []Update{
+		NewUpdate("c", 1),
+		{Path: "a", Value: json.RawMessage(`{`)},
+		NewDeleteUpdate("a"),
+		NewUpdate("a", 2), // a was deleted by the previous update
+		NewIncrementUpdate("b", 1),
+		NewMoveUpdate("x", "a"),
+		{Path: "a", Op: "?"},
+	}
+	errs := j.DryRun(us)
+	if len(errs) != len(us) {
+		t.Fatal("wrong number of errors:", errs)
+	}
+	for i, ok := range []bool{false, false, true, false, false, false, false} {
+		if (errs[i] == nil) != ok {
+			t.Errorf("update %v: unexpected result %v", i, errs[i])
+		}
+	}
+	if !errors.Is(errs[0], ErrNotFound) || !errors.Is(errs[3], ErrNotFound) || !errors.Is(errs[5], ErrNotFound) {
+		t.Error("expected ErrNotFound:", errs)
+	}
+	if buf.Len() != size || string(j.Snapshot()) != `{"a":1,"b":[1,2]}` {
+		t.Fatal("DryRun modified the Journal")
+	}
+}
+
+func TestJournalUndo(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestJournalUndo")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]interface{}{"x": 1, "y": []int{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Undo(); err == nil {
+		t.Fatal("expected error when there is nothing to undo")
+	}
+	if err := j.Update([]Update{NewUpdate("x", 2), NewDeleteUpdate("y.0"), NewUpsertUpdate("z", true)}); err != nil {
+		t.Fatal(err)
+	} else if err := j.Undo(); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"x":1,"y":[1,2]}` {
+		t.Fatalf("Undo did not restore original object: %s", j.Snapshot())
+	} else if err := j.Undo(); err == nil {
+		t.Fatal("expected error when undoing twice")
+	}
+	// undoing an update that changed nothing should write nothing
+	if err := j.Set("x", 1); err != nil {
+		t.Fatal(err)
+	}
+	size := j.Stats().Size
+	if err := j.Undo(); err != nil {
+		t.Fatal(err)
+	} else if j.Stats().Size != size {
+		t.Fatal("Undo wrote an empty update set")
+	} else if err := j.Undo(); err == nil {
+		t.Fatal("expected error when undoing twice")
+	}
+	j.Close()
+
+	// the undo should be persisted
+	var obj map[string]interface{}
+	j, err = OpenJournal(tf.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if string(j.Snapshot()) != `{"x":1,"y":[1,2]}` {
+		t.Fatalf("undo was not persisted: %s", j.Snapshot())
+	}
+}
+
+// A failWriter returns err from each call to Write.
+type failWriter struct{ err error }
+
+func (w failWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestJournalErrors(t *testing.T) {
+	// malformed initial object
+	var obj map[string]int
+	for _, data := range []string{`{"x":`, `{"x":]`} {
+		if _, err := NewJournal(strings.NewReader(data), ioutil.Discard, &obj); !errors.Is(err, ErrMalformed) {
+			t.Errorf("expected ErrMalformed for %q, got %v", data, err)
+		}
+	}
+	// malformed set in strict mode
+	_, err := NewJournal(strings.NewReader("{}\n[\n"), ioutil.Discard, &obj, WithStrict())
+	var me *MalformedError
+	if !errors.Is(err, ErrMalformed) || !errors.As(err, &me) {
+		t.Error("expected MalformedError, got", err)
+	}
+	// undecodable object
+	var n int
+	var ute *json.UnmarshalTypeError
+	if _, err := NewJournal(strings.NewReader(`{}`), ioutil.Discard, &n); !errors.As(err, &ute) {
+		t.Error("expected UnmarshalTypeError, got", err)
+	}
+
+	// write errors
+	j, err := NewJournal(strings.NewReader(`{"x":1}`), nil, &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errDisk := errors.New("disk full")
+	j.w = failWriter{errDisk}
+	if err := j.Set("x", 2); !errors.Is(err, errDisk) {
+		t.Error("expected wrapped write error, got", err)
+	}
+
+	// Get
+	if val, err := j.Get("x"); err != nil || string(val) != "1" {
+		t.Error("expected 1, got", string(val), err)
+	} else if _, err := j.Get("y"); !errors.Is(err, ErrNotFound) {
+		t.Error("expected ErrNotFound, got", err)
+	}
+}
+
+// A shortWriter writes at most max bytes per call to Write, and fails after
+// writing failAfter bytes in total, if failAfter is non-negative.
+type shortWriter struct {
+	bytes.Buffer
+	max       int
+	failAfter int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	if w.failAfter >= 0 {
+		if w.failAfter < len(p) {
+			p = p[:w.failAfter]
+		}
+		if len(p) == 0 {
+			return 0, errors.New("write failed")
+		}
+		w.failAfter -= len(p)
+	}
+	return w.Buffer.Write(p)
+}
+
+// A writerFunc is a function that implements io.Writer.
+type writerFunc func([]byte) (int, error)
+
+func (fn writerFunc) Write(p []byte) (int, error) { return fn(p) }
+
+func TestJournalShortWrites(t *testing.T) {
+	// short writes without an error should be retried
+	w := &shortWriter{max: 3, failAfter: -1}
+	j, err := NewJournal(nil, w, map[string]int{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j.Set("x", 2); err != nil {
+		t.Fatal(err)
+	} else if w.String() != "{\"x\":1}\n[{\"p\":\"x\",\"v\":2}]\n" {
+		t.Fatalf("wrong journal contents: %q", w.String())
+	}
+	w.max = 0
+	if err := j.Set("x", 3); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatal("expected ErrShortWrite, got", err)
+	}
+
+	// a write that fails partway should not corrupt subsequent sets
+	w.max, w.failAfter = 100, 5
+	if err := j.Set("x", 4); err == nil {
+		t.Fatal("expected write to fail")
+	}
+	w.failAfter = -1
+	if err := j.Set("x", 5); err != nil {
+		t.Fatal(err)
+	} else if j.Stats().Size != int64(w.Len()) {
+		t.Fatalf("size is %v, but journal thinks it is %v", w.Len(), j.Stats().Size)
+	}
+	var obj map[string]int
+	j, err = NewJournal(bytes.NewReader(w.Bytes()), ioutil.Discard, &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 5 || j.ReplaySummary().SkippedSets != 1 {
+		t.Fatal("journal was not replayed correctly:", obj, j.ReplaySummary())
+	}
+
+	// for files, the partial write should be removed
+	tf, cleanup := tempFile(t, "TestJournalShortWrites")
+	defer cleanup()
+	tf.Close()
+	j, err = OpenJournal(tf.Name(), map[string]int{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	j.w = writerFunc(func(p []byte) (int, error) {
+		n, _ := j.f.Write(p[:5])
+		return n, errors.New("write failed")
+	})
+	if err := j.Set("x", 2); err == nil {
+		t.Fatal("expected write to fail")
+	}
+	j.w = j.f
+	if err := j.Set("x", 3); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(tf.Name())
+	if string(data) != "{\"x\":1}\n[{\"p\":\"x\",\"v\":3}]\n" {
+		t.Fatalf("partial write was not removed: %q", data)
+	}
+}
+
+func TestJournalEmpty(t *testing.T) {
+	for _, contents := range []string{"", "\n \n"} {
+		f, cleanup := tempFile(t, "TestJournalEmpty")
+		f.WriteString(contents)
+		f.Close()
+
+		// open the empty file and immediately update it
+		obj := map[string]int{"foo": 3}
+		j, err := OpenJournal(f.Name(), obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Update([]Update{NewUpdate("foo", 4)}); err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+
+		// reopen and check that the update was applied
+		obj = nil
+		j, err = OpenJournal(f.Name(), &obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		if obj["foo"] != 4 {
+			t.Fatal("update was not applied:", obj)
+		}
+		cleanup()
+	}
+}
+
 func TestJournalMalformed(t *testing.T) {
 	f, cleanup := tempFile(t, "TestJournalMalformed")
 	defer cleanup()
@@ -98,23 +2262,292 @@ func TestJournalMalformed(t *testing.T) {
 	}
 }
 
+func TestJournalReplaySummary(t *testing.T) {
+	f, cleanup := tempFile(t, "TestJournalReplaySummary")
+	defer cleanup()
+
+	// write a log with a malformed set in the middle, a set containing a
+	// malformed update, and a partially-written set at the end
+	f.WriteString(`{"foo": 3, "bar": [] }
+[{"p": "foo", "v": 4}]
+[{"p": "foo", "v": 5}
+[{"p": "bar.0", "v": 6}, {"p": "baz", "v": 7}, {"p": "bar.1", "v": 8}]
+[{"p": "foo", "v": 9}`)
+	f.Close()
+
+	var obj struct {
+		Foo int   `json:"foo"`
+		Bar []int `json:"bar"`
+	}
+	j, err := OpenJournal(f.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	if obj.Foo != 4 || len(obj.Bar) != 2 || obj.Bar[0] != 6 || obj.Bar[1] != 8 {
+		t.Fatal("log was not applied correctly:", obj)
+	}
+	s := j.ReplaySummary()
+	if s.AppliedSets != 2 || s.SkippedSets != 2 || s.SkippedUpdates != 1 {
+		t.Fatal("wrong summary:", s)
+	} else if len(s.SkippedOffsets) != 2 || s.SkippedOffsets[0] != 46 || s.SkippedOffsets[1] != 139 {
+		t.Fatal("wrong skipped offsets:", s.SkippedOffsets)
+	}
+}
+
+func TestJournalMalformedInitial(t *testing.T) {
+	f, cleanup := tempFile(t, "TestJournalMalformedInitial")
+	defer cleanup()
+
+	// write a log with a truncated initial object, followed by a malformed
+	// set, a set that replaces the whole object, and a regular set
+	const head = `{"foo": 3, "bar": [1,` + "\n" + `[{"p": "foo", "v": 4}` + "\n"
+	f.WriteString(head + `[{"p": "foo", "v": 5}, {"p": "", "v": {"foo": 6, "bar": []}}]
+[{"p": "bar", "v": [7]}]
+`)
+	f.Close()
+
+	var obj struct {
+		Foo int   `json:"foo"`
+		Bar []int `json:"bar"`
+	}
+	j, err := OpenJournal(f.Name(), &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj.Foo != 6 || len(obj.Bar) != 1 || obj.Bar[0] != 7 {
+		t.Fatal("log was not applied correctly:", obj)
+	}
+	s := j.ReplaySummary()
+	if !errors.Is(s.InitialErr, ErrMalformed) || s.AppliedSets != 2 || s.SkippedUpdates != 1 || s.SkippedSets != 0 {
+		t.Fatal("wrong summary:", s)
+	} else if st := j.Stats(); st.InitialSize != int64(len(head)) || st.Sets != 2 {
+		t.Fatal("wrong stats:", st)
+	} else if r, err := Verify(f.Name()); err != nil || r.InitialErr == nil || len(r.Sets) != 2 || !r.FinalValid {
+		t.Fatal("wrong report:", r, err)
+	}
+	// the Journal should remain usable, and a checkpoint should replace the
+	// malformed head
+	if err := j.Set("foo", 8); err != nil {
+		t.Fatal(err)
+	} else if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if r, err := Verify(f.Name()); err != nil || !r.OK() {
+		t.Fatal("expected clean report:", r, err)
+	}
+
+	// recovery is not possible if the first well-formed set does not replace
+	// the object, or in strict mode
+	for _, data := range []string{
+		head,
+		head + `[{"p": "foo", "v": 5}]` + "\n" + `[{"p": "", "v": {}}]`,
+	} {
+		if _, err := NewJournal(strings.NewReader(data), ioutil.Discard, &obj); !errors.Is(err, ErrMalformed) {
+			t.Errorf("expected ErrMalformed for %q, got %v", data, err)
+		}
+	}
+	data := head + `[{"p": "", "v": {}}]`
+	if _, err := NewJournal(strings.NewReader(data), ioutil.Discard, &obj, WithStrict()); !errors.Is(err, ErrMalformed) {
+		t.Error("expected ErrMalformed in strict mode, got", err)
+	}
+	// non-seekable readers are also supported
+	if _, err := NewJournal(ioutil.NopCloser(strings.NewReader(data)), ioutil.Discard, &obj); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJournalStrict(t *testing.T) {
+	tests := []struct {
+		log    string
+		offset int64
+		data   string
+	}{
+		{
+			log: `{"foo": 3}
+[{"p": "foo", "v": 4}]
+[{"p": "foo", "v": 5}
+[{"p": "foo", "v": 6}]
+`,
+			offset: 34,
+			data:   `[{"p": "foo", "v": 5}`,
+		},
+		{
+			log: `{"foo": 3}
+[{"p": "foo", "v": 4}]
+[{"p": "foo", "v": 5}, {"p": "bar", "v": 6}]
+`,
+			offset: 34,
+			data:   `{"p":"bar","v":6}`,
+		},
+	}
+	for _, test := range tests {
+		f, cleanup := tempFile(t, "TestJournalStrict")
+		f.WriteString(test.log)
+		f.Close()
+
+		// lenient mode should succeed
+		var foo struct {
+			Foo int `json:"foo"`
+		}
+		j, err := OpenJournal(f.Name(), &foo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+
+		// strict mode should fail
+		_, err = OpenJournal(f.Name(), &foo, WithStrict())
+		if me, ok := err.(*MalformedError); !ok {
+			t.Fatal("expected MalformedError, got", err)
+		} else if me.Offset != test.offset || string(me.Data) != test.data {
+			t.Fatalf("wrong error details: %v %s", me.Offset, me.Data)
+		}
+		cleanup()
+	}
+}
+
+func TestApplyEmptyValue(t *testing.T) {
+	obj := json.RawMessage(`{"foo":1}`)
+	for _, u := range []Update{
+		{Path: "foo"},
+		{Path: "foo", Value: json.RawMessage{}},
+		{Path: "", Value: nil},
+	} {
+		if res, ok := u.apply(obj); ok || string(res) != string(obj) {
+			t.Errorf("Update with empty Value should be malformed: %v %s", ok, res)
+		}
+	}
+}
+
 func BenchmarkUpdateJournal(b *testing.B) {
 	f, cleanup := tempFile(b, "BenchmarkUpdateJournal")
 	defer cleanup()
 
-	j := &Journal{f: f}
+	j := &Journal{w: f}
+	us := []Update{
+		NewUpdate("foo.bar", struct{ X, Y int }{3, 4}),
+		NewUpdate("foo.bar", nil),
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := j.Update(us); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUpdatePreallocation(b *testing.B) {
+	for _, chunk := range []int64{0, 1 << 20} {
+		b.Run(fmt.Sprint(chunk), func(b *testing.B) {
+			tf, cleanup := tempFile(b, "BenchmarkUpdatePreallocation")
+			defer cleanup()
+			tf.Close()
+			j, err := OpenJournal(tf.Name(), map[string]int{"x": 0}, WithPreallocation(chunk))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer j.Close()
+			us := []Update{NewUpdate("x", strings.Repeat("x", 1000))}
+			b.SetBytes(int64(updateSize(us[0])))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := j.Update(us); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUpdateAllocs(b *testing.B) {
+	// without a file, the cost of Update is dominated by encoding the set
+	j := &Journal{w: ioutil.Discard}
 	us := []Update{
 		NewUpdate("foo.bar", struct{ X, Y int }{3, 4}),
 		NewUpdate("foo.bar", nil),
 	}
 
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := j.Update(us); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUpdateLarge(b *testing.B) {
+	// a fresh Journal has no buffer to reuse, so this measures the cost of
+	// allocating one for a large set
+	us := []Update{
+		NewUpdate("foo", strings.Repeat("x", 1<<16)),
+		NewUpdate("bar", 7),
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(us[0].Value)))
 	for i := 0; i < b.N; i++ {
+		j := &Journal{w: ioutil.Discard}
 		if err := j.Update(us); err != nil {
 			b.Fatal(err)
 		}
 	}
 }
 
+func BenchmarkUpdateRepeated(b *testing.B) {
+	// a compare-and-swap loop applies the same paths repeatedly
+	j, err := NewJournal(nil, ioutil.Discard, map[string]interface{}{
+		"users": map[string]interface{}{
+			"alice": map[string]int{"balance": 0},
+			"bob":   map[string]int{"balance": 0},
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	us := []Update{
+		NewIncrementUpdate("users.alice.balance", 1),
+		NewIncrementUpdate("users.bob.balance", -1),
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := j.UpdateChecked(us); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReplay(b *testing.B) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, map[string]interface{}{
+		"users": map[string]interface{}{
+			"alice": map[string]int{"balance": 0},
+			"bob":   map[string]int{"balance": 0},
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		err := j.Update([]Update{
+			NewUpdate("users.alice.balance", i),
+			NewUpdate("users.bob.balance", -i),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(buf.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, new(interface{})); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkApply(b *testing.B) {
 	u := NewUpdate("foo.bar.baz", "")
 	json := []byte(`{"foo": {"bar": {"baz": "quux"}}}`)
@@ -122,3 +2555,12 @@ func BenchmarkApply(b *testing.B) {
 		u.apply(json)
 	}
 }
+
+func BenchmarkApplyShallow(b *testing.B) {
+	u := NewUpdate("baz", "")
+	json := []byte(`{"foo": {"bar": 1}, "baz": "quux"}`)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		u.apply(json)
+	}
+}
@@ -0,0 +1,46 @@
+package jj
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrLocked is returned by OpenJournal if the Journal is already open in
+// another process (or elsewhere in the same process).
+var ErrLocked = errors.New("jj: Journal is locked by another process")
+
+// openLocked opens filename and, unless readOnly is true, takes an exclusive
+// advisory lock on it, creating it with the given mode if it does not exist.
+// Read-only opens take no lock, so that readers (e.g. Follow) may observe a
+// Journal while it is being written.
+func openLocked(filename string, readOnly bool, mode os.FileMode) (*os.File, error) {
+	if readOnly {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("jj: could not open journal: %w", err)
+		}
+		return f, nil
+	}
+	for {
+		f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, mode)
+		if err != nil {
+			return nil, fmt.Errorf("jj: could not open journal: %w", err)
+		}
+		if err := lockFile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// Checkpoint replaces the file, so the file we locked may have been
+		// replaced between opening and locking it. If so, try again.
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("jj: could not stat journal: %w", err)
+		}
+		if cur, err := os.Stat(filename); err == nil && os.SameFile(fi, cur) {
+			return f, nil
+		}
+		f.Close()
+	}
+}
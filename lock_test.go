@@ -0,0 +1,71 @@
+package jj
+
+import (
+	"testing"
+)
+
+func TestJournalLocking(t *testing.T) {
+	if !lockingSupported {
+		t.Skip("locking is not supported on this platform")
+	}
+	type foo struct {
+		X int `json:"x"`
+	}
+	tf, cleanup := tempFile(t, "TestJournalLocking")
+	defer cleanup()
+	tf.Close()
+
+	j, err := OpenJournal(tf.Name(), foo{X: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f foo
+	if _, err := OpenJournal(tf.Name(), &f); err != ErrLocked {
+		t.Fatal("expected ErrLocked, got", err)
+	}
+	// readers take no lock, and may open the journal while it is being
+	// written
+	r, err := OpenJournal(tf.Name(), &f, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	} else if f.X != 1 {
+		t.Fatal("wrong object:", f)
+	}
+	r.Close()
+	// the lock must survive a checkpoint, which replaces the file
+	if err := j.Checkpoint(foo{X: 2}); err != nil {
+		t.Fatal(err)
+	} else if _, err := OpenJournal(tf.Name(), &f); err != ErrLocked {
+		t.Fatal("expected ErrLocked after Checkpoint, got", err)
+	}
+	if err := j.Update([]Update{NewUpdate("x", 3)}); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	// multiple readers may open the journal concurrently
+	r1, err := OpenJournal(tf.Name(), &f, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	} else if f.X != 3 {
+		t.Fatal("wrong object:", f)
+	}
+	r2, err := OpenJournal(tf.Name(), &f, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r1.Update([]Update{NewUpdate("x", 4)}); err != ErrReadOnly {
+		t.Fatal("expected read-only error, got", err)
+	} else if err := r1.Checkpoint(foo{}); err != ErrReadOnly {
+		t.Fatal("expected read-only error, got", err)
+	}
+
+	// a writer may open the journal while readers have it open
+	j, err = OpenJournal(tf.Name(), &f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	r1.Close()
+	r2.Close()
+}
@@ -0,0 +1,142 @@
+package jj
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// setFormat is the version of the metadata-wrapped update set format. An
+// update set is normally written as a bare JSON array of updates; if it
+// carries metadata, it is instead written as an object of the form
+//
+//	{"fv":1,"ts":<unix nanoseconds>,"tag":"...","tx":"...","ph":"...","u":[...]}
+//
+// where "ts" and "tag" are each omitted if unset, and "tx" and "ph" are
+// present only for sets written by Transact. Bare arrays are always
+// accepted, so Journals written without metadata remain readable. A wrapped
+// set with an unrecognized version is malformed. Note that earlier versions of
+// this package treat every wrapped set as malformed.
+const setFormat = 1
+
+// WithTimestamps causes each update set to be written along with the time at
+// which it was committed. The timestamp is reported in the Time field of the
+// set's SetRecord, e.g. by StreamJournal and Verify. Journals written with
+// timestamps can be opened without this option, and vice versa.
+func WithTimestamps() Option {
+	return func(j *Journal) {
+		j.timestamps = true
+	}
+}
+
+// UpdateTagged is like Update, but records tag alongside the update set, e.g.
+// to identify its author. The tag is reported in the Tag field of the set's
+// SetRecord, e.g. by StreamJournal and Verify. An empty tag is not recorded.
+func (j *Journal) UpdateTagged(tag string, us []Update) error {
+	return j.update(context.Background(), setMeta{tag: tag}, us)
+}
+
+// setMeta is the metadata written with an update set.
+type setMeta struct {
+	tag   string
+	tx    string // transaction ID; see Transact
+	phase string // transaction phase
+}
+
+// hasMeta reports whether an update set with metadata m must be wrapped.
+func (j *Journal) hasMeta(m setMeta) bool {
+	return j.timestamps || m != setMeta{}
+}
+
+// appendSetPrefix appends the opening of an update set with metadata m to
+// buf, i.e. a '[', preceded by the set's metadata, if any. The set must be
+// closed with appendSetSuffix.
+func (j *Journal) appendSetPrefix(buf []byte, m setMeta) []byte {
+	if !j.hasMeta(m) {
+		return append(buf, '[')
+	}
+	buf = append(buf, `{"fv":`...)
+	buf = strconv.AppendInt(buf, setFormat, 10)
+	if j.timestamps {
+		buf = append(buf, `,"ts":`...)
+		buf = strconv.AppendInt(buf, time.Now().UnixNano(), 10)
+	}
+	if m.tag != "" {
+		buf = append(buf, `,"tag":`...)
+		buf = appendString(buf, m.tag)
+	}
+	if m.tx != "" {
+		buf = append(buf, `,"tx":`...)
+		buf = appendString(buf, m.tx)
+		buf = append(buf, `,"ph":`...)
+		buf = appendString(buf, m.phase)
+	}
+	return append(buf, `,"u":[`...)
+}
+
+// appendSetSuffix appends the closing of an update set opened by
+// appendSetPrefix.
+func (j *Journal) appendSetSuffix(buf []byte, m setMeta) []byte {
+	if !j.hasMeta(m) {
+		return append(buf, ']')
+	}
+	return append(buf, "]}"...)
+}
+
+// decodeSet decodes an update set, which may be wrapped with metadata. The
+// set's tag and timestamp are recorded in rec; its transaction ID and phase,
+// if any, are returned.
+func decodeSet(data []byte, rec *SetRecord) (set []Update, m setMeta, err error) {
+	if data = bytes.TrimSpace(data); len(data) == 0 || data[0] != '{' {
+		set, err = decodeUpdates(data)
+		return
+	}
+	var wrapped struct {
+		Version   int             `json:"fv"`
+		Timestamp int64           `json:"ts"`
+		Tag       string          `json:"tag"`
+		Tx        string          `json:"tx"`
+		Phase     string          `json:"ph"`
+		Updates   json.RawMessage `json:"u"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, m, err
+	} else if wrapped.Version != setFormat {
+		return nil, m, fmt.Errorf("unsupported update set format %v", wrapped.Version)
+	} else if set, err = decodeUpdates(wrapped.Updates); err != nil {
+		return nil, m, err
+	} else if set == nil {
+		return nil, m, fmt.Errorf("update set is missing updates")
+	} else if (wrapped.Tx == "") != (wrapped.Phase == "") {
+		return nil, m, fmt.Errorf("update set has incomplete transaction metadata")
+	} else if p := wrapped.Phase; p != "" && p != txPrepare && p != txCommit && p != txAbort {
+		return nil, m, fmt.Errorf("unknown transaction phase %q", p)
+	}
+	if wrapped.Timestamp != 0 {
+		rec.Time = time.Unix(0, wrapped.Timestamp)
+	}
+	rec.Tag = wrapped.Tag
+	return set, setMeta{tag: wrapped.Tag, tx: wrapped.Tx, phase: wrapped.Phase}, nil
+}
+
+// A looseUpdate has the same fields as an Update, but is decoded without the
+// validation performed by Update.UnmarshalJSON, so that a malformed update
+// can be skipped during replay without discarding the rest of its set.
+type looseUpdate Update
+
+// decodeUpdates decodes a JSON array of updates. Unlike decoding into an
+// []Update, individual updates are not validated.
+func decodeUpdates(data []byte) ([]Update, error) {
+	var loose []looseUpdate
+	if err := json.Unmarshal(data, &loose); err != nil || loose == nil {
+		return nil, err
+	}
+	set := make([]Update, len(loose))
+	for i := range loose {
+		set[i] = Update(loose[i])
+	}
+	return set, nil
+}
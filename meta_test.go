@@ -0,0 +1,113 @@
+package jj
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournalMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, map[string]int{"x": 0, "y": 0, "z": 0}, WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := j.Set("x", 1); err != nil {
+		t.Fatal(err)
+	} else if err := j.UpdateTagged(`alice "the admin"`, []Update{NewUpdate("x", 2)}); err != nil {
+		t.Fatal(err)
+	} else if err := j.SetReader("y", strings.NewReader(`3`)); err != nil {
+		t.Fatal(err)
+	}
+	end := time.Now()
+
+	// tags are recorded even without timestamps
+	j2, err := NewJournal(bytes.NewReader(buf.Bytes()), &buf, new(map[string]int))
+	if err != nil {
+		t.Fatal(err)
+	} else if err := j2.UpdateTagged("bob", []Update{NewUpdate("x", 4)}); err != nil {
+		t.Fatal(err)
+	} else if err := j2.Set("z", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	var obj map[string]int
+	var recs []SetRecord
+	err = StreamJournal(bytes.NewReader(buf.Bytes()), &obj, func(set []Update, rec SetRecord) error {
+		if rec.Status != SetApplied || len(set) != 1 {
+			t.Fatalf("wrong set: %v %+v", set, rec)
+		}
+		recs = append(recs, rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(recs) != 5 {
+		t.Fatal("wrong number of sets:", len(recs))
+	}
+	for i, rec := range recs[:3] {
+		if rec.Time.Before(start) || rec.Time.After(end) {
+			t.Errorf("set %v: timestamp %v outside of [%v, %v]", i, rec.Time, start, end)
+		}
+	}
+	if !recs[3].Time.IsZero() || !recs[4].Time.IsZero() {
+		t.Error("sets written without WithTimestamps should not have timestamps")
+	}
+	for i, tag := range []string{"", `alice "the admin"`, "", "bob", ""} {
+		if recs[i].Tag != tag {
+			t.Errorf("set %v: expected tag %q, got %q", i, tag, recs[i].Tag)
+		}
+	}
+
+	// the final set carries no metadata, so it should be a bare array
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if last := lines[len(lines)-1]; last[0] != '[' {
+		t.Errorf("expected bare array, got %s", last)
+	}
+
+	var final map[string]int
+	if _, err := NewJournal(bytes.NewReader(buf.Bytes()), ioutil.Discard, &final); err != nil {
+		t.Fatal(err)
+	} else if final["x"] != 4 || final["y"] != 3 || final["z"] != 5 {
+		t.Fatal("wrong object:", final)
+	}
+}
+
+func TestDecodeSet(t *testing.T) {
+	tests := []struct {
+		data string
+		n    int
+		tag  string
+		ok   bool
+	}{
+		{`[{"p":"x","v":1}]`, 1, "", true},
+		{`  [{"p":"x","v":1}]  `, 1, "", true},
+		{`{"fv":1,"u":[{"p":"x","v":1},{"p":"y","v":2}]}`, 2, "", true},
+		{`{"fv":1,"tag":"foo","u":[]}`, 0, "foo", true},
+		{`{"fv":2,"u":[{"p":"x","v":1}]}`, 0, "", false},
+		{`{"u":[{"p":"x","v":1}]}`, 0, "", false},
+		{`{"fv":1}`, 0, "", false},
+		{`{"fv":1,"u":{}}`, 0, "", false},
+		{`{"fv":1,"u":[]`, 0, "", false},
+	}
+	for _, test := range tests {
+		var rec SetRecord
+		set, _, err := decodeSet([]byte(test.data), &rec)
+		if (err == nil) != test.ok {
+			t.Errorf("decodeSet(%s): unexpected error %v", test.data, err)
+		} else if test.ok && (len(set) != test.n || rec.Tag != test.tag) {
+			t.Errorf("decodeSet(%s): wrong result %v %+v", test.data, set, rec)
+		}
+	}
+
+	// the metadata should be valid JSON
+	j := &Journal{timestamps: true}
+	data := j.appendSetSuffix(j.appendSetPrefix(nil, setMeta{tag: "\n\"\\"}), setMeta{tag: "\n\"\\"})
+	if !json.Valid(data) {
+		t.Fatalf("invalid metadata: %s", data)
+	}
+}
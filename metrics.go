@@ -0,0 +1,44 @@
+package jj
+
+import "time"
+
+// Metrics contains optional callbacks for monitoring a Journal, e.g. by
+// exporting its activity to a metrics library. Each callback is only called if
+// it is non-nil, so unused callbacks have no overhead. Callbacks are called
+// synchronously, and should return quickly.
+type Metrics struct {
+	// Write is called with the number of bytes written to the Journal's file
+	// by each write, including update sets, initial objects, and checkpoints.
+	Write func(n int)
+	// Sync is called with the duration and result of each sync of the
+	// Journal's file after an update set is written. If UpdateContext returns
+	// before the sync completes, Sync is called from another goroutine when
+	// it does.
+	Sync func(d time.Duration, err error)
+	// Commit is called with the number of updates in each committed update
+	// set. Like the function registered by OnCommit, it is not called if
+	// UpdateContext returns before the set is synced.
+	Commit func(updates int)
+	// Replay is called after OpenJournal or NewJournal replays an existing
+	// Journal, with a summary of the replay (including the number of malformed
+	// sets skipped) and its duration.
+	Replay func(s ReplaySummary, d time.Duration)
+	// Checkpoint is called with the duration and result of each Checkpoint,
+	// including those performed by Compact and WithAutoCheckpoint.
+	Checkpoint func(d time.Duration, err error)
+}
+
+// WithMetrics causes the Journal to report its activity to the callbacks in
+// m.
+func WithMetrics(m Metrics) Option {
+	return func(j *Journal) {
+		j.metrics = m
+	}
+}
+
+// recordWrite reports a write of n bytes, if n is positive.
+func (j *Journal) recordWrite(n int) {
+	if j.metrics.Write != nil && n > 0 {
+		j.metrics.Write(n)
+	}
+}
@@ -0,0 +1,81 @@
+package jj
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	f, cleanup := tempFile(t, "TestMetrics")
+	defer cleanup()
+	f.Close()
+
+	var written, syncs, commits, updates, checkpoints, replays int
+	var summary ReplaySummary
+	m := Metrics{
+		Write: func(n int) { written += n },
+		Sync: func(d time.Duration, err error) {
+			if d < 0 || err != nil {
+				t.Error("bad sync:", d, err)
+			}
+			syncs++
+		},
+		Commit: func(n int) { commits++; updates += n },
+		Replay: func(s ReplaySummary, d time.Duration) {
+			summary = s
+			replays++
+		},
+		Checkpoint: func(d time.Duration, err error) {
+			if d < 0 || err != nil {
+				t.Error("bad checkpoint:", d, err)
+			}
+			checkpoints++
+		},
+	}
+	j, err := OpenJournal(f.Name(), map[string]int{"a": 0, "b": 0}, WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// creating the Journal checkpoints the initial object
+	if checkpoints != 1 || replays != 0 || int64(written) != j.Stats().Size {
+		t.Fatal("wrong metrics after creation:", checkpoints, replays, written)
+	}
+	if err := j.Update([]Update{NewUpdate("a", 1), NewUpdate("b", 1)}); err != nil {
+		t.Fatal(err)
+	} else if err := j.Set("a", 2); err != nil {
+		t.Fatal(err)
+	}
+	if commits != 2 || updates != 3 || syncs != 2 || int64(written) != j.Stats().Size {
+		t.Fatal("wrong metrics after updates:", commits, updates, syncs, written)
+	}
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	} else if checkpoints != 2 {
+		t.Fatal("wrong number of checkpoints:", checkpoints)
+	}
+	j.Close()
+
+	// replay reports skipped sets
+	af, err := os.OpenFile(f.Name(), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	af.WriteString("[{\"p\":\"a\",\"v\":3}]\n[\n")
+	af.Close()
+	j, err = OpenJournal(f.Name(), new(map[string]int), WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if replays != 1 || summary.AppliedSets != 1 || summary.SkippedSets != 1 {
+		t.Fatal("wrong replay summary:", replays, summary)
+	}
+
+	// failed checkpoints are reported
+	var cpErr error
+	j.metrics.Checkpoint = func(d time.Duration, err error) { cpErr = err }
+	if err := j.Checkpoint(make(chan int)); err == nil || cpErr != err {
+		t.Fatal("expected checkpoint error to be reported:", err, cpErr)
+	}
+}
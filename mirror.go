@@ -0,0 +1,66 @@
+package jj
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// WithMirror causes every line written to the Journal to also be written to
+// w, e.g. to maintain a hot standby. The mirror forms a standalone journal
+// that can be replayed with the same options as the Journal itself: when the
+// Journal is opened, its current object is written to w as the initial
+// object, followed by each subsequent update set. A Checkpoint that changes
+// the object is mirrored as an update set that replaces the entire object.
+//
+// Each line is written to w only after it has been written to the Journal
+// and synced, so the mirror never contains an update set that the Journal
+// does not (unless UpdateContext is canceled while waiting for the sync).
+// Writes to w are not synced. If a write to w fails, the Update is
+// unaffected; instead, onError (if non-nil) is called with the error, and the
+// next line is preceded by a newline, so that any partially-written line is
+// skipped as malformed during replay. WithMirror has no effect on a read-only
+// Journal.
+func WithMirror(w io.Writer, onError func(error)) Option {
+	return func(j *Journal) {
+		j.mirror = w
+		j.mirrorErr = onError
+	}
+}
+
+// startMirror writes the current object to the mirror as its initial object.
+// Until startMirror is called, nothing is written to the mirror.
+func (j *Journal) startMirror() {
+	if j.mirror == nil || j.readOnly {
+		return
+	}
+	j.mirroring = true
+	line := j.encodeLine(append([]byte(nil), j.obj...))
+	j.writeMirror(append(line, '\n'))
+}
+
+// mirrorCheckpoint writes an update set to the mirror that replaces old with
+// obj, unless they are identical.
+func (j *Journal) mirrorCheckpoint(old, obj []byte) {
+	if !j.mirroring || bytes.Equal(old, obj) {
+		return
+	}
+	set := appendUpdate([]byte{'['}, Update{Path: "", Value: obj})
+	set = append(set, ']')
+	j.writeMirror(append(j.encodeLine(set), '\n'))
+}
+
+// writeMirror writes line to the mirror, if one has been started.
+func (j *Journal) writeMirror(line []byte) {
+	if !j.mirroring {
+		return
+	}
+	if j.mirrorFailed {
+		line = append([]byte{'\n'}, line...)
+	}
+	_, err := writeFull(j.mirror, line)
+	j.mirrorFailed = err != nil
+	if err != nil && j.mirrorErr != nil {
+		j.mirrorErr(fmt.Errorf("jj: could not write to mirror: %w", err))
+	}
+}
@@ -0,0 +1,82 @@
+package jj
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestJournalMirror(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithChecksums(), WithCompression()}} {
+		tf, cleanup := tempFile(t, "TestJournalMirror")
+		tf.Close()
+		var mirror bytes.Buffer
+		j, err := OpenJournal(tf.Name(), map[string]int{"x": 1}, append(opts, WithMirror(&mirror, nil))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Set("x", 2); err != nil {
+			t.Fatal(err)
+		} else if err := j.Checkpoint(map[string]int{"y": 3}); err != nil {
+			t.Fatal(err)
+		} else if err := j.Checkpoint(map[string]int{"y": 3}); err != nil {
+			t.Fatal(err)
+		} else if err := j.Set("y", 4); err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		cleanup()
+
+		// initial object, first Set, first Checkpoint, second Set
+		if n := bytes.Count(mirror.Bytes(), []byte("\n")); n != 4 {
+			t.Fatalf("expected 4 mirrored lines, got %v: %s", n, mirror.Bytes())
+		}
+		var obj map[string]int
+		m, err := NewJournal(bytes.NewReader(mirror.Bytes()), ioutil.Discard, &obj, opts...)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(m.Snapshot()) != string(j.Snapshot()) || m.ReplaySummary().SkippedSets != 0 {
+			t.Fatalf("mirror does not match journal: %s != %s", m.Snapshot(), j.Snapshot())
+		}
+	}
+}
+
+func TestJournalMirrorErrors(t *testing.T) {
+	// when failing, the mirror writes half of each line before returning an
+	// error
+	var mirror bytes.Buffer
+	var failing bool
+	w := writerFunc(func(p []byte) (int, error) {
+		if failing {
+			n, _ := mirror.Write(p[:len(p)/2])
+			return n, errors.New("mirror failed")
+		}
+		return mirror.Write(p)
+	})
+	var errs []error
+	j, err := NewJournal(nil, ioutil.Discard, map[string]int{"x": 1}, WithMirror(w, func(err error) {
+		errs = append(errs, err)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing = true
+	if err := j.Set("x", 2); err != nil {
+		t.Fatal("mirror failure should not affect Update:", err)
+	} else if len(errs) != 1 {
+		t.Fatal("expected mirror error to be reported:", errs)
+	}
+	failing = false
+	if err := j.Set("x", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	var obj map[string]int
+	m, err := NewJournal(bytes.NewReader(mirror.Bytes()), ioutil.Discard, &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 3 || m.ReplaySummary().SkippedSets != 1 {
+		t.Fatal("mirror was not replayed correctly:", obj, m.ReplaySummary())
+	}
+}
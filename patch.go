@@ -0,0 +1,204 @@
+package jj
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// A patchOp is a single RFC 6902 JSON Patch operation.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// FromJSONPatch converts an RFC 6902 JSON Patch document into the equivalent
+// set of Updates. The "replace", "add", and "remove" operations are
+// supported; they are converted to OpReplace, OpInsert, and OpDelete Updates,
+// respectively. As specified by RFC 6902, an "add" operation whose path is ""
+// replaces the whole document, so it is converted to an OpReplace Update.
+func FromJSONPatch(patch []byte) ([]Update, error) {
+	var ops []patchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, err
+	}
+	us := make([]Update, len(ops))
+	for i, op := range ops {
+		path, err := PointerToPath(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		u := Update{Path: path, Value: op.Value}
+		switch op.Op {
+		case "replace":
+			u.Op = OpReplace
+		case "add":
+			u.Op = OpInsert
+			if path == "" {
+				u.Op = OpReplace
+			}
+		case "remove":
+			u.Op = OpDelete
+			u.Value = nil
+		default:
+			return nil, fmt.Errorf("jj: unsupported JSON Patch operation %q", op.Op)
+		}
+		if u.Op != OpDelete && len(u.Value) == 0 {
+			return nil, fmt.Errorf("jj: JSON Patch %q operation is missing a value", op.Op)
+		}
+		us[i] = u
+	}
+	return us, nil
+}
+
+// ToJSONPatch converts a set of Updates into the equivalent RFC 6902 JSON
+// Patch document. Updates with unrecognized Ops are omitted. Like
+// Journal.Update, ToJSONPatch does not validate the Value of each Update.
+func ToJSONPatch(us []Update) []byte {
+	buf := append([]byte(nil), '[')
+	for _, u := range us {
+		var op string
+		switch u.Op {
+		case OpReplace:
+			op = "replace"
+		case OpInsert:
+			op = "add"
+		case OpDelete:
+			op = "remove"
+		default:
+			continue
+		}
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, `{"op":"`...)
+		buf = append(buf, op...)
+		buf = append(buf, `","path":`...)
+		buf = appendString(buf, PathToPointer(u.Path))
+		if u.Op != OpDelete {
+			buf = append(buf, `,"value":`...)
+			buf = append(buf, u.Value...)
+		}
+		buf = append(buf, '}')
+	}
+	return append(buf, ']')
+}
+
+// MergePatch applies an RFC 7386 JSON Merge Patch to the current object as a
+// single atomic update set. Each member of the patch whose value is null
+// deletes the corresponding key; each member whose value is an object is
+// merged recursively; and any other value replaces the corresponding element
+// wholesale. A patch that is not an object replaces the entire object.
+func (j *Journal) MergePatch(patch json.RawMessage) error {
+	us, err := MergePatchUpdates(j.obj, patch)
+	if err != nil {
+		return err
+	} else if len(us) == 0 {
+		return nil
+	}
+	return j.Update(us)
+}
+
+// MergePatchUpdates returns the Updates that apply an RFC 7386 JSON Merge
+// Patch to obj. Since the top-level empty key cannot be expressed as a path,
+// patches that modify it are rejected.
+func MergePatchUpdates(obj, patch json.RawMessage) ([]Update, error) {
+	// compact the patch, so that values can be embedded in update sets
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, patch); err != nil {
+		return nil, fmt.Errorf("jj: invalid merge patch: %w", err)
+	}
+	return mergePatch(nil, obj, "", buf.Bytes())
+}
+
+// mergePatch appends to us the Updates that apply patch, which must be
+// compact, to the element at path within obj.
+func mergePatch(us []Update, obj json.RawMessage, path string, patch []byte) ([]Update, error) {
+	if patch[0] != '{' {
+		return append(us, Update{Path: path, Value: patch, Op: OpUpsert}), nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return nil, fmt.Errorf("jj: invalid merge patch: %w", err)
+	} else if _, ok := fields[""]; ok && path == "" {
+		return nil, errors.New("jj: merge patch modifies the top-level empty key")
+	}
+	if target, ok := extractPath(obj, path); !ok || target[0] != '{' {
+		// merging into a non-object is equivalent to merging into {}
+		return append(us, Update{Path: path, Value: stripNulls(fields), Op: OpUpsert}), nil
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := joinPath(path, EscapeKey(k))
+		if string(fields[k]) == "null" {
+			if _, ok := extractPath(obj, p); ok {
+				us = append(us, Update{Path: p, Op: OpDelete})
+			}
+			continue
+		}
+		var err error
+		if us, err = mergePatch(us, obj, p, fields[k]); err != nil {
+			return nil, err
+		}
+	}
+	return us, nil
+}
+
+// stripNulls returns the JSON encoding of fields with null members removed,
+// recursively.
+func stripNulls(fields map[string]json.RawMessage) json.RawMessage {
+	for k, v := range fields {
+		if string(v) == "null" {
+			delete(fields, k)
+		} else if v[0] == '{' {
+			var sub map[string]json.RawMessage
+			json.Unmarshal(v, &sub) // v is valid, since it came from a valid patch
+			fields[k] = stripNulls(sub)
+		}
+	}
+	data, _ := json.Marshal(fields)
+	return data
+}
+
+// WithDefaults causes OpenJournal and NewJournal to merge the Journal's
+// initial object onto base before applying any update sets. The initial
+// object is treated as an RFC 7386 JSON Merge Patch (see MergePatch), so keys
+// that are present in base but absent from the initial object take their
+// values from base; this allows fields added by a newer version of a program
+// to receive defaults when an older Journal is opened. The resulting order is
+// base, then the initial object, then the update sets.
+//
+// As with any merge patch, a null member of the initial object deletes the
+// corresponding key of base, arrays are replaced wholesale, and an initial
+// object that is not a JSON object replaces base entirely. The Journal's file
+// is not modified; the merged object is only written when the Journal is
+// checkpointed. base is not used when the Journal is newly created, since obj
+// is used as the initial object. base must be encodable by encoding/json.
+func WithDefaults(base interface{}) Option {
+	return func(j *Journal) {
+		j.defaults = base
+	}
+}
+
+// applyDefaults merges init onto the object supplied to WithDefaults.
+func (j *Journal) applyDefaults(init json.RawMessage) (json.RawMessage, error) {
+	base, err := json.Marshal(j.defaults)
+	if err != nil {
+		return nil, fmt.Errorf("jj: could not encode defaults: %w", err)
+	}
+	us, err := MergePatchUpdates(base, init)
+	if err != nil {
+		return nil, fmt.Errorf("jj: could not apply defaults: %w", err)
+	}
+	for _, u := range us {
+		base, _ = u.apply(base)
+	}
+	return base, nil
+}
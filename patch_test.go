@@ -0,0 +1,180 @@
+package jj
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONPatch(t *testing.T) {
+	patch := `[
+		{"op": "replace", "path": "/a", "value": {"b": 1}},
+		{"op": "add", "path": "/c/1", "value": 2},
+		{"op": "add", "path": "/c/-", "value": 4},
+		{"op": "add", "path": "/f", "value": 5},
+		{"op": "remove", "path": "/d~1e"}
+	]`
+	us, err := FromJSONPatch([]byte(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := []byte(`{"a": null, "c": [1, 3], "d/e": true}`)
+	for _, u := range us {
+		var ok bool
+		if obj, ok = u.apply(obj); !ok {
+			t.Fatal("update was not applied:", u)
+		}
+	}
+	if exp := `{"a": {"b": 1}, "c": [1, 2,3,4],"f":5}`; string(obj) != exp {
+		t.Fatalf("expected %s, got %s", exp, obj)
+	}
+
+	// round-trip
+	exp := `[{"op":"replace","path":"/a","value":{"b": 1}},{"op":"add","path":"/c/1","value":2},{"op":"add","path":"/c/-","value":4},{"op":"add","path":"/f","value":5},{"op":"remove","path":"/d~1e"}]`
+	if p := string(ToJSONPatch(us)); p != exp {
+		t.Fatalf("expected %s, got %s", exp, p)
+	}
+
+	// adding at the root replaces the whole document
+	us, err = FromJSONPatch([]byte(`[{"op": "add", "path": "", "value": {"x": 1}}]`))
+	if err != nil {
+		t.Fatal(err)
+	} else if res, n := Apply(obj, us); n != 1 || string(res) != `{"x": 1}` {
+		t.Fatalf("expected root add to replace the document, got %s", res)
+	}
+
+	// invalid patches
+	for _, patch := range []string{
+		`{}`,
+		`[{"op": "test", "path": "/a", "value": 1}]`,
+		`[{"op": "replace", "path": "/a"}]`,
+		`[{"op": "remove", "path": "a"}]`,
+	} {
+		if _, err := FromJSONPatch([]byte(patch)); err == nil {
+			t.Errorf("expected error for %s", patch)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// test cases from RFC 7386, Appendix A
+	tests := []struct {
+		obj, patch, exp string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		// additional cases
+		{`{"a.b":{"c":1}}`, "{\n  \"a.b\": {\"c\": 2, \"d\": [1,\n 2]}\n}", `{"a.b":{"c":2,"d":[1,2]}}`},
+		{`{"a":1}`, `{"b":null}`, `{"a":1}`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		j, err := NewJournal(nil, &buf, json.RawMessage(test.obj))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := j.MergePatch(json.RawMessage(test.patch)); err != nil {
+			t.Errorf("MergePatch(%s, %s): %v", test.obj, test.patch, err)
+			continue
+		}
+		var got, exp interface{}
+		json.Unmarshal(j.Snapshot(), &got)
+		json.Unmarshal([]byte(test.exp), &exp)
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("MergePatch(%s, %s): expected %s, got %s", test.obj, test.patch, test.exp, j.Snapshot())
+		}
+		// the patch should be written as a single set
+		if n := bytes.Count(buf.Bytes(), []byte("\n")); n > 2 {
+			t.Errorf("MergePatch(%s, %s): wrote %v lines", test.obj, test.patch, n)
+		}
+	}
+
+	for _, patch := range []string{``, `{`, `{"":1}`} {
+		if _, err := MergePatchUpdates(json.RawMessage(`{}`), json.RawMessage(patch)); err == nil {
+			t.Errorf("MergePatchUpdates(%s): expected error", patch)
+		}
+	}
+}
+
+func TestJournalDefaults(t *testing.T) {
+	type config struct {
+		Name    string `json:"name"`
+		Retries int    `json:"retries"`
+		Limits  struct {
+			Max int `json:"max"`
+			Min int `json:"min"`
+		} `json:"limits"`
+	}
+	var defaults config
+	defaults.Retries = 3
+	defaults.Limits.Max = 10
+	defaults.Limits.Min = 1
+
+	// the on-disk object predates the retries and limits.min fields
+	f, cleanup := tempFile(t, "TestJournalDefaults")
+	defer cleanup()
+	f.WriteString(`{"name": "old", "limits": {"max": 5}}` + "\n" + `[{"p":"limits.max","v":6}]` + "\n")
+	f.Close()
+	var c config
+	j, err := OpenJournal(f.Name(), &c, WithDefaults(defaults))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "old" || c.Retries != 3 || c.Limits.Max != 6 || c.Limits.Min != 1 {
+		t.Fatalf("wrong object: %+v", c)
+	}
+	// defaults are not written until the Journal is checkpointed
+	if data, _ := ioutil.ReadFile(f.Name()); bytes.Contains(data, []byte("retries")) {
+		t.Fatal("defaults were written to the Journal")
+	} else if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	var c2 config
+	if j, err = OpenJournal(f.Name(), &c2); err != nil {
+		t.Fatal(err)
+	} else if c2 != c {
+		t.Fatalf("wrong object after compaction: %+v", c2)
+	}
+	j.Close()
+
+	// updates are applied after the defaults, so they may refer to fields
+	// that exist only in the defaults
+	var obj map[string]interface{}
+	r := strings.NewReader(`{"a":null,"b":[1]}` + "\n" + `[{"p":"c.0","v":2}]` + "\n")
+	base := map[string]interface{}{"a": 1, "b": []int{2, 3}, "c": []int{}}
+	if _, err := NewJournal(r, ioutil.Discard, &obj, WithDefaults(base)); err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]interface{}{"b": []interface{}{1.0}, "c": []interface{}{2.0}}; !reflect.DeepEqual(obj, exp) {
+		t.Fatal("wrong object:", obj)
+	}
+
+	// a new Journal uses obj, not the defaults
+	if j, err := NewJournal(nil, ioutil.Discard, map[string]int{"x": 1}, WithDefaults(base)); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"x":1}` {
+		t.Fatal("wrong object:", string(j.Snapshot()))
+	}
+
+	// unencodable defaults are an error
+	r = strings.NewReader(`{}`)
+	if _, err := NewJournal(r, ioutil.Discard, &obj, WithDefaults(make(chan int))); err == nil {
+		t.Fatal("expected error for unencodable defaults")
+	}
+}
@@ -0,0 +1,156 @@
+package jj
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Path is a sequence of unescaped accessors, which can be converted into an
+// Update path via its String method. It allows paths to be constructed
+// without manually escaping keys:
+//
+//	Path{}.Key("foo").Index(3).Key("a.b").String() // "foo.3.a\.b"
+//
+// Updates can also be constructed from a Path directly, e.g.
+//
+//	Path{}.Key("foo").Index(3).Update(7) // NewUpdate("foo.3", 7)
+//
+// The empty Path refers to the entire object.
+type Path []string
+
+// Key returns a copy of p with the object key appended.
+func (p Path) Key(key string) Path {
+	return append(p[:len(p):len(p)], key)
+}
+
+// Index returns a copy of p with the array index appended. As with any array
+// index, negative values count backwards from the end of the array. Note that
+// p.Index(0) and p.Key("0") are equivalent: an accessor's meaning is
+// determined by the element it is applied to.
+func (p Path) Index(i int) Path {
+	return append(p[:len(p):len(p)], strconv.Itoa(i))
+}
+
+// Match returns a copy of p with a match accessor appended, which identifies
+// the first element of an array that is an object whose field key has the
+// value val. field may not contain '='. See Update for details.
+func (p Path) Match(field, val string) Path {
+	return append(p[:len(p):len(p)], "["+field+"="+val+"]")
+}
+
+// String implements fmt.Stringer. It escapes and joins the accessors of p.
+func (p Path) String() string {
+	accs := make([]string, len(p))
+	for i, acc := range p {
+		accs[i] = EscapeKey(acc)
+	}
+	return strings.Join(accs, ".")
+}
+
+// Update is like NewUpdate(p.String(), val).
+func (p Path) Update(val interface{}) Update {
+	return p.with(NewUpdate("", val))
+}
+
+// Delete is like NewDeleteUpdate(p.String()).
+func (p Path) Delete() Update {
+	return p.with(NewDeleteUpdate(""))
+}
+
+// Insert is like NewInsertUpdate(p.String(), val).
+func (p Path) Insert(val interface{}) Update {
+	return p.with(NewInsertUpdate("", val))
+}
+
+// Upsert is like NewUpsertUpdate(p.String(), val).
+func (p Path) Upsert(val interface{}) Update {
+	return p.with(NewUpsertUpdate("", val))
+}
+
+// Increment is like NewIncrementUpdate(p.String(), delta).
+func (p Path) Increment(delta float64) Update {
+	return p.with(NewIncrementUpdate("", delta))
+}
+
+// Append is like NewAppendUpdates(p.String(), vals...).
+func (p Path) Append(vals ...interface{}) []Update {
+	us := NewAppendUpdates("", vals...)
+	for i := range us {
+		us[i] = p.Key("-").with(us[i])
+	}
+	return us
+}
+
+// MoveTo is like NewMoveUpdate(p.String(), to.String()).
+func (p Path) MoveTo(to Path) Update {
+	u := to.with(NewMoveUpdate("", ""))
+	u.From = p.String()
+	return u
+}
+
+// CopyTo is like NewCopyUpdate(p.String(), to.String()).
+func (p Path) CopyTo(to Path) Update {
+	u := to.with(NewCopyUpdate("", ""))
+	u.From = p.String()
+	return u
+}
+
+// with returns u with its Path set to p. Unlike the New*Update constructors,
+// the Path methods accept empty accessors, since a Path's accessors are
+// explicit (e.g. Key("") deliberately accesses the empty key); so they
+// construct their Updates with the path "", and then set the Path.
+func (p Path) with(u Update) Update {
+	u.Path = p.String()
+	return u
+}
+
+// ParsePath splits an Update path into its unescaped accessors. It is the
+// inverse of Path.String. The path "" is parsed as the empty Path.
+func ParsePath(path string) Path {
+	if path == "" {
+		return nil
+	}
+	return Path(splitPath(path))
+}
+
+// ValidatePath checks path for mistakes that are common when paths are built
+// programmatically, returning an error wrapping ErrInvalidPath if it contains:
+//
+//   - an empty accessor, e.g. a..b, .a, or a. (the path "" is valid, and
+//     refers to the entire object)
+//   - an escape of a character other than '.', '\', or '*', or a trailing '\'
+//   - an accessor beginning with '[' that is not a well-formed match
+//     accessor, i.e. [field=val] with a non-empty field
+//
+// The New*Update constructors, UpdateChecked, and the Journal's Set, Delete,
+// and Append methods reject invalid paths. Update itself (and thus replay) is
+// more lenient, for compatibility: it treats an empty accessor as the empty
+// key, and other escaped characters literally.
+func ValidatePath(path string) error {
+	if path == "" {
+		return nil
+	}
+	start, k := 0, 0
+	for i := 0; i <= len(path); i++ {
+		if i < len(path) && path[i] == '\\' {
+			if i+1 == len(path) {
+				return fmt.Errorf("%w %q: trailing escape", ErrInvalidPath, path)
+			} else if c := path[i+1]; c != '.' && c != '\\' && c != '*' {
+				return fmt.Errorf("%w %q: invalid escape %q", ErrInvalidPath, path, path[i:i+2])
+			}
+			i++
+		} else if i == len(path) || path[i] == '.' {
+			acc := path[start:i]
+			if acc == "" {
+				return fmt.Errorf("%w %q: accessor %v is empty", ErrInvalidPath, path, k)
+			} else if acc[0] == '[' {
+				if field, _, ok := parseMatch(acc); !ok || field == "" {
+					return fmt.Errorf("%w %q: malformed match accessor %q", ErrInvalidPath, path, acc)
+				}
+			}
+			start, k = i+1, k+1
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package jj
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	tests := []struct {
+		p    Path
+		path string
+	}{
+		{nil, ``},
+		{Path{}.Key("foo"), `foo`},
+		{Path{}.Key("foo").Index(3).Key("baz"), `foo.3.baz`},
+		{Path{}.Key("a.b").Key(`c\d`).Index(-1), `a\.b.c\\d.-1`},
+		{Path{}.Key("a").Key(""), `a.`},
+		{Path{}.Key("items").Match("id", "1.5").Key("name"), `items.[id=1\.5].name`},
+		{Path{}.Key("*").Key("a*b"), `\*.a\*b`},
+	}
+	for _, test := range tests {
+		if s := test.p.String(); s != test.path {
+			t.Errorf("%q.String(): expected %q, got %q", []string(test.p), test.path, s)
+		} else if p := ParsePath(s); !reflect.DeepEqual(p, test.p) && len(p)+len(test.p) > 0 {
+			t.Errorf("ParsePath(%q): expected %q, got %q", s, []string(test.p), []string(p))
+		}
+	}
+
+	// appending to a shared prefix must not clobber other Paths
+	base := make(Path, 1, 4)
+	base[0] = "a"
+	b, c := base.Key("b"), base.Key("c")
+	if b.String() != "a.b" || c.String() != "a.c" {
+		t.Fatal("Paths share memory:", b, c)
+	}
+
+	// a "*" key must not be treated as a wildcard
+	u := NewReplaceAllUpdate(Path{}.Key("*").Key("x").String(), 9)
+	if res, ok := u.apply([]byte(`{"*":{"x":1},"y":{"x":2}}`)); !ok || string(res) != `{"*":{"x":9},"y":{"x":2}}` {
+		t.Fatal("wrong result:", string(res))
+	}
+
+	obj := []byte(`{"a.b":{"c":[1,2]}}`)
+	u = NewUpdate(Path{}.Key("a.b").Key("c").Index(1).String(), 3)
+	if res, ok := u.apply(obj); !ok || string(res) != `{"a.b":{"c":[1,3]}}` {
+		t.Fatal("wrong result:", string(res))
+	}
+}
+
+func TestValidatePath(t *testing.T) {
+	for _, path := range []string{
+		``,
+		`a`,
+		`a.0.-1.-`,
+		`a\.b.c\\d.\*`,
+		`items.[id=42].name`,
+		`items.[id=1\.5]`,
+	} {
+		if err := ValidatePath(path); err != nil {
+			t.Errorf("ValidatePath(%q): unexpected error: %v", path, err)
+		}
+	}
+	for _, path := range []string{
+		`.a`,
+		`a.`,
+		`a..b`,
+		`.`,
+		`a\`,
+		`a\b`,
+		`items.[id]`,
+		`items.[=1]`,
+		`items.[id=1`,
+		`[x`,
+	} {
+		if err := ValidatePath(path); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("ValidatePath(%q): expected ErrInvalidPath, got %v", path, err)
+		}
+	}
+	// Paths built from non-empty keys are always valid
+	p := Path{}.Key("a.b").Key(`c\d`).Key("*").Index(-1).Match("id", "x.y")
+	if err := ValidatePath(p.String()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInvalidPathRejected(t *testing.T) {
+	// the constructors panic
+	for _, fn := range []func(){
+		func() { NewUpdate("a..b", 1) },
+		func() { NewRawUpdate("a.", json.RawMessage(`1`)) },
+		func() { NewDeleteUpdate(".a") },
+		func() { NewInsertUpdate(`a\b`, 1) },
+		func() { NewMoveUpdate("a", "b..c") },
+		func() { NewCopyUpdate("a..b", "c") },
+		func() { NewIncrementUpdate("a.[x]", 1) },
+		func() { NewAppendUpdates("a..b", 1) },
+	} {
+		func() {
+			defer func() {
+				if err, _ := recover().(error); !errors.Is(err, ErrInvalidPath) {
+					t.Error("expected panic with ErrInvalidPath, got", err)
+				}
+			}()
+			fn()
+		}()
+	}
+
+	// the Journal methods return an error, and write nothing
+	var buf bytes.Buffer
+	j, err := NewJournal(nil, &buf, json.RawMessage(`{"a":{"":[1]},"b":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := buf.Len()
+	for _, err := range []error{
+		j.Set("a..b", 1),
+		j.Delete("b."),
+		j.Append("a..", 2),
+		j.Begin().Set("b", 3).Delete("a..b").Commit(),
+	} {
+		if !errors.Is(err, ErrInvalidPath) {
+			t.Error("expected ErrInvalidPath, got", err)
+		}
+	}
+	if _, err := j.UpdateChecked([]Update{{Path: "b", Value: json.RawMessage(`3`)}, {Path: "a..b", Op: OpDelete}}); !errors.Is(err, ErrInvalidPath) {
+		t.Error("expected ErrInvalidPath, got", err)
+	} else if buf.Len() != size || string(j.Snapshot()) != `{"a":{"":[1]},"b":2}` {
+		t.Fatal("invalid updates should not be written:", buf.String())
+	}
+
+	// the empty key can still be accessed via a Path, a pointer, or Update
+	if err := j.Update(Path{}.Key("a").Key("").Append(2)); err != nil {
+		t.Fatal(err)
+	} else if err := j.Update([]Update{NewUpdatePointer("/a//0", 0)}); err != nil {
+		t.Fatal(err)
+	} else if err := j.Update([]Update{{Path: "a..1", Value: json.RawMessage(`3`)}}); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"a":{"":[0,3]},"b":2}` {
+		t.Fatal("wrong object:", string(j.Snapshot()))
+	}
+}
+
+func TestPathUpdates(t *testing.T) {
+	p := Path{}.Key("a.b").Index(1)
+	tests := []struct {
+		got, exp Update
+	}{
+		{p.Update(1), NewUpdate(`a\.b.1`, 1)},
+		{p.Delete(), NewDeleteUpdate(`a\.b.1`)},
+		{p.Insert(1), NewInsertUpdate(`a\.b.1`, 1)},
+		{p.Upsert(1), NewUpsertUpdate(`a\.b.1`, 1)},
+		{p.Increment(1), NewIncrementUpdate(`a\.b.1`, 1)},
+		{p.MoveTo(Path{}.Key("*")), NewMoveUpdate(`a\.b.1`, `\*`)},
+		{p.CopyTo(nil), NewCopyUpdate(`a\.b.1`, ``)},
+	}
+	for _, test := range tests {
+		if !test.got.Identical(test.exp) {
+			t.Errorf("expected %v, got %v", test.exp, test.got)
+		}
+	}
+	if us := p.Append(1, 2); !reflect.DeepEqual(us, NewAppendUpdates(`a\.b.1`, 1, 2)) {
+		t.Error("wrong append updates:", us)
+	}
+}
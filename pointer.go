@@ -0,0 +1,67 @@
+package jj
+
+import (
+	"errors"
+	"strings"
+)
+
+// PointerToPath converts an RFC 6901 JSON Pointer, such as /foo/bars/0/baz,
+// into the equivalent Update path. The empty pointer, which references the
+// whole object, is converted to the path "".
+func PointerToPath(ptr string) (string, error) {
+	if ptr == "" {
+		return "", nil
+	} else if ptr[0] != '/' {
+		return "", errors.New("jj: JSON pointer must begin with '/'")
+	} else if ptr == "/" {
+		// the path "" references the whole object, not the empty key
+		return "", errors.New("jj: JSON pointer to top-level empty key cannot be expressed as a path")
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, tok := range tokens {
+		if strings.IndexByte(tok, '~') >= 0 {
+			// validate escapes: '~' must be followed by '0' or '1'
+			for j := 0; j < len(tok); j++ {
+				if tok[j] == '~' && (j+1 == len(tok) || (tok[j+1] != '0' && tok[j+1] != '1')) {
+					return "", errors.New("jj: invalid escape in JSON pointer")
+				}
+			}
+			tok = strings.ReplaceAll(tok, "~1", "/")
+			tok = strings.ReplaceAll(tok, "~0", "~")
+		}
+		tokens[i] = EscapeKey(tok)
+	}
+	return strings.Join(tokens, "."), nil
+}
+
+// PathToPointer converts an Update path into the equivalent RFC 6901 JSON
+// Pointer. It is the inverse of PointerToPath.
+func PathToPointer(path string) string {
+	if path == "" {
+		return ""
+	}
+	var sb strings.Builder
+	for _, acc := range splitPath(path) {
+		sb.WriteByte('/')
+		acc = strings.ReplaceAll(acc, "~", "~0")
+		acc = strings.ReplaceAll(acc, "/", "~1")
+		sb.WriteString(acc)
+	}
+	return sb.String()
+}
+
+// NewUpdatePointer is like NewUpdate, but accepts an RFC 6901 JSON Pointer
+// instead of a path. If ptr is not a valid JSON Pointer, NewUpdatePointer
+// panics. Since a pointer is translated into a path, the resulting Update is
+// subject to the usual rules regarding malformed Updates; in particular,
+// pointers referencing nonexistent elements are ignored.
+func NewUpdatePointer(ptr string, val interface{}) Update {
+	path, err := PointerToPath(ptr)
+	if err != nil {
+		panic(err)
+	}
+	// unlike a path, a pointer may legitimately reference the empty key
+	u := NewUpdate("", val)
+	u.Path = path
+	return u
+}
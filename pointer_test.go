@@ -0,0 +1,52 @@
+package jj
+
+import "testing"
+
+func TestPointerToPath(t *testing.T) {
+	tests := []struct {
+		ptr  string
+		path string
+	}{
+		{``, ``},
+		{`/foo`, `foo`},
+		{`/foo/bars/0/baz`, `foo.bars.0.baz`},
+		{`/a~1b/c~0d`, `a/b.c~d`},
+		{`/a.b/c\d`, `a\.b.c\\d`},
+		{`/~01`, `~1`},
+	}
+	for _, test := range tests {
+		path, err := PointerToPath(test.ptr)
+		if err != nil {
+			t.Errorf("PointerToPath(%q): unexpected error: %v", test.ptr, err)
+		} else if path != test.path {
+			t.Errorf("PointerToPath(%q): expected %q, got %q", test.ptr, test.path, path)
+		} else if PathToPointer(path) != test.ptr {
+			t.Errorf("PathToPointer(%q): expected %q, got %q", path, test.ptr, PathToPointer(path))
+		}
+	}
+
+	for _, ptr := range []string{`foo`, `/`, `/a~`, `/a~2`} {
+		if _, err := PointerToPath(ptr); err == nil {
+			t.Errorf("PointerToPath(%q): expected error", ptr)
+		}
+	}
+}
+
+func TestNewUpdatePointer(t *testing.T) {
+	obj := []byte(`{"foo":{"bars":[{"baz":3}]},"a/b":{"c.d":1}}`)
+	tests := []struct {
+		ptr string
+		exp string
+	}{
+		{`/foo/bars/0/baz`, `{"foo":{"bars":[{"baz":4}]},"a/b":{"c.d":1}}`},
+		{`/a~1b/c.d`, `{"foo":{"bars":[{"baz":3}]},"a/b":{"c.d":4}}`},
+		{`/foo/quux/0`, string(obj)},
+		{`/foo/bars/2`, string(obj)},
+	}
+	for _, test := range tests {
+		res, _ := NewUpdatePointer(test.ptr, 4).apply(obj)
+		if string(res) != test.exp {
+			t.Errorf("NewUpdatePointer(%q): expected %s, got %s", test.ptr, test.exp, res)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package jj
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, which causes fallocate to allocate
+// blocks without changing the size of the file.
+const fallocKeepSize = 0x1
+
+// preallocate allocates n bytes of disk space for f, starting at off, without
+// changing its size.
+func preallocate(f *os.File, off, n int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, off, n)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package jj
+
+import "os"
+
+// Preallocation is only supported on Linux.
+func preallocate(f *os.File, off, n int64) error { return nil }
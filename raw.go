@@ -0,0 +1,43 @@
+package jj
+
+import "encoding/json"
+
+// Get returns the element at path within obj, which need not belong to a
+// Journal. The returned slice aliases obj. If path does not identify an
+// element of obj, Get returns false.
+func Get(obj json.RawMessage, path string) (json.RawMessage, bool) {
+	return extractPath(obj, path)
+}
+
+// Set returns a copy of obj with the element at path replaced by val, as by
+// an OpReplace Update. Neither obj nor val is modified. If the Update would be
+// malformed, or obj is not valid JSON (and path is not ""), Set returns obj
+// itself (not a copy) and false.
+func Set(obj json.RawMessage, path string, val json.RawMessage) (json.RawMessage, bool) {
+	if path != "" && !isValue(obj) {
+		return obj, false
+	}
+	return Update{Path: path, Value: val}.apply(obj)
+}
+
+// Apply applies the updates to obj in order, exactly as Journal.Update would,
+// and returns the result. Malformed updates are skipped; Apply returns the
+// number of updates that were applied. obj is not modified, but the result
+// may alias it if no updates were applied. If obj is not valid JSON, updates
+// are skipped until one replaces the whole object.
+func Apply(obj json.RawMessage, us []Update) (json.RawMessage, int) {
+	// obj is validated once, rather than by each update
+	valid := isValue(obj)
+	var n int
+	for _, u := range us {
+		if !valid && !(u.Op == OpReplace && u.Path == "") {
+			continue
+		}
+		var ok bool
+		if obj, ok = u.apply(obj); ok {
+			n++
+			valid = true
+		}
+	}
+	return obj, n
+}
@@ -0,0 +1,36 @@
+package jj
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRawFunctions(t *testing.T) {
+	obj := json.RawMessage(`{"a":{"b":[1,2]}}`)
+	if v, ok := Get(obj, "a.b.1"); !ok || string(v) != "2" {
+		t.Fatal("wrong value:", string(v), ok)
+	} else if _, ok := Get(obj, "a.c"); ok {
+		t.Fatal("expected missing path")
+	}
+
+	res, ok := Set(obj, "a.b.2", json.RawMessage(`3`))
+	if !ok || string(res) != `{"a":{"b":[1,2,3]}}` {
+		t.Fatal("wrong result:", string(res), ok)
+	} else if string(obj) != `{"a":{"b":[1,2]}}` {
+		t.Fatal("Set modified its input")
+	}
+	if res, ok := Set(obj, "a.c", json.RawMessage(`3`)); ok || &res[0] != &obj[0] {
+		t.Fatal("expected Set to fail and return obj:", string(res))
+	} else if _, ok := Set(json.RawMessage(`{"a":`), "a", json.RawMessage(`1`)); ok {
+		t.Fatal("expected Set to reject invalid JSON")
+	}
+
+	res, n := Apply(obj, []Update{
+		NewUpdate("a.b.0", 0),
+		NewDeleteUpdate("a.c"),
+		NewUpsertUpdate("a.c", true),
+	})
+	if n != 2 || string(res) != `{"a":{"b":[0,2],"c":true}}` {
+		t.Fatal("wrong result:", string(res), n)
+	}
+}
@@ -0,0 +1,1012 @@
+package jj
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// This file contains a minimal JSON scanner, sufficient for locating and
+// rewriting the elements referenced by an Update's Path. The scanner never
+// decodes values; it only determines their extent. All functions are
+// defensive against truncated or malformed input: rather than panicking, they
+// report failure, which causes the corresponding Update to be treated as
+// malformed.
+
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// consumeWhitespace returns the number of leading whitespace bytes in json.
+func consumeWhitespace(json []byte) int {
+	i := 0
+	for i < len(json) && isWhitespace(json[i]) {
+		i++
+	}
+	return i
+}
+
+// consumeValue returns the length of the JSON value at the beginning of json,
+// or -1 if json does not begin with a valid value.
+func consumeValue(json []byte) int {
+	if len(json) == 0 {
+		return -1
+	}
+	switch json[0] {
+	case '{', '[':
+		return consumeContainer(json)
+	case '"':
+		return consumeString(json)
+	case 't':
+		return consumeLiteral(json, "true")
+	case 'f':
+		return consumeLiteral(json, "false")
+	case 'n':
+		return consumeLiteral(json, "null")
+	default:
+		return consumeNumber(json)
+	}
+}
+
+// consumeLiteral returns len(lit) if json begins with lit, and -1 otherwise.
+func consumeLiteral(json []byte, lit string) int {
+	if len(json) < len(lit) || string(json[:len(lit)]) != lit {
+		return -1
+	}
+	return len(lit)
+}
+
+// consumeString returns the length of the JSON string (including quotes) at
+// the beginning of json, or -1 if json does not begin with a valid string.
+func consumeString(json []byte) int {
+	if len(json) == 0 || json[0] != '"' {
+		return -1
+	}
+	for i := 1; i < len(json); i++ {
+		switch c := json[i]; {
+		case c == '"':
+			return i + 1
+		case c == '\\':
+			i++
+			if i >= len(json) {
+				return -1
+			}
+			switch json[i] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			case 'u':
+				if len(json) < i+5 {
+					return -1
+				}
+				for _, h := range json[i+1 : i+5] {
+					if !isHex(h) {
+						return -1
+					}
+				}
+				i += 4
+			default:
+				return -1
+			}
+		case c < 0x20:
+			// control characters must be escaped
+			return -1
+		}
+	}
+	return -1
+}
+
+// consumeNumber returns the length of the JSON number at the beginning of
+// json, or -1 if json does not begin with a valid number.
+func consumeNumber(json []byte) int {
+	i := 0
+	if i < len(json) && json[i] == '-' {
+		i++
+	}
+	// integer part
+	if i >= len(json) {
+		return -1
+	} else if json[i] == '0' {
+		i++
+	} else if isDigit(json[i]) {
+		for i < len(json) && isDigit(json[i]) {
+			i++
+		}
+	} else {
+		return -1
+	}
+	// fractional part
+	if i < len(json) && json[i] == '.' {
+		i++
+		start := i
+		for i < len(json) && isDigit(json[i]) {
+			i++
+		}
+		if i == start {
+			return -1
+		}
+	}
+	// exponent
+	if i < len(json) && (json[i] == 'e' || json[i] == 'E') {
+		i++
+		if i < len(json) && (json[i] == '+' || json[i] == '-') {
+			i++
+		}
+		start := i
+		for i < len(json) && isDigit(json[i]) {
+			i++
+		}
+		if i == start {
+			return -1
+		}
+	}
+	return i
+}
+
+// consumeContainer returns the length of the JSON object or array at the
+// beginning of json, or -1 if json does not begin with a valid object or
+// array.
+func consumeContainer(json []byte) int {
+	it, ok := newElemIter(json)
+	if !ok {
+		return -1
+	}
+	for it.next() {
+	}
+	if it.bad {
+		return -1
+	}
+	return it.i
+}
+
+// An elemIter iterates over the elements of a JSON object or array. After
+// each successful call to next, the fields key, start, off, and end describe
+// the current element. When next returns false, bad indicates whether the
+// container was malformed; if it was not, i is the length of the container.
+type elemIter struct {
+	json   []byte
+	closer byte
+	i      int // offset of the next byte to scan
+	n      int // number of elements scanned so far
+	closed bool
+	bad    bool
+
+	key     []byte // raw key of the current member, without quotes (objects only)
+	start   int    // offset of the current element, including its key
+	off     int    // offset of the current element's value
+	end     int    // offset immediately following the current element's value
+	prevEnd int    // offset immediately following the previous element's value
+}
+
+// newElemIter returns an elemIter for the object or array at the beginning of
+// json. It returns false if json does not begin with '{' or '['.
+func newElemIter(json []byte) (elemIter, bool) {
+	if len(json) == 0 || (json[0] != '{' && json[0] != '[') {
+		return elemIter{}, false
+	}
+	closer := byte(']')
+	if json[0] == '{' {
+		closer = '}'
+	}
+	return elemIter{json: json, closer: closer, i: 1}, true
+}
+
+// isObject reports whether it is iterating over an object.
+func (it *elemIter) isObject() bool {
+	return it.closer == '}'
+}
+
+// next advances it to the next element, returning false if there are no
+// more elements or the container is malformed.
+func (it *elemIter) next() bool {
+	if it.closed || it.bad {
+		return false
+	}
+	json := it.json
+	it.i += consumeWhitespace(json[it.i:])
+	if it.i >= len(json) {
+		it.bad = true
+		return false
+	}
+	if it.n == 0 && json[it.i] == it.closer {
+		it.i++
+		it.closed = true
+		return false
+	}
+
+	it.start = it.i
+	if it.isObject() {
+		kn := consumeString(json[it.i:])
+		if kn < 0 {
+			it.bad = true
+			return false
+		}
+		it.key = json[it.i+1 : it.i+kn-1]
+		it.i += kn
+		it.i += consumeWhitespace(json[it.i:])
+		if it.i >= len(json) || json[it.i] != ':' {
+			it.bad = true
+			return false
+		}
+		it.i++
+		it.i += consumeWhitespace(json[it.i:])
+	}
+	vn := consumeValue(json[it.i:])
+	if vn < 0 {
+		it.bad = true
+		return false
+	}
+	it.prevEnd = it.end
+	it.off, it.end = it.i, it.i+vn
+	it.n++
+
+	// consume the separator or closing bracket
+	it.i = it.end + consumeWhitespace(json[it.end:])
+	if it.i >= len(json) {
+		it.bad = true
+		return false
+	}
+	switch json[it.i] {
+	case ',':
+		it.i++
+	case it.closer:
+		it.i++
+		it.closed = true
+	default:
+		it.bad = true
+		return false
+	}
+	return true
+}
+
+// keyEquals reports whether the object key key, which must have been validated
+// by consumeString, is equal to acc once its escape sequences are decoded.
+func keyEquals(key []byte, acc string) bool {
+	if bytes.IndexByte(key, '\\') < 0 {
+		return string(key) == acc
+	}
+	return unescape(key) == acc
+}
+
+// unescape decodes the escape sequences in s, which must have been validated
+// by consumeString. Like encoding/json, unpaired surrogates are decoded as
+// U+FFFD.
+func unescape(s []byte) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'u':
+			r := parseHex4(s[i+1:])
+			i += 4
+			if utf16.IsSurrogate(r) && i+6 < len(s) && s[i+1] == '\\' && s[i+2] == 'u' {
+				if dec := utf16.DecodeRune(r, parseHex4(s[i+3:])); dec != utf8.RuneError {
+					r = dec
+					i += 6
+				}
+			}
+			b = utf8.AppendRune(b, r)
+		default: // '"', '\\', or '/'
+			b = append(b, s[i])
+		}
+	}
+	return string(b)
+}
+
+// parseHex4 parses the four hex digits at the beginning of s.
+func parseHex4(s []byte) rune {
+	u, _ := strconv.ParseUint(string(s[:4]), 16, 16)
+	return rune(u)
+}
+
+// parseIndex parses acc as an array index. Only non-negative decimal integers
+// without leading zeros are valid indices.
+func parseIndex(acc string) (int, bool) {
+	if len(acc) == 0 || (len(acc) > 1 && acc[0] == '0') {
+		return 0, false
+	}
+	for i := 0; i < len(acc); i++ {
+		if !isDigit(acc[i]) {
+			return 0, false
+		}
+	}
+	index, err := strconv.Atoi(acc)
+	return index, err == nil
+}
+
+// find advances it to the element identified by acc, returning false if no
+// such element exists.
+func (it *elemIter) find(acc string) bool {
+	if it.isObject() {
+		// like encoding/json, if the key is duplicated, use the last one
+		var match elemIter
+		found := false
+		for it.next() {
+			if keyEquals(it.key, acc) {
+				match, found = *it, true
+			}
+		}
+		if !found || it.bad {
+			return false
+		}
+		*it = match
+		return true
+	}
+	index, ok := it.index(acc)
+	if !ok {
+		return false
+	}
+	for it.next() {
+		if it.n-1 == index {
+			return true
+		}
+	}
+	return false
+}
+
+// index parses acc as an index into the array it, which must not have been
+// advanced. Negative indices count backwards from the end of the array, e.g.
+// -1 refers to the last element. A match accessor, e.g. [id=42], refers to the
+// first element matching it; see parseMatch.
+func (it *elemIter) index(acc string) (int, bool) {
+	if field, val, ok := parseMatch(acc); ok {
+		return it.match(field, val)
+	} else if len(acc) < 2 || acc[0] != '-' {
+		return parseIndex(acc)
+	}
+	back, ok := parseIndex(acc[1:])
+	if !ok || back == 0 {
+		return 0, false
+	}
+	// scan a copy of the iterator to determine the array length
+	end := *it
+	for end.next() {
+	}
+	if end.bad || back > end.n {
+		return 0, false
+	}
+	return end.n - back, true
+}
+
+// parseMatch parses acc as a match accessor of the form [field=val], which
+// identifies the first element of an array that is an object whose field key
+// has the value val. field may not contain '='.
+func parseMatch(acc string) (field, val string, ok bool) {
+	if len(acc) < 3 || acc[0] != '[' || acc[len(acc)-1] != ']' {
+		return "", "", false
+	}
+	i := strings.IndexByte(acc, '=')
+	if i < 0 {
+		return "", "", false
+	}
+	return acc[1:i], acc[i+1 : len(acc)-1], true
+}
+
+// match returns the index of the first element of the array it, which must
+// not have been advanced, that is an object whose field key has the value val.
+// If the value is a string, it is compared to val after decoding its escape
+// sequences; otherwise, its JSON encoding is compared to val, e.g. 42 or true.
+func (it *elemIter) match(field, val string) (int, bool) {
+	elems := *it
+	for elems.next() {
+		obj, ok := newElemIter(elems.json[elems.off:elems.end])
+		if !ok || !obj.isObject() || !obj.find(field) {
+			continue
+		}
+		v := obj.json[obj.off:obj.end]
+		if v[0] == '"' {
+			if keyEquals(v[1:len(v)-1], val) {
+				return elems.n - 1, true
+			}
+		} else if string(v) == val {
+			return elems.n - 1, true
+		}
+	}
+	return 0, false
+}
+
+// insertOffset returns the offset at which a new element should be appended
+// to the array it, which must have been fully iterated.
+func (it *elemIter) insertOffset() int {
+	if it.n == 0 {
+		return 1
+	}
+	return it.end
+}
+
+// locateAccessor returns the offset and length of the element identified by
+// acc within json, which must be an object or array. If no such element
+// exists, locateAccessor returns -1, -1. As a special case, if json is an
+// array and acc is equal to its length, locateAccessor returns the offset at
+// which a new element should be inserted and a length of 0.
+//
+// Whether acc is treated as a key or an index is determined by json alone,
+// so a numeric acc such as "0" identifies a key of an object and an element
+// of an array.
+func locateAccessor(json []byte, acc string) (off, n int) {
+	it, ok := newElemIter(json)
+	if !ok {
+		return -1, -1
+	} else if it.find(acc) {
+		return it.off, it.end - it.off
+	} else if it.isObject() || it.bad {
+		return -1, -1
+	}
+	if index, ok := parseIndex(acc); !ok || index != it.n {
+		return -1, -1
+	}
+	return it.insertOffset(), 0
+}
+
+// locatePath returns the offset and length of the element identified by
+// accs within json. If no such element exists, locatePath returns -1, -1.
+// Like locateAccessor, if the final accessor is equal to the length of its
+// array, locatePath returns the insertion offset and a length of 0.
+func locatePath(json []byte, accs []string) (off, n int) {
+	// the root value spans the whole of json, excluding whitespace
+	off = consumeWhitespace(json)
+	n = len(json) - off
+	for n > 0 && isWhitespace(json[off+n-1]) {
+		n--
+	}
+	if n == 0 {
+		return -1, -1
+	}
+	for i, acc := range accs {
+		aoff, an := locateAccessor(json[off:off+n], acc)
+		if an < 0 || (an == 0 && i != len(accs)-1) {
+			return -1, -1
+		}
+		off, n = off+aoff, an
+	}
+	return off, n
+}
+
+// splitPath splits path into its accessors. Within an accessor, a '\' causes
+// the following character to be interpreted literally.
+func splitPath(path string) []string {
+	if strings.IndexByte(path, '\\') < 0 {
+		return strings.Split(path, ".")
+	}
+	var accs []string
+	acc := make([]byte, 0, len(path))
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\\' && i+1 < len(path):
+			i++
+			acc = append(acc, path[i])
+		case c == '.':
+			accs = append(accs, string(acc))
+			acc = acc[:0]
+		default:
+			acc = append(acc, c)
+		}
+	}
+	return append(accs, string(acc))
+}
+
+// appendString appends s to buf as a JSON string, escaped exactly as by
+// encoding/json, except that HTML characters are not escaped. In particular,
+// invalid UTF-8 is replaced with U+FFFD, as it would be when the string is
+// decoded.
+func appendString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			switch c {
+			case '"', '\\':
+				buf = append(buf, '\\', c)
+			case '\b':
+				buf = append(buf, '\\', 'b')
+			case '\f':
+				buf = append(buf, '\\', 'f')
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				if c < 0x20 {
+					buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+				} else {
+					buf = append(buf, c)
+				}
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			buf = append(buf, "\uFFFD"...)
+		case r == '\u2028' || r == '\u2029':
+			// valid JSON, but not valid JavaScript
+			buf = append(buf, '\\', 'u', '2', '0', '2', hex[r&0xF])
+		default:
+			buf = append(buf, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(buf, '"')
+}
+
+// accessors returns the accessors of path. Unlike splitPath, it returns no
+// accessors for the path "", which refers to the entire object.
+func accessors(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return splitPath(path)
+}
+
+// A pathCache memoizes the accessors of paths, so that paths that are applied
+// repeatedly (e.g. during replay, or in a compare-and-swap loop) are only
+// parsed once. The cached accessors are shared, so they must not be modified.
+// A pathCache is not safe for concurrent use.
+type pathCache map[string][]string
+
+// maxCachedPaths bounds the size of a pathCache; once it is reached, the
+// cache is cleared.
+const maxCachedPaths = 1024
+
+// accessors returns the accessors of path, as by the accessors function.
+func (c *pathCache) accessors(path string) []string {
+	if accs, ok := (*c)[path]; ok {
+		return accs
+	} else if *c == nil || len(*c) >= maxCachedPaths {
+		*c = make(pathCache)
+	}
+	accs := accessors(path)
+	(*c)[path] = accs
+	return accs
+}
+
+// locateParent returns the offset and length of the container holding the
+// final element identified by accs, along with the final accessor. If no such
+// container exists, or accs is empty, locateParent returns -1, -1.
+func locateParent(json []byte, accs []string) (off, n int, acc string) {
+	if len(accs) == 0 {
+		return -1, -1, ""
+	}
+	off, n = locatePath(json, accs[:len(accs)-1])
+	if n <= 0 {
+		return -1, -1, ""
+	}
+	return off, n, accs[len(accs)-1]
+}
+
+// extractPath returns the element at path within json. The returned slice
+// aliases json. If path does not identify an element of json, extractPath
+// returns false.
+func extractPath(json []byte, path string) ([]byte, bool) {
+	return extractAccs(json, accessors(path))
+}
+
+// extractAccs is like extractPath, but takes the accessors of the path.
+func extractAccs(json []byte, accs []string) ([]byte, bool) {
+	off, n := locatePath(json, accs)
+	if n <= 0 {
+		return nil, false
+	}
+	return json[off : off+n], true
+}
+
+// isValue reports whether val contains exactly one JSON value, optionally
+// surrounded by whitespace.
+func isValue(val []byte) bool {
+	i := consumeWhitespace(val)
+	n := consumeValue(val[i:])
+	return n >= 0 && i+n+consumeWhitespace(val[i+n:]) == len(val)
+}
+
+// splice returns a copy of json with the n bytes at off replaced by val.
+func splice(json []byte, off, n int, val []byte) []byte {
+	buf := make([]byte, 0, len(json)-n+len(val))
+	buf = append(buf, json[:off]...)
+	buf = append(buf, val...)
+	buf = append(buf, json[off+n:]...)
+	return buf
+}
+
+// rewritePath returns a copy of json with the element at path replaced by
+// val. If path is "", a copy of val is returned. When appending to an array, null
+// is treated as an empty array. If path does not identify an
+// element of json, or val is not a valid JSON value, rewritePath returns json
+// unaltered and false.
+func rewritePath(json []byte, path string, val []byte) ([]byte, bool) {
+	if path != "" && strings.IndexByte(path, '.') < 0 && strings.IndexByte(path, '\\') < 0 {
+		// fast path for single-accessor paths, which avoids allocating
+		var acc [1]string
+		acc[0] = path
+		return rewriteAccs(json, acc[:], val)
+	}
+	return rewriteAccs(json, accessors(path), val)
+}
+
+// rewriteAccs is like rewritePath, but takes the accessors of the path.
+func rewriteAccs(json []byte, accs []string, val []byte) ([]byte, bool) {
+	if !isValue(val) {
+		return json, false
+	} else if len(accs) == 0 {
+		return append([]byte(nil), val...), true
+	}
+	off, n := locatePath(json, accs)
+	if n < 0 {
+		// a null value is treated as an empty array when appending, since
+		// that is how encoding/json represents nil slices
+		if accs[len(accs)-1] != "0" {
+			return json, false
+		}
+		off, n = locatePath(json, accs[:len(accs)-1])
+		if n < 0 || string(json[off:off+n]) != "null" {
+			return json, false
+		}
+		val = append(append([]byte{'['}, val...), ']')
+	} else if n == 0 {
+		// append to array, adding a separator if the array is non-empty
+		if json[off-1] != '[' {
+			val = append([]byte{','}, val...)
+		}
+	}
+	return splice(json, off, n, val), true
+}
+
+// deletePath returns a copy of json with the element at path removed. If
+// path does not identify an element of json, or path is "", deletePath
+// returns json unaltered and false.
+func deletePath(json []byte, path string) ([]byte, bool) {
+	return deleteAccs(json, accessors(path))
+}
+
+// deleteAccs is like deletePath, but takes the accessors of the path.
+func deleteAccs(json []byte, accs []string) ([]byte, bool) {
+	off, n, acc := locateParent(json, accs)
+	if n < 0 {
+		return json, false
+	}
+	container := json[off : off+n]
+	it, ok := newElemIter(container)
+	if !ok || !it.find(acc) {
+		return json, false
+	}
+	// remove the element along with one adjacent separator
+	start, end := it.start, it.end
+	if it.n > 1 {
+		start = it.prevEnd
+	} else if !it.closed {
+		end = it.i + consumeWhitespace(container[it.i:])
+	}
+	json = splice(json, off+start, end-start, nil)
+	if it.isObject() {
+		// remove any duplicates of the key, too
+		json, _ = deleteAccs(json, accs)
+	}
+	return json, true
+}
+
+// insertPath returns a copy of json with val inserted into the array
+// containing path, before the element at path. The final accessor of path may
+// be the length of the array, or "-", in which case val is appended. If path
+// is within an object, the key is set to val, as by upsertPath; unlike
+// upsertPath, the object must already exist. If path does not identify an
+// element of an array or object within json, or val is not a valid JSON value,
+// insertPath returns json unaltered and false.
+func insertPath(json []byte, path string, val []byte) ([]byte, bool) {
+	return insertAccs(json, accessors(path), val)
+}
+
+// insertAccs is like insertPath, but takes the accessors of the path.
+func insertAccs(json []byte, accs []string, val []byte) ([]byte, bool) {
+	if !isValue(val) {
+		return json, false
+	}
+	off, n, acc := locateParent(json, accs)
+	if n < 0 {
+		return json, false
+	}
+	if (acc == "-" || acc == "0") && string(json[off:off+n]) == "null" {
+		// as in rewritePath, a null value is treated as an empty array, since
+		// that is how encoding/json represents nil slices
+		return splice(json, off, n, append(append([]byte{'['}, val...), ']')), true
+	}
+	it, ok := newElemIter(json[off : off+n])
+	if !ok {
+		return json, false
+	} else if it.isObject() {
+		// the parent exists, so only the final key can be created
+		return upsertAccs(json, accs, val)
+	}
+	index, ok := it.index(acc)
+	if acc == "-" {
+		index, ok = -1, true
+	}
+	if !ok {
+		return json, false
+	}
+	for it.next() {
+		if it.n-1 == index {
+			buf := append(append([]byte(nil), val...), ',')
+			return splice(json, off+it.start, 0, buf), true
+		}
+	}
+	if it.bad || (index != it.n && index != -1) {
+		return json, false
+	}
+	// append
+	if it.n > 0 {
+		val = append([]byte{','}, val...)
+	}
+	return splice(json, off+it.insertOffset(), 0, val), true
+}
+
+// movePath returns a copy of json with the element at from moved to to. The
+// element is first removed, and then to is rewritten as by rewritePath. If
+// either path is invalid, movePath returns json unaltered and false.
+func movePath(json []byte, from, to string) ([]byte, bool) {
+	return moveAccs(json, accessors(from), accessors(to))
+}
+
+// moveAccs is like movePath, but takes the accessors of the paths.
+func moveAccs(json []byte, from, to []string) ([]byte, bool) {
+	val, ok := extractAccs(json, from)
+	if !ok || len(from) == 0 {
+		return json, false
+	} else if len(from) == len(to) && isWithin(to, from) {
+		return json, true
+	} else if isWithin(to, from) {
+		return json, false
+	}
+	// NOTE: deleteAccs does not modify json, so val remains valid
+	res, ok := deleteAccs(json, from)
+	if !ok {
+		return json, false
+	}
+	if res, ok = rewriteAccs(res, to, val); !ok {
+		return json, false
+	}
+	return res, true
+}
+
+// isWithin reports whether the accessors of path begin with those of parent.
+func isWithin(path, parent []string) bool {
+	if len(path) < len(parent) {
+		return false
+	}
+	for i := range parent {
+		if path[i] != parent[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// copyPath returns a copy of json with the element at to replaced by the
+// element at from, as by rewritePath. If either path is invalid, copyPath
+// returns json unaltered and false.
+func copyPath(json []byte, from, to string) ([]byte, bool) {
+	return copyAccs(json, accessors(from), accessors(to))
+}
+
+// copyAccs is like copyPath, but takes the accessors of the paths.
+func copyAccs(json []byte, from, to []string) ([]byte, bool) {
+	val, ok := extractAccs(json, from)
+	if !ok {
+		return json, false
+	}
+	// NOTE: val aliases json, but rewriteAccs copies both into a new buffer
+	// rather than modifying json in place, so this is safe
+	return rewriteAccs(json, to, val)
+}
+
+// isNumber reports whether num consists solely of a JSON number.
+func isNumber(num []byte) bool {
+	return len(num) > 0 && consumeNumber(num) == len(num)
+}
+
+// addNumbers returns the sum of the JSON numbers a and b. If both are
+// integers, the sum is computed exactly, failing on overflow; otherwise, it
+// is computed in floating point.
+func addNumbers(a, b []byte) ([]byte, bool) {
+	if !isNumber(a) || !isNumber(b) {
+		return nil, false
+	}
+	x, errx := strconv.ParseInt(string(a), 10, 64)
+	y, erry := strconv.ParseInt(string(b), 10, 64)
+	if errx == nil && erry == nil {
+		sum := x + y
+		if (sum > x) != (y > 0) {
+			return nil, false // overflow
+		}
+		return strconv.AppendInt(nil, sum, 10), true
+	}
+	fx, errx := strconv.ParseFloat(string(a), 64)
+	fy, erry := strconv.ParseFloat(string(b), 64)
+	sum := fx + fy
+	if errx != nil || erry != nil || math.IsInf(sum, 0) {
+		return nil, false
+	}
+	return strconv.AppendFloat(nil, sum, 'g', -1, 64), true
+}
+
+// incrementPath returns a copy of json with delta added to the number at
+// path. If path does not identify a number within json, or delta is not a
+// number, incrementPath returns json unaltered and false.
+func incrementPath(json []byte, path string, delta []byte) ([]byte, bool) {
+	return incrementAccs(json, accessors(path), delta)
+}
+
+// incrementAccs is like incrementPath, but takes the accessors of the path.
+func incrementAccs(json []byte, accs []string, delta []byte) ([]byte, bool) {
+	num, ok := extractAccs(json, accs)
+	if !ok {
+		return json, false
+	}
+	sum, ok := addNumbers(num, delta)
+	if !ok {
+		return json, false
+	}
+	return rewriteAccs(json, accs, sum)
+}
+
+// upsertPath is like rewritePath, but if path references object keys that do
+// not exist, they are created, along with any intermediate objects.
+func upsertPath(json []byte, path string, val []byte) ([]byte, bool) {
+	return upsertAccs(json, accessors(path), val)
+}
+
+// upsertAccs is like upsertPath, but takes the accessors of the path.
+func upsertAccs(json []byte, accs []string, val []byte) ([]byte, bool) {
+	if !isValue(val) {
+		return json, false
+	} else if len(accs) == 0 {
+		return append([]byte(nil), val...), true
+	}
+	off, n := locatePath(json, nil)
+	if n < 0 {
+		return json, false
+	}
+	for i, acc := range accs {
+		aoff, an := locateAccessor(json[off:off+n], acc)
+		if an > 0 {
+			off, n = off+aoff, an
+			continue
+		}
+
+		// acc does not exist; synthesize the remainder of the path
+		var elem []byte
+		it, ok := newElemIter(json[off : off+n])
+		if !ok {
+			return json, false
+		} else if an == 0 {
+			// array append index
+			elem = synthesizePath(nil, accs[i+1:], val)
+		} else if it.isObject() {
+			elem = appendString(nil, acc)
+			elem = append(elem, ':')
+			elem = synthesizePath(elem, accs[i+1:], val)
+		} else {
+			return json, false
+		}
+		for it.next() {
+		}
+		if it.bad {
+			return json, false
+		} else if it.n > 0 {
+			elem = append([]byte{','}, elem...)
+		}
+		return splice(json, off+it.insertOffset(), 0, elem), true
+	}
+	return splice(json, off, n, val), true
+}
+
+// splitPattern is like splitPath, but also reports which accessors are
+// wildcards, i.e. an unescaped "*".
+func splitPattern(path string) (accs []string, wild []bool) {
+	accs = splitPath(path)
+	wild = make([]bool, len(accs))
+	start, k := 0, 0
+	for i := 0; i <= len(path); i++ {
+		if i < len(path) && path[i] == '\\' && i+1 < len(path) {
+			i++
+		} else if i == len(path) || path[i] == '.' {
+			wild[k] = path[start:i] == "*"
+			start, k = i+1, k+1
+		}
+	}
+	return accs, wild
+}
+
+// expandPattern appends to paths the path of each element of json matched by
+// accs, where wild indicates which accessors are wildcards. Each path is
+// escaped and prefixed with prefix. Array append indices are not matched.
+func expandPattern(paths []string, json []byte, prefix string, accs []string, wild []bool) []string {
+	if len(accs) == 0 {
+		return append(paths, prefix)
+	} else if !wild[0] {
+		off, n := locateAccessor(json, accs[0])
+		if n <= 0 {
+			return paths
+		}
+		return expandPattern(paths, json[off:off+n], joinPath(prefix, EscapeKey(accs[0])), accs[1:], wild[1:])
+	}
+	it, ok := newElemIter(json)
+	if !ok {
+		return paths
+	}
+	for it.next() {
+		acc := strconv.Itoa(it.n - 1)
+		if it.isObject() {
+			acc = EscapeKey(unescape(it.key))
+			if prefix == "" && acc == "" {
+				continue // the top-level empty key cannot be expressed as a path
+			}
+		}
+		paths = expandPattern(paths, json[it.off:it.end], joinPath(prefix, acc), accs[1:], wild[1:])
+	}
+	return paths
+}
+
+// rewriteAll returns a copy of json with each element matched by path, which
+// may contain wildcards, replaced by val, as by rewritePath. If path matches
+// no elements of json, or val is not a valid JSON value, rewriteAll returns
+// json unaltered and false.
+func rewriteAll(json []byte, path string, val []byte) ([]byte, bool) {
+	if path == "" {
+		return rewritePath(json, path, val)
+	} else if !isValue(val) {
+		return json, false
+	}
+	off, n := locatePath(json, nil)
+	if n < 0 {
+		return json, false
+	}
+	accs, wild := splitPattern(path)
+	paths := expandPattern(nil, json[off:off+n], "", accs, wild)
+	if len(paths) == 0 {
+		return json, false
+	}
+	for _, p := range paths {
+		json, _ = rewritePath(json, p, val)
+	}
+	return json, true
+}
+
+// synthesizePath appends to buf a value which, when accessed by accs, yields
+// val. Each accessor is treated as an object key.
+func synthesizePath(buf []byte, accs []string, val []byte) []byte {
+	for _, acc := range accs {
+		buf = append(buf, '{')
+		buf = appendString(buf, acc)
+		buf = append(buf, ':')
+	}
+	buf = append(buf, val...)
+	for range accs {
+		buf = append(buf, '}')
+	}
+	return buf
+}
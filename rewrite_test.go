@@ -0,0 +1,688 @@
+package jj
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestConsumeValue(t *testing.T) {
+	tests := []struct {
+		json string
+		n    int
+	}{
+		{`null`, 4},
+		{`true,`, 4},
+		{`false]`, 5},
+		{`nul`, -1},
+		{`0`, 1},
+		{`-12.5e+3}`, 8},
+		{`01`, 1},
+		{`-`, -1},
+		{`1.`, -1},
+		{`1e`, -1},
+		{`""`, 2},
+		{`"a\"b"`, 6},
+		{`"é"`, 4},
+		{`"\u00e"`, -1},
+		{`"\x"`, -1},
+		{`"abc`, -1},
+		{`{}`, 2},
+		{`{ "a" : [1, 2, {"b": null}] }`, 29},
+		{`{"a":1,}`, -1},
+		{`{"a"}`, -1},
+		{`[1 2]`, -1},
+		{`[`, -1},
+		{`[1,`, -1},
+		{``, -1},
+	}
+	for _, test := range tests {
+		if n := consumeValue([]byte(test.json)); n != test.n {
+			t.Errorf("consumeValue(%q): expected %v, got %v", test.json, test.n, n)
+		}
+	}
+}
+
+func TestConsumeNumber(t *testing.T) {
+	tests := []struct {
+		json string
+		n    int
+	}{
+		{`0`, 1},
+		{`-0`, 2},
+		{`12`, 2},
+		{`1.5`, 3},
+		{`1e5`, 3},
+		{`1E+5`, 4},
+		{`-1.5e-5`, 7},
+		{`-`, -1},
+		{`1.`, -1},
+		{`1.e5`, -1},
+		{`1e`, -1},
+		{`1e+`, -1},
+		{`1e-`, -1},
+		{`.5`, -1},
+		{`+1`, -1},
+		{``, -1},
+	}
+	for _, test := range tests {
+		if n := consumeNumber([]byte(test.json)); n != test.n {
+			t.Errorf("consumeNumber(%q): expected %v, got %v", test.json, test.n, n)
+		}
+	}
+	// every prefix of a number ends at the end of the buffer; none should be
+	// read past
+	for _, num := range []string{`-12.5e+3`, `0.0E-0`, `-0e1`} {
+		for i := 0; i <= len(num); i++ {
+			if n := consumeNumber([]byte(num[:i])); n > i {
+				t.Errorf("consumeNumber(%q): consumed %v bytes", num[:i], n)
+			}
+		}
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	tests := []struct {
+		json, path, val string
+		exp             string
+		ok              bool
+	}{
+		{`{"a":1}`, "", `2`, `2`, true},
+		{`{"a":1}`, "a", `2`, `{"a":2}`, true},
+		{`{"a":1, "b":{"c":[1,2]}}`, "b.c.1", `{}`, `{"a":1, "b":{"c":[1,{}]}}`, true},
+		{`{"a":1, "b":{"c":[1,2]}}`, "b.c.2", `3`, `{"a":1, "b":{"c":[1,2,3]}}`, true},
+		{`{"a":[ ]}`, "a.0", `3`, `{"a":[3 ]}`, true},
+		{`{"a":[[1]]}`, "a.1", `3`, `{"a":[[1],3]}`, true},
+		{`{"a":1}`, "b", `2`, `{"a":1}`, false},
+		{`{"a":[1]}`, "a.2", `2`, `{"a":[1]}`, false},
+		{`{"a":[1]}`, "a.1.b", `2`, `{"a":[1]}`, false},
+		{`{"a":[1]}`, "a.01", `2`, `{"a":[1]}`, false},
+		{`{"a":1}`, "a", `{`, `{"a":1}`, false},
+		{`{"a":1}`, "a.b", `2`, `{"a":1}`, false},
+		{`{"a":1,"a":2}`, "a", `3`, `{"a":1,"a":3}`, true},
+		{`{"a":{"b":1},"a":{"c":2}}`, "a.b", `3`, `{"a":{"b":1},"a":{"c":2}}`, false},
+		{`{"a":{"b":1},"a":{"c":2}}`, "a.c", `3`, `{"a":{"b":1},"a":{"c":3}}`, true},
+		{`{"a":null}`, "a.0", `3`, `{"a":[3]}`, true},
+		{`{"a":null}`, "a.1", `3`, `{"a":null}`, false},
+		{`{"a":[1,2,3]}`, "a.-1", `4`, `{"a":[1,2,4]}`, true},
+		{`{"a":[1,2,3]}`, "a.-3", `4`, `{"a":[4,2,3]}`, true},
+		{`{"a":[1,2,3]}`, "a.-4", `4`, `{"a":[1,2,3]}`, false},
+		{`{"":{"a":1}}`, ".a", `2`, `{"":{"a":2}}`, true},
+		{`{"a":{"":1}}`, "a.", `2`, `{"a":{"":2}}`, true},
+		{`{"a":{"":{"b":1}}}`, "a..b", `2`, `{"a":{"":{"b":2}}}`, true},
+		{`{"a":{"b":1}}`, "a..b", `2`, `{"a":{"b":1}}`, false},
+		{`{"a":[1]}`, "a.", `2`, `{"a":[1]}`, false},
+		{`{"a":[1,2,3]}`, "a.-0", `4`, `{"a":[1,2,3]}`, false},
+		{`{"a":[]}`, "a.-1", `4`, `{"a":[]}`, false},
+		{`{"a":[[1],[2]]}`, "a.-1.-1", `4`, `{"a":[[1],[4]]}`, true},
+		{`{"a":{"-1":1}}`, "a.-1", `4`, `{"a":{"-1":4}}`, true},
+		{`{"a":{"b":1},"a.b":2}`, "a.b", `3`, `{"a":{"b":3},"a.b":2}`, true},
+		{`{"a":{"b":1},"a.b":2}`, `a\.b`, `3`, `{"a":{"b":1},"a.b":3}`, true},
+		{`{"a.b":{"c.":[1]}}`, `a\.b.c\..0`, `3`, `{"a.b":{"c.":[3]}}`, true},
+		{`{"a\u0062":1}`, "ab", `2`, `{"a\u0062":2}`, true},
+		{`{"a\"b":1}`, `a"b`, `2`, `{"a\"b":2}`, true},
+		{`{"a\\b":1}`, `a\\b`, `2`, `{"a\\b":2}`, true},
+		{`{"a\/b\n":1}`, "a/b\n", `2`, `{"a\/b\n":2}`, true},
+		{`{"\ud83d\ude00":1}`, "\U0001F600", `2`, `{"\ud83d\ude00":2}`, true},
+		{`{"\ud83d":1}`, "\uFFFD", `2`, `{"\ud83d":2}`, true},
+		{`{"a\u0062":1}`, `a\u0062`, `2`, `{"a\u0062":1}`, false},
+	}
+	for _, test := range tests {
+		res, ok := rewritePath([]byte(test.json), test.path, []byte(test.val))
+		if string(res) != test.exp || ok != test.ok {
+			t.Errorf("rewritePath(%s, %q, %s): expected (%s, %v), got (%s, %v)", test.json, test.path, test.val, test.exp, test.ok, res, ok)
+		}
+	}
+}
+
+func TestAppendSameSet(t *testing.T) {
+	// successive appends within a set must each see the array's current
+	// length, and separators must depend on the array's contents, not on the
+	// accessor
+	tests := []struct {
+		json string
+		us   []Update
+		exp  string
+	}{
+		{`{"a":[]}`, []Update{NewUpdate("a.0", 1), NewUpdate("a.1", 2)}, `{"a":[1,2]}`},
+		{`{"a":[ ]}`, []Update{NewUpdate("a.0", 1), NewUpdate("a.1", 2)}, `{"a":[1,2 ]}`},
+		{`{"a":null}`, []Update{NewUpdate("a.0", 1), NewUpdate("a.1", 2)}, `{"a":[1,2]}`},
+		{`{"a":[]}`, NewAppendUpdates("a", 1, 2, 3), `{"a":[1,2,3]}`},
+		{`{"a":[ ]}`, NewAppendUpdates("a", 1, 2), `{"a":[1,2 ]}`},
+		{`{"a":[]}`, []Update{NewInsertUpdate("a.0", 1), NewInsertUpdate("a.1", 2)}, `{"a":[1,2]}`},
+		{`{"a":[]}`, []Update{NewInsertUpdate("a.0", 2), NewInsertUpdate("a.0", 1)}, `{"a":[1,2]}`},
+		{`{"a":[]}`, []Update{NewUpsertUpdate("a.0", 1), NewUpsertUpdate("a.1.b", 2)}, `{"a":[1,{"b":2}]}`},
+		{`{"a":[]}`, []Update{NewUpdate("a.0", 1), NewDeleteUpdate("a.0"), NewUpdate("a.0", 2)}, `{"a":[2]}`},
+		// a stale index is malformed, rather than producing a bad separator
+		{`{"a":[]}`, []Update{NewUpdate("a.0", 1), NewUpdate("a.0", 2), NewUpdate("a.2", 3)}, `{"a":[2]}`},
+	}
+	for _, test := range tests {
+		obj := []byte(test.json)
+		for _, u := range test.us {
+			obj, _ = u.apply(obj)
+		}
+		if string(obj) != test.exp {
+			t.Errorf("%s %v: expected %s, got %s", test.json, test.us, test.exp, obj)
+		} else if !json.Valid(obj) {
+			t.Errorf("%s %v: result is not valid JSON: %s", test.json, test.us, obj)
+		}
+	}
+}
+
+func TestAppendString(t *testing.T) {
+	for _, s := range []string{
+		"", "abc", `a"b\c`, "a/b", "\x00\x01\x1f\x7f", "\b\f\n\r\t",
+		"<&>", "\u00e9\U0001F600", "\u2028\u2029", "\xff", "a\xc3", "\xed\xa0\x80",
+	} {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(s)
+		exp := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+		if got := appendString(nil, s); !bytes.Equal(got, exp) {
+			t.Errorf("appendString(%q): expected %s, got %s", s, exp, got)
+		}
+	}
+}
+
+func TestUnicode(t *testing.T) {
+	// keys and values containing escaped and unescaped non-ASCII characters,
+	// surrogate pairs, control characters, and NUL
+	const obj = `{"\u00e9":1,"😀":2,"\ud83d\ude00x":3,"a\u0000b":4,"\t\n":5,"\ud800":6,"日本":{"\u8a9e":[7]},"v":"\ud83d\ude00\u0000\"\\"}`
+	if !isValue([]byte(obj)) {
+		t.Fatal("object should be valid")
+	}
+	for _, test := range []struct {
+		acc string
+		val string
+	}{
+		{"é", `1`},
+		{"\u00e9", `1`},
+		{"😀", `2`},
+		{"\U0001F600x", `3`},
+		{"a\x00b", `4`},
+		{"\t\n", `5`},
+		{"\uFFFD", `6`}, // unpaired surrogates decode as U+FFFD
+		{"日本", `{"\u8a9e":[7]}`},
+		{"v", `"\ud83d\ude00\u0000\"\\"`},
+	} {
+		off, n := locateAccessor([]byte(obj), test.acc)
+		if n < 0 || obj[off:off+n] != test.val {
+			t.Errorf("locateAccessor(%q): expected %s, got (%v, %v)", test.acc, test.val, off, n)
+		}
+	}
+	for _, acc := range []string{"e", "\\u00e9", "a", "ab", "日"} {
+		if _, n := locateAccessor([]byte(obj), acc); n >= 0 {
+			t.Errorf("locateAccessor(%q): expected no match", acc)
+		}
+	}
+
+	tests := []struct {
+		u   Update
+		exp string
+	}{
+		{NewUpdate("日本.語.0", "値"), `{"\u00e9":1,"😀":2,"\ud83d\ude00x":3,"a\u0000b":4,"\t\n":5,"\ud800":6,"日本":{"\u8a9e":["値"]},"v":"\ud83d\ude00\u0000\"\\"}`},
+		{NewUpdate("a\x00b", "\x00\U0001F600"), `{"\u00e9":1,"😀":2,"\ud83d\ude00x":3,"a\u0000b":"\u0000😀","\t\n":5,"\ud800":6,"日本":{"\u8a9e":[7]},"v":"\ud83d\ude00\u0000\"\\"}`},
+		{NewDeleteUpdate("😀"), `{"\u00e9":1,"\ud83d\ude00x":3,"a\u0000b":4,"\t\n":5,"\ud800":6,"日本":{"\u8a9e":[7]},"v":"\ud83d\ude00\u0000\"\\"}`},
+		{NewMoveUpdate("\t\n", "é"), `{"\u00e9":5,"😀":2,"\ud83d\ude00x":3,"a\u0000b":4,"\ud800":6,"日本":{"\u8a9e":[7]},"v":"\ud83d\ude00\u0000\"\\"}`},
+		{NewUpsertUpdate("新.\x01", 1), `{"\u00e9":1,"😀":2,"\ud83d\ude00x":3,"a\u0000b":4,"\t\n":5,"\ud800":6,"日本":{"\u8a9e":[7]},"v":"\ud83d\ude00\u0000\"\\","新":{"\u0001":1}}`},
+		{NewIncrementUpdate("é", 1), `{"\u00e9":2,"😀":2,"\ud83d\ude00x":3,"a\u0000b":4,"\t\n":5,"\ud800":6,"日本":{"\u8a9e":[7]},"v":"\ud83d\ude00\u0000\"\\"}`},
+	}
+	for _, test := range tests {
+		res, ok := test.u.apply([]byte(obj))
+		if !ok || string(res) != test.exp {
+			t.Errorf("%v: expected %s, got (%s, %v)", test.u, test.exp, res, ok)
+		} else if !json.Valid(res) {
+			t.Errorf("%v: result is not valid JSON: %s", test.u, res)
+		}
+	}
+
+	// strings with truncated or invalid escapes are not valid
+	for _, bad := range []string{`"\u00"`, `"\ud83d\ude0"`, `"\u00g0"`, `"\x"`, `"a` + "\x00" + `"`, `"\`} {
+		if n := consumeString([]byte(bad)); n >= 0 {
+			t.Errorf("consumeString(%q): expected -1, got %v", bad, n)
+		}
+	}
+	// decoded strings match encoding/json
+	for _, s := range []string{`\ud83d\ude00`, `\ud83d`, `\ude00\ud83d`, `\ud83d\u0041`, `\ud83dx`, `\u0000\u001f`, `\/\b\f\n\r\t`} {
+		var exp string
+		if err := json.Unmarshal([]byte(`"`+s+`"`), &exp); err != nil {
+			t.Fatal(err)
+		} else if got := unescape([]byte(s)); got != exp {
+			t.Errorf("unescape(%s): expected %q, got %q", s, exp, got)
+		}
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	tests := []struct {
+		path string
+		accs []string
+	}{
+		{`a`, []string{`a`}},
+		{`a.b`, []string{`a`, `b`}},
+		{`a\.b`, []string{`a.b`}},
+		{`a\\.b`, []string{`a\`, `b`}},
+		{`a\\\.b`, []string{`a\.b`}},
+		{`a\b`, []string{`ab`}},
+		{`a.b\`, []string{`a`, `b\`}},
+		{`.`, []string{``, ``}},
+	}
+	for _, test := range tests {
+		accs := splitPath(test.path)
+		if len(accs) != len(test.accs) {
+			t.Errorf("splitPath(%q): expected %q, got %q", test.path, test.accs, accs)
+			continue
+		}
+		for i := range accs {
+			if accs[i] != test.accs[i] {
+				t.Errorf("splitPath(%q): expected %q, got %q", test.path, test.accs, accs)
+				break
+			}
+		}
+	}
+
+	// EscapeKey should round-trip
+	for _, key := range []string{``, `a`, `a.b`, `a\.b`, `a\b`, `\`, `..\\`} {
+		if accs := splitPath(EscapeKey(key) + ".x"); len(accs) != 2 || accs[0] != key {
+			t.Errorf("EscapeKey(%q) did not round-trip: got %q", key, accs)
+		}
+	}
+}
+
+func TestPathCache(t *testing.T) {
+	var c pathCache
+	if accs := c.accessors(""); accs != nil {
+		t.Fatal("expected no accessors for the empty path, got", accs)
+	} else if accs := c.accessors(`a.b\.c`); !reflect.DeepEqual(accs, []string{"a", "b.c"}) {
+		t.Fatal("wrong accessors:", accs)
+	} else if &c.accessors(`a.b\.c`)[0] != &accs[0] {
+		t.Fatal("accessors were not cached")
+	}
+	// the cache is bounded
+	for i := 0; i < maxCachedPaths*2; i++ {
+		c.accessors(strconv.Itoa(i))
+	}
+	if len(c) > maxCachedPaths {
+		t.Fatal("cache exceeded its bound:", len(c))
+	}
+}
+
+func TestDeletePath(t *testing.T) {
+	tests := []struct {
+		json, path string
+		exp        string
+		ok         bool
+	}{
+		{`{"a":1}`, "a", `{}`, true},
+		{`{"a":1, "b":2, "c":3}`, "a", `{"b":2, "c":3}`, true},
+		{`{"a":1, "b":2, "c":3}`, "b", `{"a":1, "c":3}`, true},
+		{`{"a":1, "b":2, "c":3}`, "c", `{"a":1, "b":2}`, true},
+		{`{"a":[1, [2], 3]}`, "a.1", `{"a":[1, 3]}`, true},
+		{`{"a":[1]}`, "a.0", `{"a":[]}`, true},
+		{`{"a":[1]}`, "a.1", `{"a":[1]}`, false},
+		{`{"a":[1, 2]}`, "a.-1", `{"a":[1]}`, true},
+		{`{"a":[1, 2]}`, "a.-3", `{"a":[1, 2]}`, false},
+		{`{"a":1}`, "b", `{"a":1}`, false},
+		{`{"a":1, "b":2, "a":3}`, "a", `{"b":2}`, true},
+		{`{"a":1, "a":2, "a":3}`, "a", `{}`, true},
+		{`{"a":1}`, "", `{"a":1}`, false},
+	}
+	for _, test := range tests {
+		res, ok := deletePath([]byte(test.json), test.path)
+		if string(res) != test.exp || ok != test.ok {
+			t.Errorf("deletePath(%s, %q): expected (%s, %v), got (%s, %v)", test.json, test.path, test.exp, test.ok, res, ok)
+		}
+	}
+}
+
+func TestInsertPath(t *testing.T) {
+	tests := []struct {
+		json, path, val string
+		exp             string
+		ok              bool
+	}{
+		{`{"a":[]}`, "a.0", `1`, `{"a":[1]}`, true},
+		{`{"a":[]}`, "a.-", `1`, `{"a":[1]}`, true},
+		{`{"a":[1, 3]}`, "a.1", `2`, `{"a":[1, 2,3]}`, true},
+		{`{"a":[1, 3]}`, "a.0", `0`, `{"a":[0,1, 3]}`, true},
+		{`{"a":[1, 3]}`, "a.2", `4`, `{"a":[1, 3,4]}`, true},
+		{`{"a":[1, 3]}`, "a.3", `4`, `{"a":[1, 3]}`, false},
+		{`{"a":[1, 3]}`, "a.-1", `2`, `{"a":[1, 2,3]}`, true},
+		{`{"a":[1, 3]}`, "a.0", `}`, `{"a":[1, 3]}`, false},
+		{`{"a":{}}`, "a.b", `1`, `{"a":{"b":1}}`, true},
+		{`{"a":{"b":1}}`, "a.c", `2`, `{"a":{"b":1,"c":2}}`, true},
+		{`{"a":{"b":1}}`, "a.b", `2`, `{"a":{"b":2}}`, true},
+		{`{"a":{}}`, "a.b.c", `1`, `{"a":{}}`, false},
+		{`{"a":1}`, "a.b", `1`, `{"a":1}`, false},
+		{`{"a":[]}`, "", `1`, `{"a":[]}`, false},
+		{`{"a":null}`, "a.-", `1`, `{"a":[1]}`, true},
+		{`{"a":null}`, "a.0", `1`, `{"a":[1]}`, true},
+		{`{"a":null}`, "a.1", `1`, `{"a":null}`, false},
+		{`null`, "-", `1`, `[1]`, true},
+	}
+	for _, test := range tests {
+		res, ok := insertPath([]byte(test.json), test.path, []byte(test.val))
+		if string(res) != test.exp || ok != test.ok {
+			t.Errorf("insertPath(%s, %q, %s): expected (%s, %v), got (%s, %v)", test.json, test.path, test.val, test.exp, test.ok, res, ok)
+		}
+	}
+}
+
+func TestMovePath(t *testing.T) {
+	tests := []struct {
+		json, from, to string
+		exp            string
+		ok             bool
+	}{
+		{`{"a":1,"b":2}`, "a", "b", `{"b":1}`, true},
+		{`{"a":{"b":[1]},"c":[]}`, "a.b.0", "c.0", `{"a":{"b":[]},"c":[1]}`, true},
+		{`{"a":[1,2,3]}`, "a.0", "a.1", `{"a":[2,1]}`, true},
+		{`{"a":[1,2,3]}`, "a.0", "a.2", `{"a":[2,3,1]}`, true},
+		{`{"a":[1,2,3]}`, "a.2", "a.0", `{"a":[3,2]}`, true},
+		{`{"a":[1,2,3]}`, "a.0", "a.0", `{"a":[1,2,3]}`, true},
+		{`{"a":{"b":{"c":1}}}`, "a.b", "a", `{"a":{"c":1}}`, true},
+		{`{"a":{"b":1}}`, "a", "a.b", `{"a":{"b":1}}`, false},
+		{`{"a":[{"x":1},{"x":2}]}`, "a.0", "a.0.x", `{"a":[{"x":1},{"x":2}]}`, false},
+		{`{"a":[{"x":1},{"x":2}]}`, "a.0", "a.0", `{"a":[{"x":1},{"x":2}]}`, true},
+		{`{"a.b":{"c":1},"a":{"b":{"c":0}}}`, `a\.b`, "a.b.c", `{"a":{"b":{"c":{"c":1}}}}`, true},
+		{`{"a":1}`, "b", "a", `{"a":1}`, false},
+		{`{"a":1,"b":2}`, "a", "c", `{"a":1,"b":2}`, false},
+		{`{"a":1}`, "", "a", `{"a":1}`, false},
+	}
+	for _, test := range tests {
+		res, ok := movePath([]byte(test.json), test.from, test.to)
+		if string(res) != test.exp || ok != test.ok {
+			t.Errorf("movePath(%s, %q, %q): expected (%s, %v), got (%s, %v)", test.json, test.from, test.to, test.exp, test.ok, res, ok)
+		}
+	}
+}
+
+func TestCopyPath(t *testing.T) {
+	tests := []struct {
+		json, from, to string
+		exp            string
+		ok             bool
+	}{
+		{`{"a":1,"b":2}`, "a", "b", `{"a":1,"b":1}`, true},
+		{`{"t":{"x":1},"items":[]}`, "t", "items.0", `{"t":{"x":1},"items":[{"x":1}]}`, true},
+		{`{"a":[1,2]}`, "a", "a.2", `{"a":[1,2,[1,2]]}`, true},
+		{`{"a":{"b":1}}`, "a", "a.b", `{"a":{"b":{"b":1}}}`, true},
+		{`{"a":{"b":1}}`, "a.b", "", `1`, true},
+		{`{"a":1}`, "b", "a", `{"a":1}`, false},
+		{`{"a":1}`, "a", "b", `{"a":1}`, false},
+	}
+	for _, test := range tests {
+		res, ok := copyPath([]byte(test.json), test.from, test.to)
+		if string(res) != test.exp || ok != test.ok {
+			t.Errorf("copyPath(%s, %q, %q): expected (%s, %v), got (%s, %v)", test.json, test.from, test.to, test.exp, test.ok, res, ok)
+		}
+	}
+}
+
+func TestIncrementPath(t *testing.T) {
+	tests := []struct {
+		json, path, delta string
+		exp               string
+		ok                bool
+	}{
+		{`{"a":1}`, "a", `1`, `{"a":2}`, true},
+		{`{"a":[1,-5]}`, "a.1", `2`, `{"a":[1,-3]}`, true},
+		{`{"a":1.5}`, "a", `1`, `{"a":2.5}`, true},
+		{`{"a":1}`, "a", `-0.25`, `{"a":0.75}`, true},
+		{`{"a":1e3}`, "a", `1`, `{"a":1001}`, true},
+		{`7`, "", `1`, `8`, true},
+		{`{"a":9223372036854775807}`, "a", `1`, `{"a":9223372036854775807}`, false},
+		{`{"a":-9223372036854775808}`, "a", `-1`, `{"a":-9223372036854775808}`, false},
+		{`{"a":1e308}`, "a", `1e308`, `{"a":1e308}`, false},
+		{`{"a":"1"}`, "a", `1`, `{"a":"1"}`, false},
+		{`{"a":1}`, "a", `"1"`, `{"a":1}`, false},
+		{`{"a":1}`, "b", `1`, `{"a":1}`, false},
+	}
+	for _, test := range tests {
+		res, ok := incrementPath([]byte(test.json), test.path, []byte(test.delta))
+		if string(res) != test.exp || ok != test.ok {
+			t.Errorf("incrementPath(%s, %q, %s): expected (%s, %v), got (%s, %v)", test.json, test.path, test.delta, test.exp, test.ok, res, ok)
+		}
+	}
+}
+
+func TestUpsertPath(t *testing.T) {
+	tests := []struct {
+		json, path, val string
+		exp             string
+		ok              bool
+	}{
+		{`{}`, "a.b.c", `5`, `{"a":{"b":{"c":5}}}`, true},
+		{`{"x":1}`, "a", `5`, `{"x":1,"a":5}`, true},
+		{`{"x":1}`, "x", `5`, `{"x":5}`, true},
+		{`{"a":{"x":1}}`, "a.b.0", `5`, `{"a":{"x":1,"b":{"0":5}}}`, true},
+		{`{"a":[1]}`, "a.1.b", `5`, `{"a":[1,{"b":5}]}`, true},
+		{`{"a":[]}`, "a.0", `5`, `{"a":[5]}`, true},
+		{`{"a":{}}`, `a.b\.c`, `5`, `{"a":{"b.c":5}}`, true},
+		{`{"a":[1]}`, "a.2", `5`, `{"a":[1]}`, false},
+		{`{"a":1}`, "a.b", `5`, `{"a":1}`, false},
+		{`{"a":null}`, "a.b", `5`, `{"a":null}`, false},
+		{`{}`, "a", `}`, `{}`, false},
+		{`{}`, "", `5`, `5`, true},
+	}
+	for _, test := range tests {
+		res, ok := upsertPath([]byte(test.json), test.path, []byte(test.val))
+		if string(res) != test.exp || ok != test.ok {
+			t.Errorf("upsertPath(%s, %q, %s): expected (%s, %v), got (%s, %v)", test.json, test.path, test.val, test.exp, test.ok, res, ok)
+		}
+	}
+}
+
+func TestRewriteAll(t *testing.T) {
+	tests := []struct {
+		json, path, val string
+		exp             string
+		ok              bool
+	}{
+		{`{"a":[{"x":1},{"x":2}]}`, "a.*.x", `0`, `{"a":[{"x":0},{"x":0}]}`, true},
+		{`{"a":[{"x":1},{"y":2},3]}`, "a.*.x", `0`, `{"a":[{"x":0},{"y":2},3]}`, true},
+		{`{"a":{"p":{"x":1},"q.r":{"x":2}}}`, "a.*.x", `0`, `{"a":{"p":{"x":0},"q.r":{"x":0}}}`, true},
+		{`{"a":[[1,2],[3]]}`, "a.*.*", `0`, `{"a":[[0,0],[0]]}`, true},
+		{`{"a":[1,2],"b":[3]}`, "*.0", `0`, `{"a":[0,2],"b":[0]}`, true},
+		{`{"a":{"*":1,"b":2}}`, `a.\*`, `0`, `{"a":{"*":0,"b":2}}`, true},
+		{`{"a":{"*":1,"b":2}}`, `a.*`, `0`, `{"a":{"*":0,"b":0}}`, true},
+		{`{"a":1}`, "", `2`, `2`, true},
+		{`{"a":[]}`, "a.*", `0`, `{"a":[]}`, false},
+		{`{"a":[{"y":1}]}`, "a.*.x", `0`, `{"a":[{"y":1}]}`, false},
+		{`{"a":1}`, "a.*", `0`, `{"a":1}`, false},
+		{`{"a":[1]}`, "a.*", `}`, `{"a":[1]}`, false},
+		{`{"":[1],"a":[2]}`, "*.0", `0`, `{"":[1],"a":[0]}`, true},
+	}
+	for _, test := range tests {
+		res, ok := rewriteAll([]byte(test.json), test.path, []byte(test.val))
+		if string(res) != test.exp || ok != test.ok {
+			t.Errorf("rewriteAll(%s, %q, %s): expected (%s, %v), got (%s, %v)", test.json, test.path, test.val, test.exp, test.ok, res, ok)
+		}
+	}
+}
+
+func TestMatchAccessor(t *testing.T) {
+	const obj = `{"items":[{"id":41,"name":"a"},{"id":42,"name":"b"},3,{"name":"c"},{"id":42,"name":"d"},{"id":"4\u0032","name":"e"}]}`
+	tests := []struct {
+		u   Update
+		exp string
+		ok  bool
+	}{
+		// first match wins
+		{NewUpdate("items.[id=42].name", "x"), `{"items":[{"id":41,"name":"a"},{"id":42,"name":"x"},3,{"name":"c"},{"id":42,"name":"d"},{"id":"4\u0032","name":"e"}]}`, true},
+		// strings are compared after decoding
+		{NewUpdate("items.[id=\"42\"].name", "x"), obj, false},
+		{NewUpdate("items.[name=e].id", 43), `{"items":[{"id":41,"name":"a"},{"id":42,"name":"b"},3,{"name":"c"},{"id":42,"name":"d"},{"id":43,"name":"e"}]}`, true},
+		{NewUpdate("items.[id=42]", 0), `{"items":[{"id":41,"name":"a"},0,3,{"name":"c"},{"id":42,"name":"d"},{"id":"4\u0032","name":"e"}]}`, true},
+		{NewDeleteUpdate("items.[name=c]"), `{"items":[{"id":41,"name":"a"},{"id":42,"name":"b"},3,{"id":42,"name":"d"},{"id":"4\u0032","name":"e"}]}`, true},
+		{NewInsertUpdate("items.[id=41]", 0), `{"items":[0,{"id":41,"name":"a"},{"id":42,"name":"b"},3,{"name":"c"},{"id":42,"name":"d"},{"id":"4\u0032","name":"e"}]}`, true},
+		{NewIncrementUpdate("items.[name=a].id", 1), `{"items":[{"id":42,"name":"a"},{"id":42,"name":"b"},3,{"name":"c"},{"id":42,"name":"d"},{"id":"4\u0032","name":"e"}]}`, true},
+		// no match
+		{NewUpdate("items.[id=40].name", "x"), obj, false},
+		{NewUpdate("items.[age=42].name", "x"), obj, false},
+		{NewDeleteUpdate("items.[id=40]"), obj, false},
+		{NewUpsertUpdate("items.[id=40].name", "x"), obj, false},
+		// not a match accessor (and thus rejected by NewUpdate)
+		{Update{Path: "items.[id].name", Value: json.RawMessage(`"x"`)}, obj, false},
+		{Update{Path: "items.[id=42", Value: json.RawMessage(`"x"`)}, obj, false},
+		// within an object, a match accessor is an ordinary key
+		{NewUpdate("[id=42]", 1), obj, false},
+		{NewUpsertUpdate("[id=42]", 1), `{"items":[{"id":41,"name":"a"},{"id":42,"name":"b"},3,{"name":"c"},{"id":42,"name":"d"},{"id":"4\u0032","name":"e"}],"[id=42]":1}`, true},
+	}
+	for _, test := range tests {
+		res, ok := test.u.apply([]byte(obj))
+		if string(res) != test.exp || ok != test.ok {
+			t.Errorf("%v: expected (%s, %v), got (%s, %v)", test.u, test.exp, test.ok, res, ok)
+		}
+	}
+	// values containing '.' must be escaped
+	res, ok := NewUpdate(`[v=1\.5].x`, 0).apply([]byte(`[{"v":1.5,"x":1}]`))
+	if !ok || string(res) != `[{"v":1.5,"x":0}]` {
+		t.Errorf("wrong result: %s", res)
+	}
+}
+
+func TestNumericKeys(t *testing.T) {
+	// the same accessor is interpreted as an object key or an array index
+	// depending on the container it is applied to
+	obj := `{"0":"a","1":"b","-1":"c","01":"d","2":{"0":"e"},"3":["f"]}`
+	arr := `["a","b",{"0":"e"},["f"]]`
+	tests := []struct {
+		json, path string
+		exp        string
+		ok         bool
+	}{
+		{obj, "0", `"a"`, true},
+		{obj, "-1", `"c"`, true},
+		{obj, "01", `"d"`, true},
+		{obj, "2.0", `"e"`, true},
+		{obj, "3.0", `"f"`, true},
+		{obj, "4", ``, false},
+		{obj, "-2", ``, false},
+		{arr, "0", `"a"`, true},
+		{arr, "-1", `["f"]`, true},
+		{arr, "01", ``, false},
+		{arr, "2.0", `"e"`, true},
+		{arr, "3.0", `"f"`, true},
+		{arr, "2.1", ``, false},
+		{arr, "3.1", ``, false},
+	}
+	for _, test := range tests {
+		res, ok := extractPath([]byte(test.json), test.path)
+		if string(res) != test.exp || ok != test.ok {
+			t.Errorf("extractPath(%s, %q): expected (%s, %v), got (%s, %v)", test.json, test.path, test.exp, test.ok, res, ok)
+		}
+	}
+
+	// the append index applies only to arrays
+	if res, ok := rewritePath([]byte(`{"0":1}`), "1", []byte(`2`)); ok {
+		t.Errorf("rewritePath should not append to an object: %s", res)
+	} else if res, ok := insertPath([]byte(`{"0":1}`), "1", []byte(`2`)); !ok || string(res) != `{"0":1,"1":2}` {
+		t.Errorf("insertPath should add a key to an object: %s", res)
+	} else if res, ok := insertPath([]byte(`[1]`), "0", []byte(`2`)); !ok || string(res) != `[2,1]` {
+		t.Errorf("insertPath should insert into an array: %s", res)
+	} else if res, ok := deletePath([]byte(`{"0":1,"1":2}`), "0"); !ok || string(res) != `{"1":2}` {
+		t.Errorf("deletePath should delete an object key: %s", res)
+	} else if res, ok := deletePath([]byte(`[1,2]`), "0"); !ok || string(res) != `[2]` {
+		t.Errorf("deletePath should delete an array element: %s", res)
+	}
+	// upsert synthesizes objects, never arrays
+	if res, ok := upsertPath([]byte(`{}`), "a.0.1", []byte(`2`)); !ok || string(res) != `{"a":{"0":{"1":2}}}` {
+		t.Errorf("upsertPath should synthesize objects: %s", res)
+	}
+}
+
+func TestTruncatedJSON(t *testing.T) {
+	docs := []string{
+		`{"a":1, "b":{"c":[1,2,{"d":"e\"f"}]}, "g":-1.5e3}`,
+		`[1, [2, 3], {"a":null}, "xéy", true, false]`,
+		`{"ab":[{"c":{}}], "d":[]}`,
+		`{"a":[0,-12.5e+3],"g":7E-1}`,
+	}
+	updates := []Update{
+		NewUpdate("", 1),
+		NewUpdate("a", 1),
+		NewUpdate("0", 1),
+		NewUpdate("b.c.2.d", 1),
+		NewUpdate("b.c.3", 1),
+		NewUpdate("1.-1", 1),
+		NewDeleteUpdate("a"),
+		NewDeleteUpdate("1.0"),
+		NewInsertUpdate("b.c.0", 1),
+		NewInsertUpdate("-", 1),
+		NewMoveUpdate("a", "g"),
+		NewCopyUpdate("0", "1.0"),
+		NewIncrementUpdate("g", 1),
+		NewIncrementUpdate("a.1", 1),
+		NewUpsertUpdate("x.y.z", 1),
+	}
+	// apply assumes a valid object, so truncated objects are rejected by the
+	// exported functions, which validate the object once
+	for _, doc := range docs {
+		for i := 0; i < len(doc); i++ {
+			obj := []byte(doc[:i])
+			for _, u := range updates {
+				res, n := Apply(obj, []Update{u})
+				if u.Path == "" {
+					if n != 1 || string(res) != "1" {
+						t.Errorf("Apply(%s, %q): expected replacement, got %s", obj, u.Path, res)
+					}
+				} else if n != 0 || string(res) != string(obj) {
+					t.Errorf("Apply(%s, %q): truncated input should be left unaltered, got %s", obj, u.Path, res)
+				}
+			}
+			if res, ok := Set(obj, "a", []byte("1")); ok || string(res) != string(obj) {
+				t.Errorf("Set(%s): truncated input should be left unaltered, got %s", obj, res)
+			}
+		}
+	}
+}
+
+func FuzzApply(f *testing.F) {
+	seeds := []struct {
+		obj, path, val string
+		op             Op
+		from           string
+	}{
+		{`{"a":1, "b":{"c":[1,2]}}`, "b.c.1", `{}`, OpReplace, ""},
+		{`{"a":1, "b":{"c":[1,2]}}`, "b.c.2", `3`, OpReplace, ""},
+		{`{"a":[ ]}`, "a.0", `3`, OpReplace, ""},
+		{`{"a":null}`, "a.0", `3`, OpReplace, ""},
+		{`{"a":[1,2,3]}`, "a.-1", `4`, OpReplace, ""},
+		{`{"a.b":{"c.":[1]}}`, `a\.b.c\..0`, `3`, OpReplace, ""},
+		{`{"ab":1,"a\"b":2}`, `a"b`, `"x"`, OpReplace, ""},
+		{`{"a":1,"a":2}`, "a", `3`, OpReplace, ""},
+		{`{"a":[1, [2], 3]}`, "a.1", ``, OpDelete, ""},
+		{`{"a":[1,2]}`, "a.-", `0`, OpInsert, ""},
+		{`{"a":{"b":1}}`, "a.c", `0`, OpInsert, ""},
+		{`{"a":[1,2],"b":{}}`, "b.x", ``, OpMove, "a.0"},
+		{`{"a":[1,2],"b":{}}`, "a.0", ``, OpCopy, "b"},
+		{`{"a":9007199254740993}`, "a", `1.5`, OpIncrement, ""},
+		{`{"a":{}}`, "a.b.0.c", `true`, OpUpsert, ""},
+		{`{"a":[{"b":1},{"b":2}]}`, "a.*.b", `0`, OpReplaceAll, ""},
+	}
+	for _, s := range seeds {
+		f.Add([]byte(s.obj), s.path, []byte(s.val), string(s.op), s.from)
+	}
+	f.Fuzz(func(t *testing.T, obj []byte, path string, val []byte, op string, from string) {
+		// our scanner must agree with encoding/json
+		if isValue(obj) != json.Valid(obj) {
+			t.Fatalf("isValue(%q) = %v, but json.Valid disagrees", obj, isValue(obj))
+		} else if !isValue(obj) {
+			return // apply requires a valid object
+		}
+		u := Update{Path: path, Value: val, Op: Op(op), From: from}
+		orig := string(obj)
+		res, ok := u.apply(obj)
+		if string(obj) != orig {
+			t.Fatalf("apply modified its input: %q -> %q", orig, obj)
+		} else if !ok && string(res) != orig {
+			t.Fatalf("apply returned false, but altered its input: %q -> %q", orig, res)
+		} else if ok && !json.Valid(res) {
+			t.Fatalf("apply(%q, %+v) produced invalid JSON: %q", orig, u, res)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package jj
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// StreamJournal reads the Journal data in r without reconstructing its object
+// in memory, which is useful for very large Journals. The initial object is
+// decoded into obj, and then fn is called with each update set, in order,
+// along with a record describing it; the caller is responsible for applying
+// the updates. Malformed update sets are passed to fn as nil, with the
+// appropriate Status. Since the updates are not applied, the SkippedUpdates
+// field of each record is always zero. If the initial object is malformed,
+// but is recovered from a later update set (see OpenJournal), obj is left
+// unmodified, and the first set passed to fn replaces the whole object.
+//
+// If fn returns an error, StreamJournal stops and returns it. If r does not
+// contain an initial object, StreamJournal returns io.EOF. The options must
+// match those used to write the Journal.
+func StreamJournal(r io.Reader, obj interface{}, fn func(set []Update, rec SetRecord) error, opts ...Option) error {
+	j := new(Journal)
+	for _, opt := range opts {
+		opt(j)
+	}
+	return j.scan(r, func(init json.RawMessage) error {
+		if init == nil {
+			// the initial object was malformed, and will be replaced by the
+			// first set
+			return nil
+		} else if err := j.unmarshal(init, obj); err != nil {
+			return fmt.Errorf("jj: could not decode object: %w", err)
+		}
+		return nil
+	}, fn)
+}
+
+// History calls fn with each update set in the Journal stored in filename,
+// in order, along with a record describing it, including any metadata
+// recorded with the set. It is like StreamJournal, but ignores the initial
+// object. Malformed update sets are passed to fn as nil, with the appropriate
+// Status. History stops at the end of the file; to wait for new update sets,
+// use Follow.
+//
+// If fn returns an error, History stops and returns it. If the file does not
+// contain an initial object, History returns io.EOF. The options must match
+// those used to write the Journal.
+func History(filename string, fn func(set []Update, rec SetRecord) error, opts ...Option) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	j := new(Journal)
+	for _, opt := range opts {
+		opt(j)
+	}
+	return j.scan(f, func(json.RawMessage) error { return nil }, fn)
+}
+
+// SetReader is like Set, but reads the JSON encoding of the value from r,
+// streaming it to the Journal rather than buffering the entire update set
+// before writing it. This avoids holding extra copies of a very large value in
+// memory; only the current object, including the new value, is retained.
+// Newlines in the value are replaced with spaces, since each update set must
+// occupy a single line. Unless WithWriteValidation was supplied, an invalid
+// value results in a malformed update set, which is ignored (both by SetReader
+// and during replay) rather than causing an error; otherwise, the value is
+// validated once it has been read, before the update set is completed.
+//
+// If reading from r fails, or the update set exceeds the limit set by
+// WithMaxSetSize, the partially-written update set is removed, as with a
+// failed write in Update. Journals that use checksums, compression, or
+// encryption encode each update set as a whole, so for them, SetReader reads
+// the entire value into memory before writing the update set.
+func (j *Journal) SetReader(path string, r io.Reader) error {
+	if j.readOnly {
+		return ErrReadOnly
+	} else if j.encoded() {
+		val, err := j.readValue(r)
+		if err != nil {
+			return err
+		}
+		return j.Update([]Update{{Path: path, Value: val}})
+	}
+	prefix := appendString(append(j.appendSetPrefix(nil, setMeta{}), `{"p":`...), path)
+	prefix = append(prefix, `,"v":`...)
+	suffix := append(j.appendSetSuffix([]byte{'}'}, setMeta{}), '\n')
+	start, wasPartial := j.size, j.partial
+	abort := func(err error) error {
+		j.partial = true
+		j.rollback(start, wasPartial)
+		return err
+	}
+	if err := j.write(prefix); err != nil {
+		return fmt.Errorf("jj: could not write update set: %w", err)
+	}
+	vw := &valueWriter{j: j, overhead: len(prefix) + len(suffix)}
+	if lr, ok := r.(interface{ Len() int }); ok {
+		vw.val.Grow(lr.Len())
+	}
+	if _, err := io.Copy(vw, r); vw.err != nil {
+		return abort(vw.err)
+	} else if err != nil {
+		return abort(fmt.Errorf("jj: could not read value: %w", err))
+	}
+	val := vw.val.Bytes()
+	if j.validate && !json.Valid(val) {
+		return abort(fmt.Errorf("%w: update 0 (%q) has an invalid value", ErrMalformed, path))
+	}
+	if err := j.write(suffix); err != nil {
+		return abort(fmt.Errorf("jj: could not write update set: %w", err))
+	}
+	var line []byte
+	if j.mirroring {
+		line = append(append(prefix, val...), suffix...)
+	}
+	if err := j.commit(context.Background(), line, []Update{{Path: path, Value: val}}); err != nil {
+		return err
+	}
+	return j.autoCheckpoint()
+}
+
+// A valueWriter writes the value of a streamed update set to its Journal,
+// replacing newlines with spaces. It retains a copy of the value, which is
+// applied to the object once the set is complete.
+type valueWriter struct {
+	j        *Journal
+	val      bytes.Buffer
+	overhead int // size of the set, excluding the value
+	err      error
+}
+
+func (vw *valueWriter) Write(p []byte) (int, error) {
+	// p may belong to the reader, so it is copied before being modified
+	n := vw.val.Len()
+	vw.val.Write(p)
+	return len(p), vw.flush(n)
+}
+
+// WriteString implements io.StringWriter, so that io.Copy from a
+// strings.Reader does not convert the string to a temporary slice.
+func (vw *valueWriter) WriteString(s string) (int, error) {
+	n := vw.val.Len()
+	vw.val.WriteString(s)
+	return len(s), vw.flush(n)
+}
+
+// flush sanitizes and writes the portion of the value beginning at off.
+func (vw *valueWriter) flush(off int) error {
+	j := vw.j
+	if size := vw.overhead + vw.val.Len(); j.maxSet > 0 && int64(size) > j.maxSet {
+		vw.err = fmt.Errorf("%w: update set exceeds limit of %v bytes", ErrTooLarge, j.maxSet)
+		return vw.err
+	}
+	c := vw.val.Bytes()[off:]
+	for i := range c {
+		if c[i] == '\n' || c[i] == '\r' {
+			c[i] = ' '
+		}
+	}
+	if err := j.write(c); err != nil {
+		vw.err = fmt.Errorf("jj: could not write update set: %w", err)
+		return vw.err
+	}
+	return nil
+}
+
+// readValue reads the value for SetReader into memory, replacing newlines
+// with spaces.
+func (j *Journal) readValue(r io.Reader) ([]byte, error) {
+	if j.maxSet > 0 {
+		r = io.LimitReader(r, j.maxSet+1)
+	}
+	val, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("jj: could not read value: %w", err)
+	} else if j.maxSet > 0 && int64(len(val)) > j.maxSet {
+		return nil, fmt.Errorf("%w: value exceeds limit of %v bytes", ErrTooLarge, j.maxSet)
+	}
+	for i := range val {
+		if val[i] == '\n' || val[i] == '\r' {
+			val[i] = ' '
+		}
+	}
+	return val, nil
+}
@@ -0,0 +1,252 @@
+package jj
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestStreamJournal(t *testing.T) {
+	data := `{"x":0,"ys":[]}
+[{"p":"x","v":1},{"p":"ys.-","o":"i","v":"a"}]
+[{"p":"x",
+[{"p":"ys.-","o":"i","v":"b"}]
+[{"p":"x","o":"+","v":2}]
+[{"p":"x"`
+
+	type state struct {
+		X  int      `json:"x"`
+		Ys []string `json:"ys"`
+	}
+	var s state
+	var recs []SetRecord
+	err := StreamJournal(strings.NewReader(data), &s, func(set []Update, rec SetRecord) error {
+		recs = append(recs, rec)
+		// fold the updates into s
+		for _, u := range set {
+			switch {
+			case u.Path == "x" && u.Op == OpReplace:
+				s.X = int(u.Value[0] - '0')
+			case u.Path == "x" && u.Op == OpIncrement:
+				s.X += int(u.Value[0] - '0')
+			case u.Path == "ys.-":
+				s.Ys = append(s.Ys, strings.Trim(string(u.Value), `"`))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if s.X != 3 || strings.Join(s.Ys, ",") != "a,b" {
+		t.Fatal("wrong state:", s)
+	}
+	statuses := []SetStatus{SetApplied, SetMalformed, SetApplied, SetApplied, SetPartial}
+	if len(recs) != len(statuses) {
+		t.Fatal("wrong number of records:", recs)
+	}
+	for i := range recs {
+		if recs[i].Status != statuses[i] {
+			t.Errorf("record %v: expected %v, got %v", i, statuses[i], recs[i].Status)
+		}
+	}
+
+	// errors from fn should stop the stream
+	errStop := errors.New("stop")
+	var calls int
+	err = StreamJournal(strings.NewReader(data), &s, func([]Update, SetRecord) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Fatal("expected stream to stop after first set:", err, calls)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestHistory")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]int{"x": 0}, WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Set("x", 1)
+	j.UpdateTagged("foo", []Update{NewUpdate("x", 2), NewUpdate("y", 3)})
+	j.Update([]Update{NewDeleteUpdate("x")})
+	j.Close()
+	// append a malformed set
+	tf, err = os.OpenFile(tf.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.WriteString("[{\"p\":\"x\",\"v\":4}]\n")
+	tf.Close()
+
+	var sets [][]Update
+	var recs []SetRecord
+	err = History(tf.Name(), func(set []Update, rec SetRecord) error {
+		sets = append(sets, set)
+		recs = append(recs, rec)
+		return nil
+	}, WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sets) != 4 {
+		t.Fatal("wrong number of sets:", len(sets))
+	}
+	exp := []struct {
+		n      int
+		tag    string
+		status SetStatus
+	}{
+		{1, "", SetApplied},
+		{2, "foo", SetApplied},
+		{1, "", SetApplied},
+		{0, "", SetMalformed},
+	}
+	for i, e := range exp {
+		if len(sets[i]) != e.n || recs[i].Tag != e.tag || recs[i].Status != e.status {
+			t.Errorf("set %v: expected %v updates, tag %q, status %v; got %v, %+v", i, e.n, e.tag, e.status, sets[i], recs[i])
+		}
+	}
+	if u := sets[1][1]; u.Path != "y" || string(u.Value) != "3" {
+		t.Error("wrong update:", u)
+	} else if u := sets[2][0]; u.Op != OpDelete {
+		t.Error("wrong update:", u)
+	}
+	// the updates are not applied, so none are skipped, even though y does
+	// not exist
+	if recs[1].SkippedUpdates != 0 {
+		t.Error("History should not apply updates:", recs[1])
+	}
+
+	if err := History(tf.Name()+"_nonexistent", nil); err == nil {
+		t.Fatal("expected error for nonexistent file")
+	}
+}
+
+func TestJournalSetReader(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestJournalSetReader")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]interface{}{"x": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if err := j.SetReader("x", strings.NewReader("{\n\"a\": [1, 2]\r\n}")); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"x":{ "a": [1, 2]  }}` {
+		t.Fatal("wrong object:", string(j.Snapshot()))
+	}
+	// invalid values are ignored
+	if err := j.SetReader("x", strings.NewReader(`{"a":`)); err != nil {
+		t.Fatal(err)
+	} else if string(j.Snapshot()) != `{"x":{ "a": [1, 2]  }}` {
+		t.Fatal("wrong object:", string(j.Snapshot()))
+	}
+	// the reader's data should not be modified
+	data := []byte("[1,\n2]")
+	if err := j.SetReader("x", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "[1,\n2]" {
+		t.Fatalf("reader data was modified: %q", data)
+	} else if string(j.Snapshot()) != `{"x":[1, 2]}` {
+		t.Fatal("wrong object:", string(j.Snapshot()))
+	}
+	// a failed read should leave no trace
+	size := j.Stats().Size
+	r := io.MultiReader(strings.NewReader(`"abc`), iotest.ErrReader(errors.New("read failed")))
+	if err := j.SetReader("x", r); err == nil {
+		t.Fatal("expected read error")
+	} else if j.Stats().Size != size {
+		t.Fatal("partial set was not removed")
+	} else if err := j.SetReader("x", strings.NewReader(`"def"`)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = ioutil.ReadFile(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj map[string]interface{}
+	j2, err := NewJournal(bytes.NewReader(data), ioutil.Discard, &obj)
+	if err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != "def" || j2.ReplaySummary().SkippedSets != 1 {
+		t.Fatal("wrong replay:", obj, j2.ReplaySummary())
+	}
+
+	// encoded Journals are supported
+	var buf bytes.Buffer
+	j2, _ = NewJournal(nil, &buf, obj, WithChecksums())
+	if err := j2.SetReader("x", strings.NewReader(`1`)); err != nil {
+		t.Fatal(err)
+	}
+	obj = nil
+	if _, err := NewJournal(&buf, ioutil.Discard, &obj, WithChecksums()); err != nil {
+		t.Fatal(err)
+	} else if obj["x"] != 1.0 {
+		t.Fatal("wrong replay:", obj)
+	}
+
+	// invalid values are rejected with validation enabled, as are values that
+	// exceed the set size limit, in both streamed and encoded Journals
+	j.Close()
+	for _, opts := range [][]Option{nil, {WithChecksums()}} {
+		os.Remove(tf.Name())
+		opts = append(opts, WithWriteValidation(), WithMaxSetSize(100))
+		j, err := OpenJournal(tf.Name(), map[string]int{"x": 0}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := j.Stats().Size
+		if err := j.SetReader("x", strings.NewReader(`{"a":`)); !errors.Is(err, ErrMalformed) {
+			t.Fatal("expected ErrMalformed, got", err)
+		} else if err := j.SetReader("x", strings.NewReader(strings.Repeat("1", 200))); !errors.Is(err, ErrTooLarge) {
+			t.Fatal("expected ErrTooLarge, got", err)
+		} else if j.Stats().Size != size {
+			t.Fatal("rejected set was not removed")
+		} else if err := j.SetReader("x", strings.NewReader(`2`)); err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		var obj map[string]int
+		if j, err = OpenJournal(tf.Name(), &obj, opts...); err != nil {
+			t.Fatal(err)
+		} else if obj["x"] != 2 || j.ReplaySummary().SkippedSets != 0 {
+			t.Fatal("wrong replay:", obj, j.ReplaySummary())
+		}
+		j.Close()
+	}
+}
+
+func BenchmarkSetReader(b *testing.B) {
+	str := strings.Repeat("a", 4<<20)
+	val := `"` + str + `"`
+	for _, mode := range []string{"Set", "SetReader"} {
+		b.Run(mode, func(b *testing.B) {
+			j, err := NewJournal(nil, ioutil.Discard, map[string]string{"x": ""})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(val)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if mode == "Set" {
+					err = j.Set("x", str)
+				} else {
+					err = j.SetReader("x", strings.NewReader(val))
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package jj
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Transact uses a two-phase commit to apply updates atomically across
+// multiple Journals: each Journal's set is written in three steps.
+//
+// 1. Prepare: the set is written to each Journal as a "prepare" record,
+// tagged with a random transaction ID. The set is synced but not applied, and
+// is ignored during replay unless it is later committed.
+//
+// 2. Commit: once every prepare record is durable, a "commit" record is
+// written to each Journal, which then applies the prepared set. During
+// replay, the prepared set is applied at the position of the commit record.
+//
+// 3. Abort: if a prepare record cannot be written, an "abort" record is
+// written to each Journal that was prepared, and the transaction has no
+// effect.
+//
+// A crash may leave some Journals with a prepared but unresolved transaction.
+// Such a transaction is pending: its updates are not applied when the Journal
+// is opened, and the Journal cannot be checkpointed. RecoverTransactions
+// resolves pending transactions. The transaction is committed if any Journal
+// contains its commit record, since commit records are only written once
+// every Journal is prepared. Otherwise it is aborted.
+//
+// batches maps each Journal to its updates. Transact returns ErrReadOnly if
+// any Journal is read-only. If the transaction commits, but the commit record
+// cannot be written to every Journal, Transact returns an error; in that case,
+// RecoverTransactions should be called to complete the transaction.
+func Transact(batches map[*Journal][]Update) error {
+	js := make([]*Journal, 0, len(batches))
+	for j := range batches {
+		if j.readOnly {
+			return ErrReadOnly
+		}
+		js = append(js, j)
+	}
+	// write to the Journals in a consistent order
+	sort.Slice(js, func(a, b int) bool { return js[a].filename < js[b].filename })
+	id := newTxID()
+
+	abort := func() {
+		for _, j := range js {
+			if _, ok := j.pending[id]; ok {
+				j.abortTx(id) // best effort; RecoverTransactions will retry
+			}
+		}
+	}
+	for _, j := range js {
+		if err := j.prepareTx(id, batches[j]); err != nil {
+			abort()
+			return fmt.Errorf("jj: could not prepare transaction: %w", err)
+		}
+	}
+	var commitErr error
+	for _, j := range js {
+		err := j.commitTx(id)
+		if err != nil && !txCommitted(id, js) {
+			// no commit record has been written, so the transaction can
+			// still be aborted
+			abort()
+			return fmt.Errorf("jj: could not commit transaction: %w", err)
+		} else if err != nil && commitErr == nil {
+			commitErr = err
+		}
+	}
+	if commitErr != nil {
+		return fmt.Errorf("jj: transaction was committed, but not applied to every Journal: %w", commitErr)
+	}
+	// a checkpoint discards the commit record, so it must not be performed
+	// until every Journal has one
+	for _, j := range js {
+		if err := j.autoCheckpoint(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecoverTransactions resolves the pending transactions of each Journal (see
+// Transact), committing those that were committed in any of the Journals and
+// aborting the rest. It should be called after opening every Journal that may
+// have participated in a transaction, before updating or checkpointing any of
+// them: a Journal only remembers the transactions it has committed since it
+// was last checkpointed or opened.
+func RecoverTransactions(js ...*Journal) error {
+	for _, j := range js {
+		ids := make([]string, 0, len(j.pending))
+		for id := range j.pending {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			var err error
+			if txCommitted(id, js) {
+				err = j.commitTx(id)
+			} else {
+				err = j.abortTx(id)
+			}
+			if err != nil {
+				return fmt.Errorf("jj: could not recover transaction %v: %w", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// PendingTransactions returns the IDs of j's pending transactions, in sorted
+// order.
+func (j *Journal) PendingTransactions() []string {
+	var ids []string
+	for id := range j.pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Transaction phases.
+const (
+	txPrepare = "p"
+	txCommit  = "c"
+	txAbort   = "a"
+)
+
+// newTxID returns a random transaction ID.
+func newTxID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// resolveTx processes a replayed update set with metadata m. If the set is
+// part of a transaction, it returns the transaction's updates if the set
+// commits it, and false otherwise.
+func (j *Journal) resolveTx(set []Update, m setMeta) ([]Update, bool) {
+	switch m.phase {
+	case "":
+		return set, true
+	case txPrepare:
+		if j.pending == nil {
+			j.pending = make(map[string][]Update)
+		}
+		j.pending[m.tx] = set
+		return nil, false
+	case txCommit:
+		set, ok := j.pending[m.tx]
+		delete(j.pending, m.tx)
+		j.markCommitted(m.tx)
+		return set, ok
+	default: // txAbort
+		delete(j.pending, m.tx)
+		return nil, false
+	}
+}
+
+// markCommitted records that the transaction id has been committed.
+func (j *Journal) markCommitted(id string) {
+	if j.committed == nil {
+		j.committed = make(map[string]bool)
+	}
+	j.committed[id] = true
+}
+
+// txCommitted reports whether the transaction id has been committed by any of
+// js.
+func txCommitted(id string, js []*Journal) bool {
+	for _, o := range js {
+		if o.committed[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareTx writes and syncs a prepare record containing us.
+func (j *Journal) prepareTx(id string, us []Update) error {
+	line, err := j.writeSet(setMeta{tx: id, phase: txPrepare}, us)
+	if err != nil {
+		return err
+	}
+	if j.pending == nil {
+		j.pending = make(map[string][]Update)
+	}
+	j.pending[id] = us
+	j.sets++
+	if err := j.sync(); err != nil {
+		return fmt.Errorf("jj: could not sync journal: %w", err)
+	}
+	j.writeMirror(line)
+	return nil
+}
+
+// commitTx writes a commit record for the pending transaction id, and then
+// applies it. Unlike Update, it does not perform automatic checkpoints.
+func (j *Journal) commitTx(id string) error {
+	us, ok := j.pending[id]
+	if !ok {
+		return fmt.Errorf("jj: transaction %v is not pending", id)
+	}
+	line, err := j.writeSet(setMeta{tx: id, phase: txCommit}, nil)
+	if err != nil {
+		return err
+	}
+	delete(j.pending, id)
+	j.markCommitted(id)
+	return j.commit(context.Background(), line, us)
+}
+
+// abortTx writes and syncs an abort record for the pending transaction id.
+func (j *Journal) abortTx(id string) error {
+	line, err := j.writeSet(setMeta{tx: id, phase: txAbort}, nil)
+	if err != nil {
+		return err
+	}
+	delete(j.pending, id)
+	j.sets++
+	if err := j.sync(); err != nil {
+		return fmt.Errorf("jj: could not sync journal: %w", err)
+	}
+	j.writeMirror(line)
+	return nil
+}
@@ -0,0 +1,183 @@
+package jj
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestTransact(t *testing.T) {
+	fa, cleanupA := tempFile(t, "TestTransact")
+	defer cleanupA()
+	fb, cleanupB := tempFile(t, "TestTransact")
+	defer cleanupB()
+	fa.Close()
+	fb.Close()
+
+	// open (or reopen) both Journals, returning their objects
+	var a, b *Journal
+	open := func() (objA, objB map[string]int) {
+		t.Helper()
+		if a != nil {
+			a.Close()
+			b.Close()
+		}
+		var err error
+		if a, err = OpenJournal(fa.Name(), &objA); err != nil {
+			t.Fatal(err)
+		} else if b, err = OpenJournal(fb.Name(), &objB); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	a, _ = OpenJournal(fa.Name(), map[string]int{"x": 0})
+	b, _ = OpenJournal(fb.Name(), map[string]int{"y": 0})
+
+	// a successful transaction
+	err := Transact(map[*Journal][]Update{
+		a: {NewUpdate("x", 1)},
+		b: {NewUpdate("y", 1), NewIncrementUpdate("y", 1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if string(a.Snapshot()) != `{"x":1}` || string(b.Snapshot()) != `{"y":2}` {
+		t.Fatal("transaction was not applied:", string(a.Snapshot()), string(b.Snapshot()))
+	}
+	if objA, objB := open(); objA["x"] != 1 || objB["y"] != 2 {
+		t.Fatal("transaction was not replayed:", objA, objB)
+	} else if len(a.PendingTransactions())+len(b.PendingTransactions()) != 0 {
+		t.Fatal("no transactions should be pending")
+	}
+
+	// crash after preparing only a
+	id := newTxID()
+	if err := a.prepareTx(id, []Update{NewUpdate("x", 2)}); err != nil {
+		t.Fatal(err)
+	} else if string(a.Snapshot()) != `{"x":1}` {
+		t.Fatal("prepared transaction should not be applied")
+	}
+	objA, _ := open()
+	if objA["x"] != 1 || len(a.PendingTransactions()) != 1 || a.PendingTransactions()[0] != id {
+		t.Fatal("prepared transaction should be pending:", objA, a.PendingTransactions())
+	} else if err := a.Checkpoint(objA); err == nil {
+		t.Fatal("Checkpoint should fail with a pending transaction")
+	} else if err := RecoverTransactions(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if objA, _ := open(); objA["x"] != 1 || len(a.PendingTransactions()) != 0 {
+		t.Fatal("transaction should have been aborted:", objA, a.PendingTransactions())
+	}
+
+	// crash after preparing both
+	id = newTxID()
+	if err := a.prepareTx(id, []Update{NewUpdate("x", 3)}); err != nil {
+		t.Fatal(err)
+	} else if err := b.prepareTx(id, []Update{NewUpdate("y", 3)}); err != nil {
+		t.Fatal(err)
+	}
+	open()
+	if err := RecoverTransactions(a, b); err != nil {
+		t.Fatal(err)
+	} else if objA, objB := open(); objA["x"] != 1 || objB["y"] != 2 {
+		t.Fatal("transaction should have been aborted:", objA, objB)
+	}
+
+	// crash after committing only a
+	id = newTxID()
+	if err := a.prepareTx(id, []Update{NewUpdate("x", 4)}); err != nil {
+		t.Fatal(err)
+	} else if err := b.prepareTx(id, []Update{NewUpdate("y", 4)}); err != nil {
+		t.Fatal(err)
+	} else if err := a.commitTx(id); err != nil {
+		t.Fatal(err)
+	}
+	objA, objB := open()
+	if objA["x"] != 4 || objB["y"] != 2 || len(b.PendingTransactions()) != 1 {
+		t.Fatal("transaction should be committed in a only:", objA, objB, b.PendingTransactions())
+	}
+	// b alone cannot know that the transaction was committed
+	if err := RecoverTransactions(a, b); err != nil {
+		t.Fatal(err)
+	} else if string(b.Snapshot()) != `{"y":4}` {
+		t.Fatal("transaction should have been rolled forward:", string(b.Snapshot()))
+	}
+	if objA, objB := open(); objA["x"] != 4 || objB["y"] != 4 {
+		t.Fatal("transaction should have been rolled forward:", objA, objB)
+	}
+
+	// committed transactions are forgotten after a checkpoint
+	if len(a.committed) == 0 {
+		t.Fatal("a should remember its committed transactions")
+	} else if err := a.Compact(); err != nil {
+		t.Fatal(err)
+	} else if len(a.committed) != 0 {
+		t.Fatal("committed transactions should be forgotten after Compact:", a.committed)
+	}
+
+	// a failed prepare aborts the transaction
+	var buf bytes.Buffer
+	ro, err := NewJournal(nil, &buf, map[string]int{"z": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro.maxSet = 10 // too small for any prepare record
+	err = Transact(map[*Journal][]Update{a: {NewUpdate("x", 5)}, ro: {NewUpdate("z", 5)}})
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatal("expected ErrTooLarge, got", err)
+	} else if string(a.Snapshot()) != `{"x":4}` || len(a.PendingTransactions()) != 0 {
+		t.Fatal("transaction should have been aborted:", string(a.Snapshot()), a.PendingTransactions())
+	}
+	if objA, _ := open(); objA["x"] != 4 {
+		t.Fatal("transaction should have been aborted:", objA)
+	}
+	ro.readOnly = true
+	if err := Transact(map[*Journal][]Update{a: {NewUpdate("x", 5)}, ro: nil}); err != ErrReadOnly {
+		t.Fatal("expected ErrReadOnly, got", err)
+	}
+	a.Close()
+	b.Close()
+}
+
+func TestTransactReaders(t *testing.T) {
+	// readers other than OpenJournal should only observe committed
+	// transactions
+	var bufA, bufB bytes.Buffer
+	a, err := NewJournal(nil, &bufA, map[string]int{"x": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewJournal(nil, &bufB, map[string]int{"x": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Transact(map[*Journal][]Update{a: {NewUpdate("x", 1)}, b: {NewUpdate("x", 1)}}); err != nil {
+		t.Fatal(err)
+	} else if err := a.prepareTx(newTxID(), []Update{NewUpdate("x", 2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var sets [][]Update
+	err = StreamJournal(bytes.NewReader(bufA.Bytes()), new(interface{}), func(set []Update, rec SetRecord) error {
+		sets = append(sets, set)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sets) != 1 || len(sets[0]) != 1 || string(sets[0][0].Value) != "1" {
+		t.Fatal("wrong sets:", sets)
+	}
+
+	tf, cleanup := tempFile(t, "TestTransactReaders")
+	defer cleanup()
+	tf.Write(bufA.Bytes())
+	tf.Close()
+	if r, err := Verify(tf.Name()); err != nil {
+		t.Fatal(err)
+	} else if !r.OK() || len(r.Sets) != 1 {
+		t.Fatal("wrong report:", r)
+	}
+	if data, err := ioutil.ReadFile(tf.Name()); err != nil || !bytes.Equal(data, bufA.Bytes()) {
+		t.Fatal("Verify modified the journal")
+	}
+}
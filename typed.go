@@ -0,0 +1,56 @@
+package jj
+
+import "fmt"
+
+// A TypedJournal is a Journal whose object is a T. Like a Journal, it may be
+// read concurrently with updates.
+type TypedJournal[T any] struct {
+	j *Journal
+}
+
+// Snapshot decodes the current object into a new T. Since each call decodes
+// a fresh T, the returned value does not share memory with values returned by
+// previous calls, and may be modified freely. Snapshot returns an error if the
+// object cannot be decoded into a T, e.g. because an update has set a field to
+// a value of the wrong type.
+func (tj *TypedJournal[T]) Snapshot() (T, error) {
+	var val T
+	if err := tj.j.unmarshal(tj.j.current(), &val); err != nil {
+		return val, fmt.Errorf("jj: could not decode object: %w", err)
+	}
+	return val, nil
+}
+
+// Update applies the updates atomically to the Journal and to the in-memory
+// object.
+func (tj *TypedJournal[T]) Update(us []Update) error {
+	return tj.j.Update(us)
+}
+
+// Set sets the value at path to val. Like Journal.Set, it reports an invalid
+// path as an error.
+func (tj *TypedJournal[T]) Set(path string, val interface{}) error {
+	return tj.j.Set(path, val)
+}
+
+// Checkpoint refreshes the Journal with a new initial object.
+func (tj *TypedJournal[T]) Checkpoint(val T) error {
+	return tj.j.Checkpoint(val)
+}
+
+// Close closes the underlying Journal.
+func (tj *TypedJournal[T]) Close() error {
+	return tj.j.Close()
+}
+
+// OpenTypedJournal opens the supplied Journal, returning it along with the
+// reconstructed object. If the Journal does not exist, it will be created and
+// init will be used as the initial object.
+func OpenTypedJournal[T any](filename string, init T, opts ...Option) (*TypedJournal[T], T, error) {
+	val := init
+	j, err := OpenJournal(filename, &val, opts...)
+	if err != nil {
+		return nil, val, err
+	}
+	return &TypedJournal[T]{j: j}, val, nil
+}
@@ -0,0 +1,78 @@
+package jj
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTypedJournal(t *testing.T) {
+	type foo struct {
+		X int   `json:"x"`
+		Y []int `json:"y"`
+	}
+
+	f, err := ioutil.TempFile("", "TestTypedJournal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.RemoveAll(f.Name())
+
+	tj, init, err := OpenTypedJournal(f.Name(), foo{X: 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if init.X != 1 || len(init.Y) != 0 {
+		t.Fatal("wrong initial object:", init)
+	}
+	if err := tj.Set("x", 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := tj.Update([]Update{NewUpdate("y.0", 2), NewUpdate("y.1", 3)}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := tj.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	} else if s.X != 7 || len(s.Y) != 2 || s.Y[1] != 3 {
+		t.Fatal("wrong snapshot:", s)
+	}
+	// modifying a snapshot should not affect later snapshots
+	s.Y[0] = 9
+	if s, err := tj.Snapshot(); err != nil {
+		t.Fatal(err)
+	} else if s.Y[0] != 2 {
+		t.Fatal("snapshots should not share memory:", s)
+	}
+	if err := tj.Checkpoint(foo{X: 8}); err != nil {
+		t.Fatal(err)
+	} else if s, err := tj.Snapshot(); err != nil {
+		t.Fatal(err)
+	} else if s.X != 8 || len(s.Y) != 0 {
+		t.Fatal("wrong snapshot after checkpoint:", s)
+	}
+	if err := tj.Set("y.0", 4); err != nil {
+		t.Fatal(err)
+	}
+	tj.Close()
+
+	// reopen; the snapshot should match the reconstructed object
+	tj, obj, err := OpenTypedJournal(f.Name(), foo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tj.Close()
+	s, err = tj.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	} else if obj.X != 8 || len(obj.Y) != 1 || obj.Y[0] != 4 || s.X != obj.X || len(s.Y) != len(obj.Y) {
+		t.Fatal("wrong object after reopening:", obj, s)
+	}
+
+	// an update of the wrong type should be reported by Snapshot
+	if err := tj.Set("x", "foo"); err != nil {
+		t.Fatal(err)
+	} else if _, err := tj.Snapshot(); err == nil {
+		t.Fatal("expected decode error")
+	}
+}
@@ -0,0 +1,183 @@
+package jj
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// A SetStatus describes the outcome of replaying an update set.
+type SetStatus int
+
+// Possible SetStatus values.
+const (
+	// SetApplied indicates that the set was applied. Individual updates
+	// within the set may have been skipped.
+	SetApplied SetStatus = iota
+	// SetMalformed indicates that the set was malformed and was skipped.
+	SetMalformed
+	// SetPartial indicates that the set was malformed and was the final line
+	// of the Journal, i.e. it was most likely only partially written. It was
+	// skipped.
+	SetPartial
+)
+
+// String implements fmt.Stringer.
+func (s SetStatus) String() string {
+	switch s {
+	case SetApplied:
+		return "applied"
+	case SetMalformed:
+		return "malformed"
+	case SetPartial:
+		return "partial"
+	default:
+		return "unknown"
+	}
+}
+
+// A SetRecord describes a single update set within a Journal.
+type SetRecord struct {
+	Offset         int64 // byte offset of the set
+	Length         int64 // length of the set, including its trailing newline
+	Status         SetStatus
+	SkippedUpdates int       // number of malformed updates within an applied set
+	Time           time.Time // commit time, if recorded; see WithTimestamps
+	Tag            string    // tag, if recorded; see UpdateTagged
+}
+
+// A Report describes the contents of a Journal, as produced by Verify.
+type Report struct {
+	// InitialErr is non-nil if the initial object is malformed. In that case,
+	// the remainder of the Report is empty, unless the object was recovered
+	// from a later update set (see OpenJournal).
+	InitialErr error
+	// Sets contains a record of each update set in the Journal, in order.
+	Sets []SetRecord
+	// FinalValid indicates whether the reconstructed object is valid JSON.
+	FinalValid bool
+}
+
+// OK reports whether the Journal is entirely free of malformed data.
+func (r *Report) OK() bool {
+	if r.InitialErr != nil || !r.FinalValid {
+		return false
+	}
+	for _, rec := range r.Sets {
+		if rec.Status != SetApplied || rec.SkippedUpdates > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify replays the Journal stored in filename, reporting on the validity
+// of each of its components. Unlike OpenJournal, it never modifies the file.
+// The options must match those used to write the Journal; WithStrict is
+// ignored. Verify only returns an error if the file cannot be read.
+func Verify(filename string, opts ...Option) (*Report, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	j := new(Journal)
+	for _, opt := range opts {
+		opt(j)
+	}
+	j.strict = false
+
+	r := new(Report)
+	obj, err := j.replay(f, func(rec SetRecord) {
+		r.Sets = append(r.Sets, rec)
+	})
+	if err != nil && !errors.Is(err, ErrMalformed) && err != io.EOF {
+		return nil, err
+	} else if err != nil {
+		r.InitialErr = err
+		r.Sets = nil
+		return r, nil
+	}
+	r.InitialErr = j.summary.InitialErr
+	r.FinalValid = json.Valid(obj)
+	return r, nil
+}
+
+// Repair replays the Journal stored in filename and replaces it with a new
+// Journal whose initial object is the reconstructed object, dropping every
+// update set (applied or not). The returned Report describes the Journal as
+// it was before the repair, so any data that was dropped can be identified
+// via its non-applied SetRecords. The options must match those used to write
+// the Journal; WithStrict is ignored.
+//
+// Like Checkpoint, Repair writes the new Journal to a temporary file and then
+// renames it, so if Repair is interrupted, the original file is left intact.
+// The Journal must not be open elsewhere. If the initial object is malformed
+// and cannot be recovered, or the reconstructed object is not valid JSON, the
+// file is not modified and Repair returns the Report along with an error.
+func Repair(filename string, opts ...Option) (*Report, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	j := new(Journal)
+	for _, opt := range opts {
+		opt(j)
+	}
+	j.strict = false
+	f, err := openLocked(filename, false, j.fileMode())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := new(Report)
+	obj, err := j.replay(f, func(rec SetRecord) {
+		r.Sets = append(r.Sets, rec)
+	})
+	if err != nil && !errors.Is(err, ErrMalformed) && err != io.EOF {
+		return nil, err
+	} else if err != nil {
+		r.InitialErr = err
+		r.Sets = nil
+		return r, fmt.Errorf("jj: could not repair journal: %w", err)
+	}
+	r.InitialErr = j.summary.InitialErr
+	if r.FinalValid = json.Valid(obj); !r.FinalValid {
+		return r, fmt.Errorf("%w: reconstructed object is not valid JSON", ErrMalformed)
+	}
+
+	line := append(j.encodeLine(obj), '\n')
+	tmpName := filename + "_tmp"
+	if j.tmpDir != "" {
+		tmpName = filepath.Join(j.tmpDir, filepath.Base(tmpName))
+	}
+	tmp, err := j.create(tmpName)
+	if err != nil {
+		return r, fmt.Errorf("jj: could not create repaired journal: %w", err)
+	}
+	defer os.Remove(tmpName)
+	if _, err := writeFull(tmp, line); err != nil {
+		tmp.Close()
+		return r, fmt.Errorf("jj: could not write repaired journal: %w", err)
+	} else if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return r, fmt.Errorf("jj: could not sync repaired journal: %w", err)
+	} else if err := tmp.Close(); err != nil {
+		return r, fmt.Errorf("jj: could not write repaired journal: %w", err)
+	}
+	if runtime.GOOS == "windows" {
+		f.Close() // an open file cannot be replaced on Windows
+	}
+	if err := rename(tmpName, filename); err != nil {
+		return r, fmt.Errorf("jj: could not replace journal: %w", err)
+	} else if err := syncDir(filepath.Dir(filename)); err != nil {
+		return r, fmt.Errorf("jj: could not sync directory: %w", err)
+	}
+	return r, nil
+}
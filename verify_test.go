@@ -0,0 +1,142 @@
+package jj
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	f, cleanup := tempFile(t, "TestVerify")
+	defer cleanup()
+	f.WriteString(`{"foo": 3}
+[{"p": "foo", "v": 4}]
+[{"p": "foo", "v": 5}
+{"p": "foo", "v": 5}
+
+[{"p": "foo", "v": 6}, {"p": "bar", "v": 7}]
+[{"p": "foo", "v": 8}`)
+	f.Close()
+
+	r, err := Verify(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	} else if r.InitialErr != nil || !r.FinalValid || r.OK() {
+		t.Fatal("wrong report:", r)
+	}
+	exp := []SetRecord{
+		{Offset: 11, Length: 23, Status: SetApplied},
+		{Offset: 34, Length: 22, Status: SetMalformed},
+		{Offset: 56, Length: 21, Status: SetMalformed},
+		{Offset: 78, Length: 45, Status: SetApplied, SkippedUpdates: 1},
+		{Offset: 123, Length: 21, Status: SetPartial},
+	}
+	if len(r.Sets) != len(exp) {
+		t.Fatal("wrong number of sets:", r.Sets)
+	}
+	for i := range exp {
+		if r.Sets[i] != exp[i] {
+			t.Errorf("set %v: expected %+v, got %+v", i, exp[i], r.Sets[i])
+		}
+	}
+
+	// a clean journal should be OK
+	j, cleanup2 := tempJournal(t, map[string]int{"foo": 1}, "TestVerify")
+	defer cleanup2()
+	j.Update([]Update{NewUpdate("foo", 2)})
+	if r, err := Verify(j.filename); err != nil {
+		t.Fatal(err)
+	} else if !r.OK() || len(r.Sets) != 1 {
+		t.Fatal("expected clean report:", r)
+	}
+
+	// a journal with a malformed initial object should report it
+	f, cleanup3 := tempFile(t, "TestVerify")
+	defer cleanup3()
+	f.WriteString(`{"foo": }`)
+	f.Close()
+	if r, err := Verify(f.Name()); err != nil {
+		t.Fatal(err)
+	} else if r.InitialErr == nil || r.OK() {
+		t.Fatal("expected initial object error:", r)
+	}
+
+	// a nonexistent file is an error
+	if _, err := Verify(f.Name() + "_nonexistent"); err == nil {
+		t.Fatal("expected error for nonexistent file")
+	}
+}
+
+func TestRepair(t *testing.T) {
+	f, cleanup := tempFile(t, "TestRepair")
+	defer cleanup()
+	f.WriteString(`{"foo": 3}
+[{"p": "foo", "v": 4}]
+[{"p": "foo", "v": 5}
+
+[{"p": "foo", "v": 6}, {"p": "bar", "v": 7}]
+[{"p": "foo", "v": 8}`)
+	f.Close()
+
+	r, err := Repair(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	} else if r.OK() || len(r.Sets) != 4 || r.Sets[1].Status != SetMalformed || r.Sets[3].Status != SetPartial {
+		t.Fatal("wrong report:", r)
+	}
+	if data, err := ioutil.ReadFile(f.Name()); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "{\"foo\": 6}\n" {
+		t.Fatalf("wrong repaired journal: %q", data)
+	}
+	if r, err := Verify(f.Name()); err != nil {
+		t.Fatal(err)
+	} else if !r.OK() || len(r.Sets) != 0 {
+		t.Fatal("repaired journal should be clean:", r)
+	}
+	if _, err := os.Stat(f.Name() + "_tmp"); !os.IsNotExist(err) {
+		t.Fatal("temp file was not removed:", err)
+	}
+
+	// repair should work with encoded journals
+	tf, cleanup2 := tempFile(t, "TestRepair")
+	defer cleanup2()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]int{"foo": 1}, WithChecksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Set("foo", 2)
+	j.Close()
+	if r, err := Repair(tf.Name(), WithChecksums()); err != nil {
+		t.Fatal(err)
+	} else if !r.OK() || len(r.Sets) != 1 {
+		t.Fatal("wrong report:", r)
+	}
+	var obj map[string]int
+	if j, err := OpenJournal(tf.Name(), &obj, WithChecksums()); err != nil {
+		t.Fatal(err)
+	} else if j.Close(); obj["foo"] != 2 {
+		t.Fatal("wrong object after repair:", obj)
+	}
+
+	// a journal with a malformed initial object cannot be repaired, and
+	// should not be modified
+	f, cleanup3 := tempFile(t, "TestRepair")
+	defer cleanup3()
+	f.WriteString(`{"foo": }`)
+	f.Close()
+	if r, err := Repair(f.Name()); !errors.Is(err, ErrMalformed) || r == nil || r.InitialErr == nil {
+		t.Fatal("expected initial object error:", r, err)
+	} else if data, _ := ioutil.ReadFile(f.Name()); string(data) != `{"foo": }` {
+		t.Fatal("journal was modified:", string(data))
+	}
+
+	// a nonexistent file is an error, and should not be created
+	if _, err := Repair(f.Name() + "_nonexistent"); err == nil {
+		t.Fatal("expected error for nonexistent file")
+	} else if _, err := os.Stat(f.Name() + "_nonexistent"); !os.IsNotExist(err) {
+		t.Fatal("Repair created a file")
+	}
+}
@@ -0,0 +1,22 @@
+package jj
+
+// OnCommit registers fn to be called after each update set is committed, i.e.
+// written, synced, and applied, with the updates in the set. fn is not called
+// if UpdateContext returns before the sync completes, since the updates are
+// not yet durable. Updates made by Undo, Replace, and SetReader are included.
+// fn must not modify the updates, and must not call methods on j that modify
+// it. Calling OnCommit again replaces fn; a nil fn unregisters it.
+//
+// Unlike Follow, which observes a Journal's file, OnCommit observes only the
+// updates made through j itself.
+func (j *Journal) OnCommit(fn func(us []Update)) {
+	j.onCommit = fn
+}
+
+// OnCheckpoint registers fn to be called after each successful Checkpoint,
+// including those performed by Compact and WithAutoCheckpoint. As with
+// OnCommit, fn must not call methods on j that modify it, and calling
+// OnCheckpoint again replaces fn.
+func (j *Journal) OnCheckpoint(fn func()) {
+	j.onCheckpoint = fn
+}
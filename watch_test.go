@@ -0,0 +1,74 @@
+package jj
+
+import (
+	"context"
+	"testing"
+)
+
+func TestJournalObservers(t *testing.T) {
+	tf, cleanup := tempFile(t, "TestJournalObservers")
+	defer cleanup()
+	tf.Close()
+	j, err := OpenJournal(tf.Name(), map[string]int{"x": 0}, WithAutoCheckpoint(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	var commits [][]Update
+	var checkpoints int
+	var snaps []string
+	j.OnCommit(func(us []Update) {
+		commits = append(commits, us)
+		snaps = append(snaps, string(j.Snapshot()))
+	})
+	j.OnCheckpoint(func() { checkpoints++ })
+
+	if err := j.Set("x", 1); err != nil {
+		t.Fatal(err)
+	} else if len(commits) != 1 || len(commits[0]) != 1 || commits[0][0].Path != "x" {
+		t.Fatal("wrong commits:", commits)
+	} else if snaps[0] != `{"x":1}` {
+		t.Fatal("callback should observe the applied update:", snaps[0])
+	} else if err := j.Undo(); err != nil {
+		t.Fatal(err)
+	} else if len(commits) != 2 || snaps[1] != `{"x":0}` {
+		t.Fatal("Undo should be observed:", snaps)
+	}
+
+	// a canceled update is not observed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := j.UpdateContext(ctx, []Update{NewUpdate("x", 2)}); err == nil {
+		t.Fatal("expected error")
+	} else if len(commits) != 2 {
+		t.Fatal("canceled update should not be observed")
+	}
+
+	if err := j.Checkpoint(map[string]int{"x": 3}); err != nil {
+		t.Fatal(err)
+	} else if checkpoints != 1 {
+		t.Fatal("Checkpoint should be observed:", checkpoints)
+	}
+	// trigger an automatic checkpoint
+	for j.Len() > 0 || checkpoints == 1 {
+		if err := j.Set("x", 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if checkpoints != 2 {
+		t.Fatal("automatic Checkpoint should be observed:", checkpoints)
+	}
+
+	// unregister
+	j.OnCommit(nil)
+	j.OnCheckpoint(nil)
+	n := len(commits)
+	if err := j.Set("x", 5); err != nil {
+		t.Fatal(err)
+	} else if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	} else if len(commits) != n || checkpoints != 2 {
+		t.Fatal("unregistered callbacks should not be called")
+	}
+}